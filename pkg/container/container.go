@@ -18,7 +18,9 @@ type ContainerContext struct {
 	containersByCgroupId map[string]*Container
 	containersByPid      map[uint32]*Container
 	events               chan ebpftracer.Event
+	l7Events             chan ebpftracer.Event
 	ebpftracer           *ebpftracer.EBPFTracer
+	tlsUprobes           *TlsUprobes
 	conntrack            *system.Conntrack
 }
 
@@ -28,6 +30,7 @@ func NewContainerContext(kernelVersion string) (*ContainerContext, error) {
 	ctx := &ContainerContext{
 		ContainerClientProvider: NewContainerClientProvider(),
 		events:                  make(chan ebpftracer.Event, 10000),
+		l7Events:                make(chan ebpftracer.Event, 10000),
 		containersById:          map[string]*Container{},
 		containersByCgroupId:    map[string]*Container{},
 		containersByPid:         map[uint32]*Container{},
@@ -36,6 +39,7 @@ func NewContainerContext(kernelVersion string) (*ContainerContext, error) {
 		klog.Warning(err)
 	} else {
 		ctx.ebpftracer = ebpftracer
+		ctx.tlsUprobes = NewTlsUprobes(ebpftracer)
 	}
 	if conntrack, err := system.NewHostNetConntrack(); err != nil {
 		return nil, err
@@ -43,22 +47,78 @@ func NewContainerContext(kernelVersion string) (*ContainerContext, error) {
 		ctx.conntrack = conntrack
 	}
 	ctx.ebpfEventSubscribe()
-	go ctx.handleEvents(ctx.events)
+	go ctx.handleEvents(ctx.events, ctx.l7Events)
 	ctx.initContainer(ctx.events)
 	return ctx, nil
 }
 
+// Tracer returns the eBPF tracer, nil when it failed to start.
+func (ctx *ContainerContext) Tracer() *ebpftracer.EBPFTracer {
+	return ctx.ebpftracer
+}
+
+// SetTracerFeatures changes the programs attached by the eBPF tracer, the TLS uprobes are detached
+// when the tls feature is disabled and attached to the running processes again when it's enabled.
+func (ctx *ContainerContext) SetTracerFeatures(config ebpftracer.FeatureConfig) error {
+	if ctx.ebpftracer == nil {
+		return fmt.Errorf("the eBPF tracer isn't running")
+	}
+	err := ctx.ebpftracer.SetFeatures(config)
+	if !config.Tls || !config.L7 {
+		ctx.tlsUprobes.Detach()
+	} else {
+		ctx.tlsUprobes.Attach()
+	}
+	return err
+}
+
+// Close detaches the TLS uprobes and stops the eBPF tracer, the events already queued are still handled.
+func (ctx *ContainerContext) Close() {
+	if ctx.tlsUprobes != nil {
+		ctx.tlsUprobes.Close()
+	}
+	if ctx.ebpftracer != nil {
+		ctx.ebpftracer.Close()
+	}
+}
+
+// ebpfEventSubscribe receives the lifecycle events of the processes and the connections in a queue which
+// is never dropped from, the containers and the connections would be left stale otherwise. The L7 requests
+// and the retransmits are sampled data, the oldest are dropped rather than stalling the tracer when
+// handleEvents falls behind.
 func (ctx *ContainerContext) ebpfEventSubscribe() {
-	ctx.ebpftracer.SubscribeEvents(ebpftracer.EventTypeProcessStart, ctx.events)
-	ctx.ebpftracer.SubscribeEvents(ebpftracer.EventTypeProcessExit, ctx.events)
-	ctx.ebpftracer.SubscribeEvents(ebpftracer.EventTypeConnectionOpen, ctx.events)
-	ctx.ebpftracer.SubscribeEvents(ebpftracer.EventTypeConnectionClose, ctx.events)
-	ctx.ebpftracer.SubscribeEvents(ebpftracer.EventTypeConnectionError, ctx.events)
-	ctx.ebpftracer.SubscribeEvents(ebpftracer.EventTypeListenOpen, ctx.events)
-	ctx.ebpftracer.SubscribeEvents(ebpftracer.EventTypeListenClose, ctx.events)
-	ctx.ebpftracer.SubscribeEvents(ebpftracer.EventTypeFileOpen, ctx.events)
-	ctx.ebpftracer.SubscribeEvents(ebpftracer.EventTypeTCPRetransmit, ctx.events)
-	ctx.ebpftracer.SubscribeEvents(ebpftracer.EventTypeL7Request, ctx.events)
+	if ctx.ebpftracer == nil {
+		return
+	}
+	err := ctx.ebpftracer.Subscribe("containers", ebpftracer.SubscriptionConfig{
+		QueueSize:  cap(ctx.events),
+		DropPolicy: ebpftracer.Block,
+		Filter: ebpftracer.EventFilter{Types: []ebpftracer.EventType{
+			ebpftracer.EventTypeProcessStart,
+			ebpftracer.EventTypeProcessExit,
+			ebpftracer.EventTypeConnectionOpen,
+			ebpftracer.EventTypeConnectionClose,
+			ebpftracer.EventTypeConnectionError,
+			ebpftracer.EventTypeConnectionAccept,
+			ebpftracer.EventTypeListenOpen,
+			ebpftracer.EventTypeListenClose,
+			ebpftracer.EventTypeFileOpen,
+		}},
+	}, ctx.events)
+	if err != nil {
+		klog.Warning(err)
+	}
+	err = ctx.ebpftracer.Subscribe("containers-l7", ebpftracer.SubscriptionConfig{
+		QueueSize:  cap(ctx.l7Events),
+		DropPolicy: ebpftracer.DropOldest,
+		Filter: ebpftracer.EventFilter{Types: []ebpftracer.EventType{
+			ebpftracer.EventTypeTCPRetransmit,
+			ebpftracer.EventTypeL7Request,
+		}},
+	}, ctx.l7Events)
+	if err != nil {
+		klog.Warning(err)
+	}
 }
 
 func (ctx *ContainerContext) initContainer(ch chan<- ebpftracer.Event) {
@@ -69,41 +129,91 @@ func (ctx *ContainerContext) initContainer(ch chan<- ebpftracer.Event) {
 	for _, pid := range pids {
 		ch <- ebpftracer.Event{Type: ebpftracer.EventTypeProcessStart, Pid: pid}
 	}
+	// the containers are created by the events above, the sockets they already have are queued after them,
+	// the channel is drained by handleEvents so none of them is dropped
+	if ctx.ebpftracer != nil {
+		for _, e := range ctx.ebpftracer.Init(pids) {
+			ch <- e
+		}
+	}
 }
 
-func (ctx *ContainerContext) handleEvents(ch <-chan ebpftracer.Event) {
+// handleEvents handles the queued lifecycle events first, so the connection of a request is usually
+// known by the time the request is handled.
+func (ctx *ContainerContext) handleEvents(lifecycle, l7Events <-chan ebpftracer.Event) {
 	for {
 		select {
-		case event, more := <-ch:
+		case event, more := <-lifecycle:
 			if !more {
 				return
 			}
-			switch event.Type {
-			case ebpftracer.EventTypeProcessStart:
-				ctx.createContainer(event.Pid)
-			case ebpftracer.EventTypeProcessExit:
-				if c, exists := ctx.containersByPid[event.Pid]; exists {
-					delete(ctx.containersByCgroupId, c.Cgroup.Id)
-					delete(ctx.containersById, c.ContainerID)
-					delete(ctx.containersByPid, event.Pid)
-				}
-			case ebpftracer.EventTypeConnectionOpen:
-				if c, ok := ctx.containersByPid[event.Pid]; c != nil && ok {
-					c.OnConnectionOpen(event.SrcAddr, event.DstAddr, event.Pid, event.Fd, event.Timestamp, false)
-				}
-			case ebpftracer.EventTypeConnectionError:
-				if c, ok := ctx.containersByPid[event.Pid]; c != nil && ok {
-					c.OnConnectionOpen(event.SrcAddr, event.DstAddr, event.Pid, event.Fd, 0, true)
-				}
-			case ebpftracer.EventTypeL7Request:
-				if event.L7Request == nil {
-					continue
-				}
-				if c, ok := ctx.containersByPid[event.Pid]; c != nil && ok {
-					c.OnL7Request(event.Pid, event.Fd, event.Timestamp, event.L7Request)
-				}
+			ctx.handleEvent(event)
+			continue
+		default:
+		}
+		select {
+		case event, more := <-lifecycle:
+			if !more {
+				return
 			}
+			ctx.handleEvent(event)
+		case event := <-l7Events:
+			ctx.handleEvent(event)
+		}
+	}
+}
+
+func (ctx *ContainerContext) handleEvent(event ebpftracer.Event) {
+	switch event.Type {
+	case ebpftracer.EventTypeProcessStart:
+		ctx.createContainer(event.Pid)
+		if c := ctx.containersByPid[event.Pid]; c != nil && ctx.tlsUprobes != nil {
+			ctx.tlsUprobes.OnProcessStart(event.Pid)
+		}
+	case ebpftracer.EventTypeProcessExit:
+		if ctx.tlsUprobes != nil {
+			ctx.tlsUprobes.OnProcessExit(event.Pid)
+		}
+		// the ignored pids are kept with a nil container
+		if c, exists := ctx.containersByPid[event.Pid]; c != nil && exists {
+			c.OnProcessExit(event.Pid)
+			delete(ctx.containersByCgroupId, c.Cgroup.Id)
+			delete(ctx.containersById, c.ContainerID)
+		}
+		delete(ctx.containersByPid, event.Pid)
+	case ebpftracer.EventTypeConnectionOpen:
+		if c, ok := ctx.containersByPid[event.Pid]; c != nil && ok {
+			c.OnConnectionOpen(event.SrcAddr, event.DstAddr, event.Pid, event.Fd, event.Timestamp, false, event.PreExisting)
+		}
+	case ebpftracer.EventTypeConnectionError:
+		if c, ok := ctx.containersByPid[event.Pid]; c != nil && ok {
+			c.OnConnectionOpen(event.SrcAddr, event.DstAddr, event.Pid, event.Fd, 0, true, false)
+		}
+	case ebpftracer.EventTypeConnectionClose:
+		// the pid is unknown for the connections established before the tracer started
+		if c, ok := ctx.containersByPid[event.Pid]; c != nil && ok && event.Pid != 0 {
+			c.OnConnectionClose(event.Pid, event.Fd, event.Timestamp)
+		}
+	case ebpftracer.EventTypeConnectionAccept:
+		if c, ok := ctx.containersByPid[event.Pid]; c != nil && ok {
+			c.OnConnectionAccept(event.SrcAddr, event.DstAddr, event.Pid, event.Fd, event.Timestamp, event.PreExisting)
+		}
+	case ebpftracer.EventTypeListenOpen:
+		if c, ok := ctx.containersByPid[event.Pid]; c != nil && ok {
+			c.OnListenOpen(event.SrcAddr)
+		}
+	case ebpftracer.EventTypeListenClose:
+		if c, ok := ctx.containersByPid[event.Pid]; c != nil && ok {
+			c.OnListenClose(event.SrcAddr)
+		}
+	case ebpftracer.EventTypeL7Request:
+		if event.L7Request == nil {
+			return
+		}
+		if c, ok := ctx.containersByPid[event.Pid]; c != nil && ok {
+			c.OnL7Request(event.Pid, event.Fd, event.Timestamp, event.L7Request)
 		}
+		event.L7Request.Release()
 	}
 }
 
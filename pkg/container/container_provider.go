@@ -9,6 +9,7 @@ import (
 
 	"github.com/kwaisu/sense-agent/pkg/cgroup"
 	"github.com/kwaisu/sense-agent/pkg/ebpftracer/l7"
+	"github.com/kwaisu/sense-agent/pkg/exporter/trace"
 	"github.com/kwaisu/sense-agent/pkg/system"
 )
 
@@ -25,7 +26,10 @@ type Container struct {
 	connectsFailed     map[netaddr.IPPort]int64 // dst -> count
 	connectionsActive  map[AddrPair]*ActiveConnection
 	connectLastAttempt map[netaddr.IPPort]time.Time // dst -> time
+	listens            map[netaddr.IPPort]bool
+	serverStats        map[ServerStatsKey]*L7Stats
 	hostConntrack      *system.Conntrack
+	traces             *trace.TraceProvider
 }
 type PidFd struct {
 	Pid uint32
@@ -42,6 +46,14 @@ type ActiveConnection struct {
 	Fd         uint64
 	Timestamp  uint64
 	Closed     time.Time
+	// PreExisting connections were open before the agent started, their Timestamp is unknown
+	PreExisting bool
+	// Inbound connections are accepted by the container, Dest is the client then
+	Inbound  bool
+	Listen   netaddr.IPPort
+	src      netaddr.IPPort
+	resolved bool
+	trace    *trace.Trace
 }
 
 type ContainerPort struct {
@@ -77,6 +89,8 @@ type ContainerClient interface {
 
 type ContainerClientProvider struct {
 	client ContainerClient
+	// Traces receives the spans of the L7 requests, they aren't traced when it's nil
+	Traces *trace.TraceProvider
 }
 
 func NewContainerClientProvider() *ContainerClientProvider {
@@ -109,6 +123,9 @@ func (c *ContainerClientProvider) NewContainer(containerID string, metadata *Con
 		connectsFailed:     make(map[netaddr.IPPort]int64),
 		connectionsActive:  make(map[AddrPair]*ActiveConnection),
 		connectLastAttempt: make(map[netaddr.IPPort]time.Time),
+		listens:            make(map[netaddr.IPPort]bool),
+		serverStats:        make(map[ServerStatsKey]*L7Stats),
+		traces:             c.Traces,
 	}
 	return contianer, nil
 }
@@ -124,9 +141,135 @@ func (c *Container) OnL7Request(pid uint32, fd uint64, timestamp uint64, r *l7.R
 	if timestamp != 0 && conn.Timestamp != timestamp {
 		return
 	}
+	if r.Server && conn.Inbound {
+		c.onServerRequest(conn, r)
+	} else if !r.Server && !conn.Inbound {
+		conn.trace.L7Request(r)
+	}
+}
+
+// onServerRequest accounts a request served on an accepted connection,
+// the requests served before the addresses of the connection are known are skipped.
+func (c *Container) onServerRequest(conn *ActiveConnection, r *l7.RequestData) {
+	if !conn.resolved {
+		return
+	}
+	key := ServerStatsKey{Protocol: r.Protocol, Port: conn.Listen.Port()}
+	stats := c.serverStats[key]
+	if stats == nil {
+		stats = newL7Stats()
+		c.serverStats[key] = stats
+	}
+	stats.observe(r.Status, r.Duration)
+	conn.trace.L7Request(r)
+}
+
+func (c *Container) OnListenOpen(addr netaddr.IPPort) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.listens[addr] = true
+}
+
+func (c *Container) OnListenClose(addr netaddr.IPPort) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.listens, addr)
+}
+
+// OnConnectionAccept registers a connection accepted by the container, so the requests it serves are tracked.
+// The addresses are reported by the kernel, they are read from /proc when it didn't.
+func (c *Container) OnConnectionAccept(listen, client netaddr.IPPort, pid uint32, fd uint64, timestamp uint64, preExisting bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	conn := &ActiveConnection{Pid: pid, Fd: fd, Timestamp: timestamp, Inbound: true, PreExisting: preExisting}
+	if listen.IsValid() {
+		c.setAcceptedAddrs(conn, listen, client)
+	} else {
+		go c.resolveAccepted(conn)
+	}
+	c.connectionsByPidFd[PidFd{Pid: pid, Fd: fd}] = conn
+}
+
+// resolveAccepted runs outside of the event loop, GetSocket parses every socket of the network namespace.
+func (c *Container) resolveAccepted(conn *ActiveConnection) {
+	s, err := system.GetSocket(conn.Pid, conn.Fd)
+	if err != nil || s == nil {
+		klog.Warningf("failed to resolve the accepted connection pid=%d fd=%d: %v", conn.Pid, conn.Fd, err)
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.setAcceptedAddrs(conn, s.SAddr, s.DAddr)
+}
+
+// setAcceptedAddrs must be called with the lock held
+func (c *Container) setAcceptedAddrs(conn *ActiveConnection, listen, client netaddr.IPPort) {
+	conn.Listen, conn.Dest, conn.ActualDest = listen, client, client
+	conn.resolved = true
+	if c.traces != nil {
+		conn.trace = c.traces.NewServerTrace(c.ContainerID, listen, client)
+	}
+}
+
+// OnConnectionClose forgets a closed connection. The timestamp tells apart the connections using the same fd,
+// it's zero for the connections open before the tracer started.
+func (c *Container) OnConnectionClose(pid uint32, fd uint64, timestamp uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := PidFd{Pid: pid, Fd: fd}
+	conn := c.connectionsByPidFd[key]
+	if conn == nil || timestamp != 0 && conn.Timestamp != timestamp {
+		return
+	}
+	c.forget(key, conn)
+}
+
+// OnProcessExit forgets the connections of the process, their close events may have been lost.
+func (c *Container) OnProcessExit(pid uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, conn := range c.connectionsByPidFd {
+		if key.Pid == pid {
+			c.forget(key, conn)
+		}
+	}
+}
+
+// forget must be called with the lock held
+func (c *Container) forget(key PidFd, conn *ActiveConnection) {
+	conn.Closed = time.Now()
+	delete(c.connectionsByPidFd, key)
+	if !conn.Inbound {
+		pair := AddrPair{src: conn.src, dst: conn.ActualDest}
+		if c.connectionsActive[pair] == conn {
+			delete(c.connectionsActive, pair)
+		}
+	}
+}
+
+// Listens returns the addresses the container is listening on.
+func (c *Container) Listens() []netaddr.IPPort {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	res := make([]netaddr.IPPort, 0, len(c.listens))
+	for addr := range c.listens {
+		res = append(res, addr)
+	}
+	return res
+}
+
+// ServerStats returns a copy of the RED stats of the requests served by the container.
+func (c *Container) ServerStats() map[ServerStatsKey]L7Stats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	res := make(map[ServerStatsKey]L7Stats, len(c.serverStats))
+	for k, s := range c.serverStats {
+		res[k] = s.copy()
+	}
+	return res
 }
 
-func (c *Container) OnConnectionOpen(srcAddr, dstAddr netaddr.IPPort, pid uint32, fd uint64, timestamp uint64, isConnectError bool) {
+func (c *Container) OnConnectionOpen(srcAddr, dstAddr netaddr.IPPort, pid uint32, fd uint64, timestamp uint64, isConnectError, preExisting bool) {
 	if dstAddr.IP().IsLoopback() {
 		return
 	}
@@ -135,11 +278,13 @@ func (c *Container) OnConnectionOpen(srcAddr, dstAddr netaddr.IPPort, pid uint32
 		actualDst = &dstAddr
 	}
 	activeConnection := &ActiveConnection{
-		ActualDest: *actualDst,
-		Pid:        pid,
-		Fd:         fd,
-		Timestamp:  timestamp,
-		Dest:       dstAddr,
+		ActualDest:  *actualDst,
+		Pid:         pid,
+		Fd:          fd,
+		Timestamp:   timestamp,
+		Dest:        dstAddr,
+		PreExisting: preExisting,
+		src:         srcAddr,
 	}
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -147,6 +292,9 @@ func (c *Container) OnConnectionOpen(srcAddr, dstAddr netaddr.IPPort, pid uint32
 		c.connectsFailed[dstAddr]++
 		klog.Infof("OnConnectionError contianer: %s, pid = %d,Fd = %d, srcadd = %s:%d, destaddr =  %s:%d,Timestamp =  %d", c.Metadata.Name, pid, fd, srcAddr.IP().String(), srcAddr.Port(), dstAddr.IP().String(), dstAddr.Port(), timestamp)
 	} else {
+		if c.traces != nil {
+			activeConnection.trace = c.traces.NewTrace(c.ContainerID, *actualDst)
+		}
 		c.connectionsActive[AddrPair{src: srcAddr, dst: *actualDst}] = activeConnection
 		c.connectionsByPidFd[PidFd{Pid: pid, Fd: fd}] = activeConnection
 		c.connectsSuccessful[AddrPair{src: srcAddr, dst: *actualDst}]++
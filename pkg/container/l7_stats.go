@@ -0,0 +1,50 @@
+package container
+
+import (
+	"time"
+
+	"github.com/kwaisu/sense-agent/pkg/ebpftracer/l7"
+)
+
+// L7LatencyBuckets are the upper bounds in seconds of the request latency histograms.
+var L7LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type ServerStatsKey struct {
+	Protocol l7.Protocol
+	Port     uint16
+}
+
+// L7Stats are the request rate, errors and latency of a protocol.
+type L7Stats struct {
+	Requests map[l7.Status]uint64
+	// LatencyBuckets are cumulative like prometheus buckets, one per L7LatencyBuckets
+	LatencyBuckets []uint64
+	LatencyCount   uint64
+	LatencySum     float64
+}
+
+func newL7Stats() *L7Stats {
+	return &L7Stats{Requests: map[l7.Status]uint64{}, LatencyBuckets: make([]uint64, len(L7LatencyBuckets))}
+}
+
+func (s *L7Stats) observe(status l7.Status, duration time.Duration) {
+	s.Requests[status]++
+	v := duration.Seconds()
+	for i, b := range L7LatencyBuckets {
+		if v <= b {
+			s.LatencyBuckets[i]++
+		}
+	}
+	s.LatencyCount++
+	s.LatencySum += v
+}
+
+func (s *L7Stats) copy() L7Stats {
+	res := *s
+	res.Requests = make(map[l7.Status]uint64, len(s.Requests))
+	for k, v := range s.Requests {
+		res.Requests[k] = v
+	}
+	res.LatencyBuckets = append([]uint64(nil), s.LatencyBuckets...)
+	return res
+}
@@ -0,0 +1,101 @@
+package container
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"inet.af/netaddr"
+
+	"github.com/kwaisu/sense-agent/pkg/ebpftracer"
+	"github.com/kwaisu/sense-agent/pkg/ebpftracer/l7"
+)
+
+func TestServerRequests(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+	conn, err := l.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	assert.NoError(t, err)
+	var fd uint64
+	assert.NoError(t, raw.Control(func(s uintptr) { fd = uint64(s) }))
+
+	c, err := (&ContainerClientProvider{}).NewContainer("c1", &ContainerMetadata{}, nil, 0, nil)
+	assert.NoError(t, err)
+	pid := uint32(os.Getpid())
+	// the addresses weren't reported by the kernel, they are read from /proc in the background
+	c.OnConnectionAccept(netaddr.IPPort{}, netaddr.IPPort{}, pid, fd, 100, false)
+	assert.Eventually(t, func() bool {
+		c.lock.RLock()
+		defer c.lock.RUnlock()
+		return c.connectionsByPidFd[PidFd{Pid: pid, Fd: fd}].resolved
+	}, time.Second, time.Millisecond)
+	c.OnL7Request(pid, fd, 100, &l7.RequestData{Protocol: l7.ProtocolHTTP, Status: 200, Duration: 20 * time.Millisecond, Server: true})
+	c.OnL7Request(pid, fd, 100, &l7.RequestData{Protocol: l7.ProtocolHTTP, Status: 503, Duration: 2 * time.Second, Server: true})
+	// a request of another connection using the same fd is ignored
+	c.OnL7Request(pid, fd, 99, &l7.RequestData{Protocol: l7.ProtocolHTTP, Status: 200, Server: true})
+
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+	stats := c.ServerStats()
+	assert.Len(t, stats, 1)
+	s := stats[ServerStatsKey{Protocol: l7.ProtocolHTTP, Port: port}]
+	assert.Equal(t, map[l7.Status]uint64{200: 1, 503: 1}, s.Requests)
+	assert.Equal(t, uint64(2), s.LatencyCount)
+	assert.Equal(t, uint64(1), s.LatencyBuckets[2]) // 0.025
+	assert.Equal(t, uint64(2), s.LatencyBuckets[len(s.LatencyBuckets)-1])
+
+	conns := c.connectionsByPidFd[PidFd{Pid: pid, Fd: fd}]
+	assert.Equal(t, client.LocalAddr().String(), conns.Dest.String())
+}
+
+func TestPreExistingServerConnection(t *testing.T) {
+	c, err := (&ContainerClientProvider{}).NewContainer("c1", &ContainerMetadata{}, nil, 0, nil)
+	assert.NoError(t, err)
+	listen, client := netaddr.MustParseIPPort("10.0.0.2:5432"), netaddr.MustParseIPPort("10.0.0.1:43210")
+	c.OnConnectionAccept(listen, client, 1, 7, 0, true)
+	c.OnL7Request(1, 7, 0, &l7.RequestData{Protocol: l7.ProtocolPostgres, Status: l7.StatusOk, Server: true})
+
+	conn := c.connectionsByPidFd[PidFd{Pid: 1, Fd: 7}]
+	assert.True(t, conn.PreExisting)
+	assert.Equal(t, client, conn.Dest)
+	assert.Equal(t, map[l7.Status]uint64{l7.StatusOk: 1}, c.ServerStats()[ServerStatsKey{Protocol: l7.ProtocolPostgres, Port: 5432}].Requests)
+}
+
+func TestConnectionClose(t *testing.T) {
+	c, err := (&ContainerClientProvider{}).NewContainer("c1", &ContainerMetadata{}, nil, 0, nil)
+	assert.NoError(t, err)
+	listen, client := netaddr.MustParseIPPort("10.0.0.2:5432"), netaddr.MustParseIPPort("10.0.0.1:43210")
+	c.OnConnectionAccept(listen, client, 1, 7, 100, false)
+	c.OnConnectionAccept(listen, client, 1, 8, 200, false)
+	c.OnConnectionAccept(listen, client, 2, 7, 300, false)
+
+	// the close of an older connection which used the same fd
+	c.OnConnectionClose(1, 7, 50)
+	assert.Len(t, c.connectionsByPidFd, 3)
+	c.OnConnectionClose(1, 7, 100)
+	assert.NotContains(t, c.connectionsByPidFd, PidFd{Pid: 1, Fd: 7})
+
+	c.OnProcessExit(1)
+	assert.Len(t, c.connectionsByPidFd, 1)
+	assert.Contains(t, c.connectionsByPidFd, PidFd{Pid: 2, Fd: 7})
+}
+
+func TestProcessExitIgnoredPid(t *testing.T) {
+	ctx := &ContainerContext{
+		containersById:       map[string]*Container{},
+		containersByCgroupId: map[string]*Container{},
+		containersByPid:      map[uint32]*Container{42: nil},
+	}
+	assert.NotPanics(t, func() {
+		ctx.handleEvent(ebpftracer.Event{Type: ebpftracer.EventTypeProcessExit, Pid: 42})
+	})
+	assert.NotContains(t, ctx.containersByPid, uint32(42))
+}
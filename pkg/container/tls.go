@@ -0,0 +1,327 @@
+package container
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cilium/ebpf/link"
+	"k8s.io/klog/v2"
+
+	"github.com/kwaisu/sense-agent/pkg/ebpftracer"
+)
+
+// a process is started by fork, the uprobes are attached once it's likely to have executed its binary
+const tlsAttachDelay = time.Second
+
+// tlsAttacher finds the binaries of a process implementing TLS and attaches the uprobes to them.
+type tlsAttacher struct {
+	paths   func(pid uint32) []string
+	inspect func(pid uint32, path string) (ebpftracer.TlsBinary, error)
+	attach  func(pid uint32, b ebpftracer.TlsBinary) ([]link.Link, error)
+	// track registers the processes running a library whose sessions are matched by the socket syscalls
+	track   func(pid uint32) error
+	untrack func(pid uint32)
+}
+
+func newTlsAttacher(tracer *ebpftracer.EBPFTracer) tlsAttacher {
+	return tlsAttacher{
+		paths:   ebpftracer.FindTlsBinaryPaths,
+		inspect: ebpftracer.InspectTlsBinary,
+		attach:  tracer.AttachTlsUprobes,
+		track:   tracer.TrackTlsSessions,
+		untrack: tracer.UntrackTlsSessions,
+	}
+}
+
+type binaryKey struct {
+	dev uint64
+	ino uint64
+}
+
+// tlsBinary holds the uprobes of a binary, a binary without a TLS library has no links
+// and it isn't inspected again while processes are running it.
+type tlsBinary struct {
+	info  ebpftracer.TlsBinary
+	err   error
+	links []link.Link
+	pids  map[uint32]bool
+	// sessions is set once the uprobes of a library tracking its sessions by pid are attached
+	sessions bool
+}
+
+// TlsBinaryReport tells which TLS library was found in a binary and whether it's instrumented.
+type TlsBinaryReport struct {
+	ebpftracer.TlsBinary
+	Attached bool
+	// Error is why the uprobes couldn't be attached
+	Error string
+	// Processes is the number of running processes mapping the binary
+	Processes int
+}
+
+// TlsUprobes attaches the TLS uprobes to the binaries run by the processes of the tracked containers.
+// An uprobe fires in every process mapping the binary, so the uprobes are attached once per inode
+// and detached when the last process running the binary exits.
+type TlsUprobes struct {
+	attacher tlsAttacher
+	delay    time.Duration
+	lock     sync.Mutex
+	binaries map[binaryKey]*tlsBinary
+	pids     map[uint32][]binaryKey
+	// pending are the processes waiting for tlsAttachDelay
+	pending map[uint32]*time.Timer
+	// processes are the running processes, they are attached again when the uprobes are re-enabled
+	processes map[uint32]bool
+	// disabled is set by Detach, or when the tracer reports the tls feature as disabled, until Attach
+	disabled bool
+	closed   bool
+}
+
+func NewTlsUprobes(tracer *ebpftracer.EBPFTracer) *TlsUprobes {
+	return newTlsUprobes(newTlsAttacher(tracer), tlsAttachDelay)
+}
+
+func newTlsUprobes(attacher tlsAttacher, delay time.Duration) *TlsUprobes {
+	return &TlsUprobes{
+		attacher:  attacher,
+		delay:     delay,
+		binaries:  map[binaryKey]*tlsBinary{},
+		pids:      map[uint32][]binaryKey{},
+		pending:   map[uint32]*time.Timer{},
+		processes: map[uint32]bool{},
+	}
+}
+
+// OnProcessStart attaches the uprobes of the process after a delay, the binaries are read outside of the event loop.
+func (u *TlsUprobes) OnProcessStart(pid uint32) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.closed {
+		return
+	}
+	u.processes[pid] = true
+	if u.disabled || u.pending[pid] != nil || u.pids[pid] != nil {
+		return
+	}
+	u.schedule(pid)
+}
+
+// schedule must be called with the lock held
+func (u *TlsUprobes) schedule(pid uint32) {
+	u.pending[pid] = time.AfterFunc(u.delay, func() { u.attach(pid) })
+}
+
+func (u *TlsUprobes) OnProcessExit(pid uint32) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	delete(u.processes, pid)
+	if t := u.pending[pid]; t != nil {
+		t.Stop()
+		delete(u.pending, pid)
+	}
+	for _, key := range u.pids[pid] {
+		b := u.binaries[key]
+		if b == nil {
+			continue
+		}
+		delete(b.pids, pid)
+		if b.sessions {
+			u.attacher.untrack(pid)
+		}
+		if len(b.pids) == 0 {
+			closeLinks(b.links)
+			delete(u.binaries, key)
+		}
+	}
+	delete(u.pids, pid)
+}
+
+// Close detaches all the uprobes, nothing is attached afterwards.
+func (u *TlsUprobes) Close() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.closed = true
+	u.processes = map[uint32]bool{}
+	u.detach()
+}
+
+// Detach detaches the uprobes until Attach is called, the processes started meanwhile are only recorded.
+func (u *TlsUprobes) Detach() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.disabled = true
+	u.detach()
+}
+
+// Attach instruments the running processes again after Detach, or after the tracer
+// reported the tls feature as disabled.
+func (u *TlsUprobes) Attach() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.closed || !u.disabled {
+		return
+	}
+	u.disabled = false
+	u.detach()
+	for pid := range u.processes {
+		u.schedule(pid)
+	}
+}
+
+// detach must be called with the lock held, the pending processes are dropped as well
+func (u *TlsUprobes) detach() {
+	for _, t := range u.pending {
+		t.Stop()
+	}
+	u.pending = map[uint32]*time.Timer{}
+	for _, b := range u.binaries {
+		closeLinks(b.links)
+		if b.sessions {
+			for pid := range b.pids {
+				u.attacher.untrack(pid)
+			}
+		}
+	}
+	u.binaries = map[binaryKey]*tlsBinary{}
+	u.pids = map[uint32][]binaryKey{}
+}
+
+// Attached returns the number of binaries with uprobes attached.
+func (u *TlsUprobes) Attached() int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	n := 0
+	for _, b := range u.binaries {
+		if len(b.links) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Report returns the binaries implementing TLS run by the tracked processes, sorted by path.
+func (u *TlsUprobes) Report() []TlsBinaryReport {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	var res []TlsBinaryReport
+	for _, b := range u.binaries {
+		if b.info.Library == "" {
+			continue
+		}
+		r := TlsBinaryReport{TlsBinary: b.info, Attached: len(b.links) > 0, Processes: len(b.pids)}
+		if b.err != nil {
+			r.Error = b.err.Error()
+		}
+		res = append(res, r)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Path < res[j].Path })
+	return res
+}
+
+// attach reads the binaries without the lock. A binary shared by processes starting together is attached
+// by the first of them, the others only hold a reference to it.
+func (u *TlsUprobes) attach(pid uint32) {
+	u.lock.Lock()
+	if _, ok := u.pending[pid]; !ok {
+		u.lock.Unlock()
+		return
+	}
+	delete(u.pending, pid)
+	u.pids[pid] = []binaryKey{}
+	u.lock.Unlock()
+
+	for _, path := range u.attacher.paths(pid) {
+		key, err := getBinaryKey(path)
+		if err != nil {
+			continue
+		}
+		u.lock.Lock()
+		if _, running := u.pids[pid]; !running {
+			u.lock.Unlock()
+			return
+		}
+		u.pids[pid] = append(u.pids[pid], key)
+		b := u.binaries[key]
+		if b != nil {
+			b.pids[pid] = true
+			if b.sessions {
+				u.track(pid)
+			}
+			u.lock.Unlock()
+			continue
+		}
+		b = &tlsBinary{pids: map[uint32]bool{pid: true}}
+		u.binaries[key] = b
+		u.lock.Unlock()
+
+		info, links, err := u.instrument(pid, path)
+
+		u.lock.Lock()
+		if errors.Is(err, ebpftracer.ErrTlsDisabled) {
+			// the failure isn't cached, the processes are attached again by Attach
+			if u.binaries[key] == b {
+				delete(u.binaries, key)
+			}
+			u.disabled = true
+			u.lock.Unlock()
+			return
+		}
+		if u.binaries[key] != b {
+			// every process running the binary exited in the meantime
+			closeLinks(links)
+		} else {
+			b.info, b.links, b.err = info, links, err
+			if len(links) > 0 && info.TracksSessions() {
+				b.sessions = true
+				for p := range b.pids {
+					u.track(p)
+				}
+			}
+		}
+		u.lock.Unlock()
+	}
+}
+
+// track must be called with the lock held
+func (u *TlsUprobes) track(pid uint32) {
+	if err := u.attacher.track(pid); err != nil {
+		klog.Warningf("pid=%d: failed to track the TLS sessions: %s", pid, err)
+	}
+}
+
+func (u *TlsUprobes) instrument(pid uint32, path string) (ebpftracer.TlsBinary, []link.Link, error) {
+	info, err := u.attacher.inspect(pid, path)
+	var links []link.Link
+	if err == nil && info.Library != "" {
+		links, err = u.attacher.attach(pid, info)
+	}
+	if info.Static {
+		// the report shows the executable rather than its /proc link
+		if exe, err := os.Readlink(path); err == nil {
+			info.Path = exe
+		}
+	}
+	return info, links, err
+}
+
+func getBinaryKey(path string) (binaryKey, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return binaryKey{}, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return binaryKey{}, os.ErrInvalid
+	}
+	return binaryKey{dev: uint64(st.Dev), ino: st.Ino}, nil
+}
+
+func closeLinks(links []link.Link) {
+	for _, l := range links {
+		_ = l.Close()
+	}
+}
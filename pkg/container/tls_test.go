@@ -0,0 +1,153 @@
+package container
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf/link"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kwaisu/sense-agent/pkg/ebpftracer"
+)
+
+type testLink struct {
+	link.Link
+	closed *atomic.Int32
+}
+
+func (l testLink) Close() error {
+	l.closed.Add(1)
+	return nil
+}
+
+func TestTlsUprobes(t *testing.T) {
+	dir := t.TempDir()
+	libssl, gnutls, app, sh := dir+"/libssl.so.3", dir+"/libgnutls.so.30", dir+"/app", dir+"/sh"
+	for _, f := range []string{libssl, gnutls, app, sh} {
+		assert.NoError(t, os.WriteFile(f, nil, 0644))
+	}
+	// pids 1 and 2 share libssl, pid 3 is a Go binary with no supported version, pid 6 uses GnuTLS
+	paths := map[uint32][]string{1: {sh, libssl}, 2: {sh, libssl}, 3: {app}, 4: {sh}, 6: {sh, gnutls}}
+	binaries := map[string]ebpftracer.TlsBinary{
+		libssl: {Path: libssl, Library: ebpftracer.TlsLibraryOpenSsl, Version: "v3.0.2"},
+		gnutls: {Path: gnutls, Library: ebpftracer.TlsLibraryGnuTls},
+		app:    {Path: app, Library: ebpftracer.TlsLibraryGoTls, Version: "v1.16", Static: true},
+		sh:     {Path: sh, Static: true},
+	}
+
+	var inspected, attached atomic.Int32
+	closed := &atomic.Int32{}
+	var tracked sync.Map
+	u := newTlsUprobes(tlsAttacher{
+		paths: func(pid uint32) []string { return paths[pid] },
+		inspect: func(pid uint32, path string) (ebpftracer.TlsBinary, error) {
+			inspected.Add(1)
+			b := binaries[path]
+			if b.Library == ebpftracer.TlsLibraryGoTls {
+				return b, errors.New("go versions below v1.17.0 are not supported")
+			}
+			return b, nil
+		},
+		attach: func(pid uint32, b ebpftracer.TlsBinary) ([]link.Link, error) {
+			attached.Add(1)
+			return []link.Link{testLink{closed: closed}, testLink{closed: closed}}, nil
+		},
+		track: func(pid uint32) error {
+			tracked.Store(pid, true)
+			return nil
+		},
+		untrack: func(pid uint32) { tracked.Delete(pid) },
+	}, 10*time.Millisecond)
+	isTracked := func(pid uint32) bool {
+		_, ok := tracked.Load(pid)
+		return ok
+	}
+
+	for _, pid := range []uint32{1, 2, 3, 6} {
+		u.OnProcessStart(pid)
+	}
+	// the process exits before the delay, nothing is attached for it
+	u.OnProcessStart(4)
+	u.OnProcessExit(4)
+	assert.Eventually(t, func() bool { return u.Attached() == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, int32(2), attached.Load(), "libssl is attached once")
+	assert.Equal(t, int32(4), inspected.Load(), "every binary is inspected once")
+
+	assert.Equal(t, []TlsBinaryReport{
+		{TlsBinary: binaries[app], Error: "go versions below v1.17.0 are not supported", Processes: 1},
+		{TlsBinary: binaries[gnutls], Attached: true, Processes: 1},
+		{TlsBinary: binaries[libssl], Attached: true, Processes: 2},
+	}, u.Report())
+	assert.True(t, isTracked(6), "the syscalls of the GnuTLS process are matched with its sessions")
+	assert.False(t, isTracked(1), "OpenSSL passes the fds to the uprobes")
+
+	u.OnProcessExit(1)
+	assert.Equal(t, int32(0), closed.Load(), "libssl is still used by pid 2")
+	u.OnProcessExit(2)
+	assert.Equal(t, int32(2), closed.Load())
+	assert.Equal(t, 1, u.Attached())
+
+	u.Detach()
+	assert.False(t, isTracked(6))
+	assert.Equal(t, int32(4), closed.Load())
+	assert.Equal(t, 0, u.Attached())
+	assert.Empty(t, u.Report())
+
+	u.Close()
+	assert.Equal(t, int32(4), closed.Load())
+	u.OnProcessStart(5)
+	assert.Empty(t, u.pending)
+}
+
+func TestTlsUprobesReattach(t *testing.T) {
+	dir := t.TempDir()
+	libssl := dir + "/libssl.so.3"
+	assert.NoError(t, os.WriteFile(libssl, nil, 0644))
+	var disabled atomic.Bool
+	var attempts atomic.Int32
+	closed := &atomic.Int32{}
+	u := newTlsUprobes(tlsAttacher{
+		paths: func(pid uint32) []string { return []string{libssl} },
+		inspect: func(pid uint32, path string) (ebpftracer.TlsBinary, error) {
+			return ebpftracer.TlsBinary{Path: path, Library: ebpftracer.TlsLibraryOpenSsl, Version: "v3.0.2"}, nil
+		},
+		attach: func(pid uint32, b ebpftracer.TlsBinary) ([]link.Link, error) {
+			attempts.Add(1)
+			if disabled.Load() {
+				return nil, ebpftracer.ErrTlsDisabled
+			}
+			return []link.Link{testLink{closed: closed}}, nil
+		},
+		track:   func(pid uint32) error { return nil },
+		untrack: func(pid uint32) {},
+	}, time.Millisecond)
+
+	// the feature is disabled in the tracer, the failure isn't cached
+	disabled.Store(true)
+	u.OnProcessStart(1)
+	assert.Eventually(t, func() bool { return attempts.Load() == 1 }, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		u.lock.Lock()
+		defer u.lock.Unlock()
+		return u.disabled && len(u.pending) == 0
+	}, time.Second, time.Millisecond)
+	assert.Empty(t, u.Report())
+	u.OnProcessStart(2)
+	assert.Empty(t, u.pending, "nothing is attached until the feature is enabled")
+
+	disabled.Store(false)
+	u.Attach()
+	assert.Eventually(t, func() bool { return u.Attached() == 1 && len(u.Report()) == 1 && u.Report()[0].Processes == 2 }, time.Second, time.Millisecond)
+
+	u.Detach()
+	assert.Equal(t, int32(1), closed.Load())
+	u.OnProcessStart(3)
+	assert.Empty(t, u.pending)
+	u.Attach()
+	assert.Eventually(t, func() bool { return u.Attached() == 1 && len(u.Report()) == 1 && u.Report()[0].Processes == 3 }, time.Second, time.Millisecond)
+	u.Close()
+}
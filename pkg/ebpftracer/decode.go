@@ -0,0 +1,150 @@
+package ebpftracer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/kwaisu/sense-agent/pkg/ebpftracer/l7"
+)
+
+// the sizes of the event structs as written by the eBPF programs, the fields are packed
+const (
+	l7EventSize   = 48
+	fileEventSize = 16
+	procEventSize = 12
+	tcpEventSize  = 60
+)
+
+var errShortRecord = errors.New("record is too short")
+
+// The decoders below replace binary.Read, which allocates and uses reflection for every record.
+
+func decodeL7Event(b []byte, v *l7Event) error {
+	if len(b) < l7EventSize {
+		return errShortRecord
+	}
+	le := binary.LittleEndian
+	v.Fd = le.Uint64(b[0:])
+	v.ConnectionTimestamp = le.Uint64(b[8:])
+	v.Pid = le.Uint32(b[16:])
+	v.Status = le.Uint32(b[20:])
+	v.Duration = le.Uint64(b[24:])
+	v.Protocol = b[32]
+	v.Method = b[33]
+	v.Server = le.Uint16(b[34:])
+	v.StatementId = le.Uint32(b[36:])
+	v.PayloadSize = le.Uint64(b[40:])
+	return nil
+}
+
+func decodeFileEvent(b []byte, v *fileEvent) error {
+	if len(b) < fileEventSize {
+		return errShortRecord
+	}
+	le := binary.LittleEndian
+	v.Type = EventType(le.Uint32(b[0:]))
+	v.Pid = le.Uint32(b[4:])
+	v.Fd = le.Uint64(b[8:])
+	return nil
+}
+
+func decodeProcEvent(b []byte, v *procEvent) error {
+	if len(b) < procEventSize {
+		return errShortRecord
+	}
+	le := binary.LittleEndian
+	v.Type = EventType(le.Uint32(b[0:]))
+	v.Pid = le.Uint32(b[4:])
+	v.Reason = le.Uint32(b[8:])
+	return nil
+}
+
+func decodeTcpEvent(b []byte, v *tcpEvent) error {
+	if len(b) < tcpEventSize {
+		return errShortRecord
+	}
+	le := binary.LittleEndian
+	v.Fd = le.Uint64(b[0:])
+	v.Timestamp = le.Uint64(b[8:])
+	v.Type = EventType(le.Uint32(b[16:]))
+	v.Pid = le.Uint32(b[20:])
+	v.SPort = le.Uint16(b[24:])
+	v.DPort = le.Uint16(b[26:])
+	copy(v.SAddr[:], b[28:44])
+	copy(v.DAddr[:], b[44:60])
+	return nil
+}
+
+var cupsPayload = []byte("CUPS/2.4.1")
+
+// decode appends the events of a raw perf sample to events, the samples that must be skipped add none.
+// The L7 request and its payload are pooled, they are reused once released by every subscriber.
+func (t *EBPFTracer) decode(typ perfMapType, sample []byte, events []Event) ([]Event, error) {
+	switch typ {
+	case perfMapTypeL7Events:
+		var v l7Event
+		if err := decodeL7Event(sample, &v); err != nil {
+			return events, err
+		}
+		payload := sample[l7EventSize:]
+		size := v.PayloadSize
+		if size > MaxPayloadSize {
+			size = MaxPayloadSize
+		}
+		if size > uint64(len(payload)) {
+			size = uint64(len(payload))
+		}
+		payload = payload[:size]
+		if bytes.Contains(payload, cupsPayload) {
+			return events, nil
+		}
+		if l7.Protocol(v.Protocol) == l7.ProtocolHTTP2 {
+			// the duration of the frame events is the kernel time they were sent or received at
+			return t.http2Requests(&v, payload, events), nil
+		}
+		req := l7.AcquireRequestData()
+		req.Protocol = l7.Protocol(v.Protocol)
+		req.Status = l7.Status(v.Status)
+		req.Duration = time.Duration(v.Duration)
+		req.Method = l7.Method(v.Method)
+		req.StatementId = v.StatementId
+		req.Server = v.Server == 1
+		if size > 0 {
+			// the perf record is reused by the reader
+			req.CopyPayload(payload)
+		}
+		if req.Protocol == l7.ProtocolHTTP {
+			req.TraceContext = l7.ParseHttpTraceContext(req.Payload)
+		}
+		req.Payload = t.redactor.Load().Redact(req.Payload)
+		return append(events, Event{Type: EventTypeL7Request, Pid: v.Pid, Fd: v.Fd, Timestamp: v.ConnectionTimestamp, L7Request: req}), nil
+	case perfMapTypeFileEvents:
+		var v fileEvent
+		if err := decodeFileEvent(sample, &v); err != nil {
+			return events, err
+		}
+		return append(events, Event{Type: v.Type, Pid: v.Pid, Fd: v.Fd}), nil
+	case perfMapTypeProcEvents:
+		var v procEvent
+		if err := decodeProcEvent(sample, &v); err != nil {
+			return events, err
+		}
+		return append(events, Event{Type: v.Type, Reason: EventReason(v.Reason), Pid: v.Pid}), nil
+	case perfMapTypeTCPEvents:
+		var v tcpEvent
+		if err := decodeTcpEvent(sample, &v); err != nil {
+			return events, err
+		}
+		return append(events, Event{
+			Type:      v.Type,
+			Pid:       v.Pid,
+			SrcAddr:   ipPort(v.SAddr, v.SPort),
+			DstAddr:   ipPort(v.DAddr, v.DPort),
+			Fd:        v.Fd,
+			Timestamp: v.Timestamp,
+		}), nil
+	}
+	return events, nil
+}
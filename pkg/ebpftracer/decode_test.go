@@ -0,0 +1,231 @@
+package ebpftracer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kwaisu/sense-agent/pkg/ebpftracer/l7"
+)
+
+// samples are encoded like the records written by the eBPF programs
+var (
+	httpPayload  = []byte("GET /api/v1/users?limit=10 HTTP/1.1\r\nHost: users:8080\r\nUser-Agent: Go-http-client/1.1\r\nAccept-Encoding: gzip\r\n\r\n")
+	redisPayload = []byte("*2\r\n$3\r\nGET\r\n$12\r\nsession:1234\r\n")
+)
+
+func encode(t testing.TB, v any, payload []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, binary.Write(buf, binary.LittleEndian, v))
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+func l7Sample(t testing.TB, protocol l7.Protocol, payload []byte) []byte {
+	return encode(t, &l7Event{
+		Fd: 12, ConnectionTimestamp: 123456789, Pid: 4242, Status: 200, Duration: uint64(3 * time.Millisecond),
+		Protocol: uint8(protocol), Method: 1, Server: 1, StatementId: 7, PayloadSize: uint64(len(payload)),
+	}, payload)
+}
+
+func tcpSample(t testing.TB) []byte {
+	v := &tcpEvent{Fd: 5, Timestamp: 987654321, Type: EventTypeConnectionOpen, Pid: 4242, SPort: 43210, DPort: 5432}
+	copy(v.SAddr[:], []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 0, 0, 1})
+	copy(v.DAddr[:], []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 0, 0, 2})
+	return encode(t, v, nil)
+}
+
+func testTracer(t testing.TB) *EBPFTracer {
+	tracer := newEBPFTracer()
+	redactor, err := l7.NewRedactor(l7.RedactionConfig{})
+	assert.NoError(t, err)
+	tracer.redactor.Store(redactor)
+	return tracer
+}
+
+// decodeOne decodes a sample that converts to a single event at most
+func decodeOne(t testing.TB, tracer *EBPFTracer, typ perfMapType, sample []byte) (Event, bool, error) {
+	events, err := tracer.decode(typ, sample, nil)
+	assert.LessOrEqual(t, len(events), 1)
+	if len(events) == 0 {
+		return Event{}, false, err
+	}
+	return events[0], true, err
+}
+
+func TestDecoders(t *testing.T) {
+	assert.Equal(t, l7EventSize, binary.Size(l7Event{}))
+	assert.Equal(t, fileEventSize, binary.Size(fileEvent{}))
+	assert.Equal(t, procEventSize, binary.Size(procEvent{}))
+	assert.Equal(t, tcpEventSize, binary.Size(tcpEvent{}))
+
+	sample := l7Sample(t, l7.ProtocolHTTP, httpPayload)
+	var expected, actual l7Event
+	assert.NoError(t, binary.Read(bytes.NewReader(sample), binary.LittleEndian, &expected))
+	assert.NoError(t, decodeL7Event(sample, &actual))
+	assert.Equal(t, expected, actual)
+
+	sample = tcpSample(t)
+	var expectedTcp, actualTcp tcpEvent
+	assert.NoError(t, binary.Read(bytes.NewReader(sample), binary.LittleEndian, &expectedTcp))
+	assert.NoError(t, decodeTcpEvent(sample, &actualTcp))
+	assert.Equal(t, expectedTcp, actualTcp)
+
+	sample = encode(t, &procEvent{Type: EventTypeProcessExit, Pid: 1, Reason: uint32(EventReasonOOMKill)}, nil)
+	var proc procEvent
+	assert.NoError(t, decodeProcEvent(sample, &proc))
+	assert.Equal(t, procEvent{Type: EventTypeProcessExit, Pid: 1, Reason: uint32(EventReasonOOMKill)}, proc)
+
+	sample = encode(t, &fileEvent{Type: EventTypeFileOpen, Pid: 1, Fd: 3}, nil)
+	var file fileEvent
+	assert.NoError(t, decodeFileEvent(sample, &file))
+	assert.Equal(t, fileEvent{Type: EventTypeFileOpen, Pid: 1, Fd: 3}, file)
+
+	assert.Equal(t, errShortRecord, decodeTcpEvent(sample, &actualTcp))
+}
+
+func TestDecode(t *testing.T) {
+	tracer := testTracer(t)
+	sample := l7Sample(t, l7.ProtocolHTTP, httpPayload)
+	event, ok, err := decodeOne(t, tracer, perfMapTypeL7Events, sample)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, EventTypeL7Request, event.Type)
+	assert.Equal(t, uint32(4242), event.Pid)
+	assert.Equal(t, uint64(12), event.Fd)
+	assert.Equal(t, uint64(123456789), event.Timestamp)
+	r := event.L7Request
+	assert.Equal(t, l7.ProtocolHTTP, r.Protocol)
+	assert.Equal(t, 3*time.Millisecond, r.Duration)
+	assert.True(t, r.Server)
+	assert.Equal(t, httpPayload, r.Payload)
+
+	// the payload is a copy, the perf record is reused by the reader
+	sample[l7EventSize] = 'P'
+	assert.Equal(t, byte('G'), r.Payload[0])
+
+	// the payload size is capped by the record size
+	sample = l7Sample(t, l7.ProtocolRedis, redisPayload)
+	event, ok, err = decodeOne(t, tracer, perfMapTypeL7Events, sample[:len(sample)-4])
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, redisPayload[:len(redisPayload)-4], event.L7Request.Payload)
+
+	_, ok, _ = decodeOne(t, tracer, perfMapTypeL7Events, l7Sample(t, l7.ProtocolHTTP, []byte("GET /printers HTTP/1.1\r\nUser-Agent: CUPS/2.4.1\r\n")))
+	assert.False(t, ok)
+
+	event, ok, err = decodeOne(t, tracer, perfMapTypeTCPEvents, tcpSample(t))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.1:43210", event.SrcAddr.String())
+	assert.Equal(t, "10.0.0.2:5432", event.DstAddr.String())
+}
+
+func TestPublishReleasesRequests(t *testing.T) {
+	tracer := testTracer(t)
+	ch1, ch2 := make(chan Event, 1), make(chan Event, 1)
+	assert.NoError(t, tracer.SubscribeEvents(EventTypeL7Request, ch1))
+	assert.NoError(t, tracer.SubscribeEvents(EventTypeL7Request, ch2))
+	event, _, _ := decodeOne(t, tracer, perfMapTypeL7Events, l7Sample(t, l7.ProtocolRedis, redisPayload))
+	tracer.publish(event, nil)
+	r1, r2 := (<-ch1).L7Request, (<-ch2).L7Request
+	r1.Release()
+	assert.Equal(t, redisPayload, r2.Payload, "the request is reused only when every subscriber released it")
+	r2.Release()
+}
+
+func BenchmarkDecodeL7(b *testing.B) {
+	tracer := testTracer(b)
+	samples := [][]byte{l7Sample(b, l7.ProtocolHTTP, httpPayload), l7Sample(b, l7.ProtocolRedis, redisPayload)}
+	var buf [4]Event
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		events, err := tracer.decode(perfMapTypeL7Events, samples[i%len(samples)], buf[:0])
+		if err != nil {
+			b.Fatal(err)
+		}
+		events[0].L7Request.Release()
+	}
+}
+
+func BenchmarkDecodeTcp(b *testing.B) {
+	tracer := testTracer(b)
+	sample := tcpSample(b)
+	var buf [4]Event
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tracer.decode(perfMapTypeTCPEvents, sample, buf[:0]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// recordedSamples reads the payloads of testdata/l7_payloads.txt
+func recordedSamples(b *testing.B) [][]byte {
+	data, err := os.ReadFile("testdata/l7_payloads.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	protocols := map[string]l7.Protocol{
+		"http": l7.ProtocolHTTP, "redis": l7.ProtocolRedis, "postgres": l7.ProtocolPostgres,
+		"mysql": l7.ProtocolMysql, "mongo": l7.ProtocolMongo,
+	}
+	var samples [][]byte
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, quoted, _ := strings.Cut(line, " ")
+		payload, err := strconv.Unquote(quoted)
+		if err != nil {
+			b.Fatal(err)
+		}
+		samples = append(samples, l7Sample(b, protocols[name], []byte(payload)))
+	}
+	return samples
+}
+
+// BenchmarkDecodeRecordedL7 decodes and redacts the recorded payloads like the reader does.
+func BenchmarkDecodeRecordedL7(b *testing.B) {
+	tracer := testTracer(b)
+	samples := recordedSamples(b)
+	var buf [4]Event
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		events, err := tracer.decode(perfMapTypeL7Events, samples[i%len(samples)], buf[:0])
+		if err != nil {
+			b.Fatal(err)
+		}
+		events[0].L7Request.Release()
+	}
+}
+
+// BenchmarkBinaryReadRecordedL7 is the path BenchmarkDecodeRecordedL7 replaces: the reflection based decoding
+// and every redaction regexp matched against every payload.
+func BenchmarkBinaryReadRecordedL7(b *testing.B) {
+	redactor, err := l7.NewRedactor(l7.RedactionConfig{DisableBuiltin: true, Rules: l7.BuiltinRedactionRules()})
+	if err != nil {
+		b.Fatal(err)
+	}
+	samples := recordedSamples(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		v := &l7Event{}
+		reader := bytes.NewBuffer(samples[i%len(samples)])
+		if err := binary.Read(reader, binary.LittleEndian, v); err != nil {
+			b.Fatal(err)
+		}
+		r := &l7.RequestData{Protocol: l7.Protocol(v.Protocol), Payload: reader.Bytes()[:v.PayloadSize]}
+		r.Payload = redactor.Redact(r.Payload)
+	}
+}
@@ -14,6 +14,7 @@
 #define EVENT_TYPE_LISTEN_CLOSE 	7
 #define EVENT_TYPE_FILE_OPEN		8
 #define EVENT_TYPE_TCP_RETRANSMIT	9
+#define EVENT_TYPE_CONNECTION_ACCEPT	11
 
 #define EVENT_REASON_OOM_KILL		1
 
@@ -26,6 +27,44 @@
     }                                                 \
 })
 
+// Since 5.8 the events are sent through ring buffers shared by all CPUs, they keep the order of the events
+// and don't reserve memory per CPU. The size of a ring buffer is set by the agent when the map is created.
+// The reader of a ring buffer isn't told about the events which didn't fit, they are counted per CPU
+// in the <name>_lost array, so the map must be named in the bpf_events_output call.
+#if __KERNEL_FROM >= 508
+#define EVENTS_MAP(name)                            \
+struct {                                            \
+    __uint(type, BPF_MAP_TYPE_RINGBUF);             \
+    __uint(max_entries, 256 * 1024);                \
+} name SEC(".maps");                                \
+struct {                                            \
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);        \
+    __type(key, __u32);                             \
+    __type(value, __u64);                           \
+    __uint(max_entries, 1);                         \
+} name##_lost SEC(".maps")
+
+#define bpf_events_output(ctx, map, data, size)                 \
+({                                                              \
+    if (bpf_ringbuf_output(map, data, size, 0)) {               \
+        __u32 ____zero = 0;                                     \
+        __u64 *____lost = bpf_map_lookup_elem(map##_lost, &____zero); \
+        if (____lost) {                                         \
+            (*____lost)++;                                      \
+        }                                                       \
+    }                                                           \
+})
+#else
+#define EVENTS_MAP(name)                            \
+struct {                                            \
+    __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);    \
+    __uint(key_size, sizeof(int));                  \
+    __uint(value_size, sizeof(int));                \
+} name SEC(".maps")
+
+#define bpf_events_output(ctx, map, data, size) bpf_perf_event_output(ctx, map, BPF_F_CURRENT_CPU, data, size)
+#endif
+
 #define bpf_printk(fmt, ...)                                   \
 ({                                                             \
     char ____fmt[] = fmt;                                      \
@@ -36,8 +75,11 @@
 #include "file.c"
 #include "tcp/state.c"
 #include "tcp/retransmit.c"
+#include "tcp/accept.c"
 #include "l7/l7.c"
 #include "l7/gotls.c"
 #include "l7/openssl.c"
+#include "l7/gnutls.c"
+#include "l7/jsse.c"
 
 char _license[] SEC("license") = "GPL";
@@ -6,11 +6,7 @@ struct file_event {
 	__u64 fd;
 };
 
-struct {
-	__uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
-	__uint(key_size, sizeof(int));
-	__uint(value_size, sizeof(int));
-} file_events SEC(".maps");
+EVENTS_MAP(file_events);
 
 struct {
 	__uint(type, BPF_MAP_TYPE_HASH);
@@ -71,7 +67,7 @@ int trace_exit(struct trace_event_raw_sys_exit__stub* ctx)
 		.pid = id >> 32,
 		.fd = ctx->ret,
 	};
-	bpf_perf_event_output(ctx, &file_events, BPF_F_CURRENT_CPU, &e, sizeof(e));
+	bpf_events_output(ctx, &file_events, &e, sizeof(e));
 	return 0;
 }
 
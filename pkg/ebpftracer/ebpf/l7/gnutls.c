@@ -0,0 +1,26 @@
+// The GnuTLS sessions are tracked by tls_session.c, the fd is learned from the syscalls made by the record calls.
+
+SEC("uprobe/gnutls_record_send_enter")
+int gnutls_record_send_enter(struct pt_regs *ctx) {
+    return tls_session_write(ctx, PT_REGS_PARM1(ctx), (char*)PT_REGS_PARM2(ctx), PT_REGS_PARM3(ctx));
+}
+
+SEC("uprobe/gnutls_record_send_exit")
+int gnutls_record_send_exit(struct pt_regs *ctx) {
+    return tls_session_write_exit();
+}
+
+SEC("uprobe/gnutls_record_recv_enter")
+int gnutls_record_recv_enter(struct pt_regs *ctx) {
+    return tls_session_read_enter(PT_REGS_PARM1(ctx), (char*)PT_REGS_PARM2(ctx));
+}
+
+SEC("uprobe/gnutls_record_recv_exit")
+int gnutls_record_recv_exit(struct pt_regs *ctx) {
+    return tls_session_read_exit(ctx, (long int)PT_REGS_RC(ctx));
+}
+
+SEC("uprobe/gnutls_deinit_enter")
+int gnutls_deinit_enter(struct pt_regs *ctx) {
+    return tls_session_free(PT_REGS_PARM1(ctx));
+}
@@ -0,0 +1,23 @@
+// JSSE runs JIT compiled in anonymous memory, the uprobes are attached to the functions exported by the JVMTI agent
+// of jsse/sense_jsse.c instead. Their arguments follow SSL_write and SSL_read, the session is the tag of the stream
+// and the sessions are tracked by tls_session.c.
+
+SEC("uprobe/jsse_write_enter")
+int jsse_write_enter(struct pt_regs *ctx) {
+    return tls_session_write(ctx, PT_REGS_PARM1(ctx), (char*)PT_REGS_PARM2(ctx), PT_REGS_PARM3(ctx));
+}
+
+SEC("uprobe/jsse_read_enter")
+int jsse_read_enter(struct pt_regs *ctx) {
+    return tls_session_read_enter(PT_REGS_PARM1(ctx), (char*)PT_REGS_PARM2(ctx));
+}
+
+SEC("uprobe/jsse_read_exit")
+int jsse_read_exit(struct pt_regs *ctx) {
+    return tls_session_read_exit(ctx, (int)PT_REGS_RC(ctx));
+}
+
+SEC("uprobe/jsse_free_enter")
+int jsse_free_enter(struct pt_regs *ctx) {
+    return tls_session_free(PT_REGS_PARM1(ctx));
+}
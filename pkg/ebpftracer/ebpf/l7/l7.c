@@ -58,7 +58,7 @@ struct l7_event {
     __u64 duration;
     __u8 protocol;
     __u8 method;
-    __u16 padding;
+    __u16 server;
     __u32 statement_id;
     __u64 payload_size;
     char payload[MAX_PAYLOAD_SIZE];
@@ -71,11 +71,7 @@ struct {
      __uint(max_entries, 1);
 } l7_event_heap SEC(".maps");
 
-struct {
-    __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
-    __uint(key_size, sizeof(int));
-    __uint(value_size, sizeof(int));
-} l7_events SEC(".maps");
+EVENTS_MAP(l7_events);
 
 struct read_args {
     __u64 fd;
@@ -122,6 +118,14 @@ struct {
     __uint(max_entries, 32768);
 } active_l7_requests SEC(".maps");
 
+// requests read by servers, the response is written to the same fd
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(key_size, sizeof(struct l7_request_key));
+    __uint(value_size, sizeof(struct l7_request));
+    __uint(max_entries, 32768);
+} active_l7_server_requests SEC(".maps");
+
 struct {
      __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
      __type(key, int);
@@ -198,6 +202,157 @@ __u64 read_iovec(char *iovec, __u64 iovlen, __u64 ret, char *buf) {
     return offset;
 }
 
+static inline __attribute__((__always_inline__))
+int is_server_connection(__u32 pid, __u64 fd) {
+    struct sk_info sk = {};
+    sk.pid = pid;
+    sk.fd = fd;
+    __u64 *timestamp = bpf_map_lookup_elem(&accepted_connections, &sk);
+    return timestamp && *timestamp == get_connection_timestamp(pid, fd);
+}
+
+// trace_server_read stores a request read from an accepted connection, it's completed by the response
+// written to the same fd. The requests are recognized by the detectors of the client side, HTTP requests
+// are also recognized on the connections accepted before the tracer started, which aren't known to the kernel.
+// HTTP/2 frames read by a server are sent as the client frames of a server connection.
+// It returns 1 when the payload was read by a server and mustn't be looked at as a response.
+static inline __attribute__((__always_inline__))
+int trace_server_read(void *ctx, struct l7_request_key *k, struct l7_event *e, char *payload, __u64 size) {
+    int server = is_server_connection(k->pid, k->fd);
+    if (!server && (!is_http_request(payload) || bpf_map_lookup_elem(&active_l7_requests, k))) {
+        return 0;
+    }
+    int zero = 0;
+    struct l7_request *r = bpf_map_lookup_elem(&l7_request_heap, &zero);
+    if (!r) {
+        return server;
+    }
+    struct l7_request_key sk = *k;
+    r->protocol = PROTOCOL_UNKNOWN;
+    r->partial = 0;
+    r->request_type = 0;
+    r->request_id = 0;
+
+    if (is_http_request(payload)) {
+        r->protocol = PROTOCOL_HTTP;
+    } else if (is_postgres_query(payload, size, &r->request_type)) {
+        if (r->request_type == POSTGRES_FRAME_CLOSE) {
+            return 1; // no response is written
+        }
+        r->protocol = PROTOCOL_POSTGRES;
+    } else if (is_redis_query(payload, size)) {
+        r->protocol = PROTOCOL_REDIS;
+    } else if (is_memcached_query(payload, size)) {
+        r->protocol = PROTOCOL_MEMCACHED;
+    } else if (is_mysql_query(payload, size, &r->request_type)) {
+        if (r->request_type == MYSQL_COM_STMT_CLOSE) {
+            return 1; // no response is written
+        }
+        r->protocol = PROTOCOL_MYSQL;
+    } else if (is_mongo_query(payload, size)) {
+        r->protocol = PROTOCOL_MONGO;
+    } else if (is_cassandra_request(payload, size, &sk.stream_id)) {
+        r->protocol = PROTOCOL_CASSANDRA;
+    } else if (is_kafka_request(payload, size, &r->request_id)) {
+        r->protocol = PROTOCOL_KAFKA;
+    } else if (looks_like_http2_frame(payload, size, METHOD_HTTP2_CLIENT_FRAMES)) {
+        e->protocol = PROTOCOL_HTTP2;
+        e->method = METHOD_HTTP2_CLIENT_FRAMES;
+        e->server = 1;
+        e->duration = bpf_ktime_get_ns();
+        e->connection_timestamp = get_connection_timestamp(k->pid, k->fd);
+        e->payload_size = size;
+        COPY_PAYLOAD(e->payload, size, payload);
+        bpf_events_output(ctx, &l7_events, e, sizeof(*e));
+        e->server = 0; // the heap is shared with the client side events
+        return 1;
+    } else {
+        return 1;
+    }
+    r->ns = bpf_ktime_get_ns();
+    r->payload_size = size;
+    COPY_PAYLOAD(r->payload, size, payload);
+    bpf_map_update_elem(&active_l7_server_requests, &sk, r, BPF_ANY);
+    return 1;
+}
+
+// trace_server_write completes the request read from the fd with the response written by the server.
+// It returns 1 when the payload was written by a server and mustn't be looked at as a request.
+static inline __attribute__((__always_inline__))
+int trace_server_write(void *ctx, struct l7_request_key *k, char *payload, __u64 size) {
+    int server = is_server_connection(k->pid, k->fd);
+    __u32 zero = 0;
+    struct l7_event *e = bpf_map_lookup_elem(&l7_event_heap, &zero);
+    if (!e) {
+        return server;
+    }
+    e->fd = k->fd;
+    e->pid = k->pid;
+    e->status = STATUS_UNKNOWN;
+    e->method = METHOD_UNKNOWN;
+    e->statement_id = 0;
+    e->server = 0;
+
+    struct l7_request_key sk = *k;
+    struct l7_request *req = bpf_map_lookup_elem(&active_l7_server_requests, &sk);
+    if (!req && server && is_cassandra_response(payload, size, &sk.stream_id, &e->status)) {
+        // the cassandra requests are stored per stream
+        req = bpf_map_lookup_elem(&active_l7_server_requests, &sk);
+    }
+    if (!req) {
+        if (server && looks_like_http2_frame(payload, size, METHOD_HTTP2_SERVER_FRAMES)) {
+            e->protocol = PROTOCOL_HTTP2;
+            e->method = METHOD_HTTP2_SERVER_FRAMES;
+            e->server = 1;
+            e->duration = bpf_ktime_get_ns();
+            e->connection_timestamp = get_connection_timestamp(k->pid, k->fd);
+            e->payload_size = size;
+            COPY_PAYLOAD(e->payload, size, payload);
+            bpf_events_output(ctx, &l7_events, e, sizeof(*e));
+            e->server = 0;
+        }
+        return server;
+    }
+
+    int response = 0;
+    if (req->protocol == PROTOCOL_HTTP) {
+        response = is_http_response(payload, &e->status);
+    } else if (req->protocol == PROTOCOL_POSTGRES) {
+        response = is_postgres_response(payload, size, &e->status);
+        if (req->request_type == POSTGRES_FRAME_PARSE) {
+            e->method = METHOD_STATEMENT_PREPARE;
+        }
+    } else if (req->protocol == PROTOCOL_REDIS) {
+        response = is_redis_response(payload, size, &e->status);
+    } else if (req->protocol == PROTOCOL_MEMCACHED) {
+        response = is_memcached_response(payload, size, &e->status);
+    } else if (req->protocol == PROTOCOL_MYSQL) {
+        response = is_mysql_response(payload, size, req->request_type, &e->statement_id, &e->status);
+        if (req->request_type == MYSQL_COM_STMT_PREPARE) {
+            e->method = METHOD_STATEMENT_PREPARE;
+        }
+    } else if (req->protocol == PROTOCOL_MONGO) {
+        response = is_mongo_response(payload, size, 0) == 1;
+    } else if (req->protocol == PROTOCOL_KAFKA) {
+        response = is_kafka_response(payload, req->request_id);
+    } else if (req->protocol == PROTOCOL_CASSANDRA) {
+        response = sk.stream_id != -1;
+    }
+    if (!response) {
+        return server;
+    }
+    e->protocol = req->protocol;
+    e->server = 1;
+    e->duration = bpf_ktime_get_ns() - req->ns;
+    e->connection_timestamp = get_connection_timestamp(k->pid, k->fd);
+    e->payload_size = req->payload_size;
+    COPY_PAYLOAD(e->payload, req->payload_size, req->payload);
+    bpf_map_delete_elem(&active_l7_server_requests, &sk);
+    bpf_events_output(ctx, &l7_events, e, sizeof(*e));
+    e->server = 0; // the heap is shared with the client side events
+    return 1;
+}
+
 static inline __attribute__((__always_inline__))
 int trace_enter_write(void *ctx, __u64 fd, __u16 is_tls, char *buf, __u64 size, __u64 iovlen) {
     __u64 id = bpf_get_current_pid_tgid();
@@ -215,6 +370,16 @@ int trace_enter_write(void *ctx, __u64 fd, __u16 is_tls, char *buf, __u64 size,
         return 0;
     }
 
+    struct l7_request_key k = {};
+    k.pid = id >> 32;
+    k.fd = fd;
+    k.is_tls = is_tls;
+    k.stream_id = -1;
+
+    if (trace_server_write(ctx, &k, payload, size)) {
+        return 0;
+    }
+
     struct l7_request *req = bpf_map_lookup_elem(&l7_request_heap, &zero);
     if (!req) {
         return 0;
@@ -224,11 +389,6 @@ int trace_enter_write(void *ctx, __u64 fd, __u16 is_tls, char *buf, __u64 size,
     req->request_id = 0;
     req->ns = 0;
     req->payload_size = size;
-    struct l7_request_key k = {};
-    k.pid = id >> 32;
-    k.fd = fd;
-    k.is_tls = is_tls;
-    k.stream_id = -1;
 
     if (is_http_request(payload)) {
         req->protocol = PROTOCOL_HTTP;
@@ -245,7 +405,7 @@ int trace_enter_write(void *ctx, __u64 fd, __u16 is_tls, char *buf, __u64 size,
             e->connection_timestamp = get_connection_timestamp(k.pid, k.fd);
             e->payload_size = size;
             COPY_PAYLOAD(e->payload, size, payload);
-            bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
+            bpf_events_output(ctx, &l7_events, e, sizeof(*e));
             return 0;
         }
         req->protocol = PROTOCOL_POSTGRES;
@@ -266,7 +426,7 @@ int trace_enter_write(void *ctx, __u64 fd, __u16 is_tls, char *buf, __u64 size,
             e->connection_timestamp = get_connection_timestamp(k.pid, k.fd);
             e->payload_size = size;
             COPY_PAYLOAD(e->payload, size, payload);
-            bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
+            bpf_events_output(ctx, &l7_events, e, sizeof(*e));
             return 0;
         }
         req->protocol = PROTOCOL_MYSQL;
@@ -282,7 +442,7 @@ int trace_enter_write(void *ctx, __u64 fd, __u16 is_tls, char *buf, __u64 size,
         e->pid = k.pid;
         e->method = METHOD_PRODUCE;
         e->connection_timestamp = get_connection_timestamp(k.pid, k.fd);
-        bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
+        bpf_events_output(ctx, &l7_events, e, sizeof(*e));
         return 0;
     } else if (nats_method(payload, size) == METHOD_PRODUCE) {
         struct l7_event *e = bpf_map_lookup_elem(&l7_event_heap, &zero);
@@ -294,7 +454,7 @@ int trace_enter_write(void *ctx, __u64 fd, __u16 is_tls, char *buf, __u64 size,
         e->pid = k.pid;
         e->method = METHOD_PRODUCE;
         e->connection_timestamp = get_connection_timestamp(k.pid, k.fd);
-        bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
+        bpf_events_output(ctx, &l7_events, e, sizeof(*e));
         return 0;
     } else if (is_cassandra_request(payload, size, &k.stream_id)) {
         req->protocol = PROTOCOL_CASSANDRA;
@@ -317,7 +477,7 @@ int trace_enter_write(void *ctx, __u64 fd, __u16 is_tls, char *buf, __u64 size,
         e->connection_timestamp = get_connection_timestamp(k.pid, k.fd);
         e->payload_size = size;
         COPY_PAYLOAD(e->payload, size, payload);
-        bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
+        bpf_events_output(ctx, &l7_events, e, sizeof(*e));
         return 0;
     }
 
@@ -395,19 +555,24 @@ int trace_exit_read(void *ctx, __u64 id, __u32 pid, __u16 is_tls, long int ret)
     e->method = METHOD_UNKNOWN;
     e->statement_id = 0;
     e->payload_size = 0;
+    e->server = 0;
 
     if (is_rabbitmq_consume(payload, ret)) {
         e->protocol = PROTOCOL_RABBITMQ;
         e->method = METHOD_CONSUME;
         e->connection_timestamp = get_connection_timestamp(k.pid, k.fd);
-        bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
+        bpf_events_output(ctx, &l7_events, e, sizeof(*e));
         return 0;
     }
     if (nats_method(payload, ret) == METHOD_CONSUME) {
         e->protocol = PROTOCOL_NATS;
         e->method = METHOD_CONSUME;
         e->connection_timestamp = get_connection_timestamp(k.pid, k.fd);
-        bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
+        bpf_events_output(ctx, &l7_events, e, sizeof(*e));
+        return 0;
+    }
+
+    if (trace_server_read(ctx, &k, e, payload, ret)) {
         return 0;
     }
 
@@ -427,7 +592,7 @@ int trace_exit_read(void *ctx, __u64 id, __u32 pid, __u16 is_tls, long int ret)
             e->connection_timestamp = get_connection_timestamp(k.pid, k.fd);
             e->payload_size = ret;
             COPY_PAYLOAD(e->payload, ret, payload);
-            bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
+            bpf_events_output(ctx, &l7_events, e, sizeof(*e));
             return 0;
         } else {
             return 0;
@@ -479,22 +644,33 @@ int trace_exit_read(void *ctx, __u64 id, __u32 pid, __u16 is_tls, long int ret)
     }
     e->duration = bpf_ktime_get_ns() - req->ns;
     e->connection_timestamp = get_connection_timestamp(k.pid, k.fd);
-    bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
+    bpf_events_output(ctx, &l7_events, e, sizeof(*e));
     return 0;
 }
 
+#include "tls_session.c"
+
 SEC("tracepoint/syscalls/sys_enter_write")
 int sys_enter_write(struct trace_event_raw_sys_enter_rw__stub* ctx) {
+    if (tls_session_on_syscall(ctx, ctx->fd, 0)) {
+        return 0;
+    }
     return trace_enter_write(ctx, ctx->fd, 0, ctx->buf, ctx->size, 0);
 }
 
 SEC("tracepoint/syscalls/sys_enter_writev")
 int sys_enter_writev(struct trace_event_raw_sys_enter_rw__stub* ctx) {
+    if (tls_session_on_syscall(ctx, ctx->fd, 0)) {
+        return 0;
+    }
     return trace_enter_write(ctx, ctx->fd, 0, ctx->buf, 0, ctx->size);
 }
 
 SEC("tracepoint/syscalls/sys_enter_sendmsg")
 int sys_enter_sendmsg(struct trace_event_raw_sys_enter_rw__stub* ctx) {
+    if (tls_session_on_syscall(ctx, ctx->fd, 0)) {
+        return 0;
+    }
     struct user_msghdr msghdr = {};
     if (bpf_probe_read(&msghdr, sizeof(msghdr), (void *)ctx->buf)) {
         return 0;
@@ -504,23 +680,29 @@ int sys_enter_sendmsg(struct trace_event_raw_sys_enter_rw__stub* ctx) {
 
 SEC("tracepoint/syscalls/sys_enter_sendto")
 int sys_enter_sendto(struct trace_event_raw_sys_enter_rw__stub* ctx) {
+    if (tls_session_on_syscall(ctx, ctx->fd, 0)) {
+        return 0;
+    }
     return trace_enter_write(ctx, ctx->fd, 0, ctx->buf, ctx->size, 0);
 }
 
 SEC("tracepoint/syscalls/sys_enter_read")
 int sys_enter_read(struct trace_event_raw_sys_enter_rw__stub* ctx) {
+    tls_session_on_syscall(ctx, ctx->fd, 1);
     __u64 id = bpf_get_current_pid_tgid();
     return trace_enter_read(id, ctx->fd, ctx->buf, 0, 0);
 }
 
 SEC("tracepoint/syscalls/sys_enter_readv")
 int sys_enter_readv(struct trace_event_raw_sys_enter_rw__stub* ctx) {
+    tls_session_on_syscall(ctx, ctx->fd, 1);
     __u64 id = bpf_get_current_pid_tgid();
     return trace_enter_read(id, ctx->fd, ctx->buf, 0, ctx->size);
 }
 
 SEC("tracepoint/syscalls/sys_enter_recvmsg")
 int sys_enter_recvmsg(struct trace_event_raw_sys_enter_rw__stub* ctx) {
+    tls_session_on_syscall(ctx, ctx->fd, 1);
     __u64 id = bpf_get_current_pid_tgid();
     struct user_msghdr msghdr = {};
     if (bpf_probe_read(&msghdr, sizeof(msghdr), (void *)ctx->buf)) {
@@ -531,6 +713,7 @@ int sys_enter_recvmsg(struct trace_event_raw_sys_enter_rw__stub* ctx) {
 
 SEC("tracepoint/syscalls/sys_enter_recvfrom")
 int sys_enter_recvfrom(struct trace_event_raw_sys_enter_rw__stub* ctx) {
+    tls_session_on_syscall(ctx, ctx->fd, 1);
     __u64 id = bpf_get_current_pid_tgid();
     return trace_enter_read(id, ctx->fd, ctx->buf, 0, 0);
 }
@@ -44,9 +44,33 @@ struct ssl_st {
     struct bio_st* wbio;  // used by SSL_write
 };
 
-#define GET_FD(ctx, bio_t, bio_rw)                                      \
+// BoringSSL has no stable ABI, the layouts below match the releases bundled by Envoy, gRPC and Node.js
+struct bio_st_boringssl {
+    struct unused* method;
+    struct unused* ex_data;
+    int init;
+    int shutdown;
+    int flags;
+    int retry_reason;
+    int num; // fd
+};
+
+struct ssl_st_boringssl {
+    struct unused* method;
+    struct unused* x509_method;
+    __u16 version;
+    __u16 conf_max_version;
+    __u16 conf_min_version;
+    __u16 max_send_fragment;
+    struct bio_st* rbio;  // used by SSL_read
+    struct bio_st* wbio;  // used by SSL_write
+};
+
+#define GET_FD(ctx, bio_t, bio_rw) GET_FD_SSL(ctx, ssl_st, bio_t, bio_rw)
+
+#define GET_FD_SSL(ctx, ssl_t, bio_t, bio_rw)                           \
 ({                                                                      \
-    struct ssl_st ssl;                                                  \
+    struct ssl_t ssl;                                                   \
     if (bpf_probe_read(&ssl, sizeof(ssl), (void*)PT_REGS_PARM1(ctx))) { \
         return 0;                                                       \
     };                                                                  \
@@ -61,17 +85,21 @@ struct ssl_st {
     fd;                                                                 \
 })
 
-#define WRITE_ENTER(ctx, bio_t)                                 \
+#define WRITE_ENTER(ctx, bio_t) WRITE_ENTER_SSL(ctx, ssl_st, bio_t)
+
+#define WRITE_ENTER_SSL(ctx, ssl_t, bio_t)                      \
 ({                                                              \
-    __u32 fd = GET_FD(ctx, bio_t, wbio);                        \
+    __u32 fd = GET_FD_SSL(ctx, ssl_t, bio_t, wbio);             \
     char* buf_ptr = (char*)PT_REGS_PARM2(ctx);                  \
     __u64 buf_size = PT_REGS_PARM3(ctx);                        \
     return trace_enter_write(ctx, fd, 1, buf_ptr, buf_size, 0); \
 })
 
-#define READ_ENTER(ctx, bio_t)                      \
+#define READ_ENTER(ctx, bio_t) READ_ENTER_SSL(ctx, ssl_st, bio_t)
+
+#define READ_ENTER_SSL(ctx, ssl_t, bio_t)           \
 ({                                                  \
-    __u32 fd = GET_FD(ctx, bio_t, rbio);            \
+    __u32 fd = GET_FD_SSL(ctx, ssl_t, bio_t, rbio); \
     char* buf_ptr = (char*)PT_REGS_PARM2(ctx);      \
     __u64 pid_tgid = bpf_get_current_pid_tgid();    \
     __u64 id = pid_tgid | IS_TLS_READ_ID;           \
@@ -133,6 +161,16 @@ int openssl_SSL_read_ex_enter_v3_0(struct pt_regs *ctx) {
     READ_EX_ENTER(ctx, bio_st_v3_0);
 }
 
+SEC("uprobe/openssl_SSL_write_enter_boringssl")
+int openssl_SSL_write_enter_boringssl(struct pt_regs *ctx) {
+    WRITE_ENTER_SSL(ctx, ssl_st_boringssl, bio_st_boringssl);
+}
+
+SEC("uprobe/openssl_SSL_read_enter_boringssl")
+int openssl_SSL_read_enter_boringssl(struct pt_regs *ctx) {
+    READ_ENTER_SSL(ctx, ssl_st_boringssl, bio_st_boringssl);
+}
+
 SEC("uprobe/openssl_SSL_read_exit")
 int openssl_SSL_read_exit(struct pt_regs *ctx) {
     __u64 pid_tgid = bpf_get_current_pid_tgid();
@@ -141,3 +179,25 @@ int openssl_SSL_read_exit(struct pt_regs *ctx) {
     int ret = (int)PT_REGS_RC(ctx);
     return trace_exit_read(ctx, id, pid, 1, ret);
 }
+
+// Node.js feeds OpenSSL through memory BIOs, the sessions are tracked by tls_session.c.
+// The encrypted records are written by libuv after SSL_write returns, so there is no write exit probe.
+SEC("uprobe/openssl_SSL_write_enter_nodejs")
+int openssl_SSL_write_enter_nodejs(struct pt_regs *ctx) {
+    return tls_session_write(ctx, PT_REGS_PARM1(ctx), (char*)PT_REGS_PARM2(ctx), PT_REGS_PARM3(ctx));
+}
+
+SEC("uprobe/openssl_SSL_read_enter_nodejs")
+int openssl_SSL_read_enter_nodejs(struct pt_regs *ctx) {
+    return tls_session_read_enter(PT_REGS_PARM1(ctx), (char*)PT_REGS_PARM2(ctx));
+}
+
+SEC("uprobe/openssl_SSL_read_exit_nodejs")
+int openssl_SSL_read_exit_nodejs(struct pt_regs *ctx) {
+    return tls_session_read_exit(ctx, (int)PT_REGS_RC(ctx));
+}
+
+SEC("uprobe/openssl_SSL_free_nodejs")
+int openssl_SSL_free_nodejs(struct pt_regs *ctx) {
+    return tls_session_free(PT_REGS_PARM1(ctx));
+}
@@ -0,0 +1,207 @@
+// Some TLS libraries don't keep the socket fd where it can be read: GnuTLS keeps the transport behind a pointer
+// whose offset differs between versions and Node.js feeds OpenSSL through memory BIOs. The fd of a session
+// is learned from the socket syscalls the thread makes during or around the TLS calls, and cached per session.
+// Only the processes running these libraries are looked at, the agent adds them to tls_session_pids.
+
+#define IS_TLS_READ_ID 0x8000000000000000
+#define TLS_PENDING_WRITE_TTL 100000000 // 100ms
+
+struct tls_call {
+    __u64 session;
+    char* buf;
+};
+
+// the plaintext of a write whose fd isn't known yet, it's copied on the TLS call
+// since the buffer may be reused or freed before the record is sent
+struct tls_pending_write {
+    __u64 session;
+    __u64 ns;
+    __u64 size;
+    char payload[MAX_PAYLOAD_SIZE];
+};
+
+// the connection timestamp tells whether the fd still refers to the connection the session was bound to
+struct tls_session {
+    __u64 fd;
+    __u64 connection_timestamp;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(key_size, sizeof(__u32));
+    __uint(value_size, sizeof(__u8));
+    __uint(max_entries, 10240);
+} tls_session_pids SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(key_size, sizeof(__u64));
+    __uint(value_size, sizeof(struct tls_call));
+    __uint(max_entries, 10240);
+} tls_calls SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(key_size, sizeof(__u64));
+    __uint(value_size, sizeof(struct tls_pending_write));
+    __uint(max_entries, 1024);
+} tls_pending_writes SEC(".maps");
+
+struct {
+     __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+     __type(key, int);
+     __type(value, struct tls_pending_write);
+     __uint(max_entries, 1);
+} tls_pending_write_heap SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(key_size, sizeof(__u64));
+    __uint(value_size, sizeof(struct tls_session));
+    __uint(max_entries, 10240);
+} tls_session_fds SEC(".maps");
+
+// the last fd a thread read from, Node.js reads the encrypted records before passing them to SSL_read
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(key_size, sizeof(__u64));
+    __uint(value_size, sizeof(__u64));
+    __uint(max_entries, 10240);
+} tls_thread_read_fds SEC(".maps");
+
+static inline __attribute__((__always_inline__))
+void tls_session_bind(__u64 session, __u64 fd, __u64 connection_timestamp) {
+    struct tls_session s = {};
+    s.fd = fd;
+    s.connection_timestamp = connection_timestamp;
+    bpf_map_update_elem(&tls_session_fds, &session, &s, BPF_ANY);
+}
+
+// tls_session_lookup drops the binding once the connection is closed, the fd may be reused by another one
+static inline __attribute__((__always_inline__))
+struct tls_session *tls_session_lookup(__u32 pid, __u64 session) {
+    struct tls_session *s = bpf_map_lookup_elem(&tls_session_fds, &session);
+    if (!s) {
+        return 0;
+    }
+    if (get_connection_timestamp(pid, s->fd) != s->connection_timestamp) {
+        bpf_map_delete_elem(&tls_session_fds, &session);
+        return 0;
+    }
+    return s;
+}
+
+// tls_session_on_syscall returns 1 if the syscall sends the record of a pending TLS write,
+// the plaintext is traced instead of the encrypted payload then.
+// Only the syscalls on tracked TCP connections are looked at, not the writes to log files or pipes.
+static inline __attribute__((__always_inline__))
+int tls_session_on_syscall(void *ctx, __u64 fd, int is_read) {
+    __u64 id = bpf_get_current_pid_tgid();
+    __u32 pid = id >> 32;
+    if (!bpf_map_lookup_elem(&tls_session_pids, &pid)) {
+        return 0;
+    }
+    __u64 connection_timestamp = get_connection_timestamp(pid, fd);
+    if (!connection_timestamp) {
+        return 0;
+    }
+    if (is_read) {
+        bpf_map_update_elem(&tls_thread_read_fds, &id, &fd, BPF_ANY);
+    }
+    struct tls_call *call = bpf_map_lookup_elem(&tls_calls, &id);
+    if (call) {
+        tls_session_bind(call->session, fd, connection_timestamp);
+        return 0;
+    }
+    if (is_read) {
+        return 0;
+    }
+    struct tls_pending_write *w = bpf_map_lookup_elem(&tls_pending_writes, &id);
+    if (!w) {
+        return 0;
+    }
+    if (bpf_ktime_get_ns() - w->ns > TLS_PENDING_WRITE_TTL) {
+        bpf_map_delete_elem(&tls_pending_writes, &id);
+        return 0;
+    }
+    tls_session_bind(w->session, fd, connection_timestamp);
+    trace_enter_write(ctx, fd, 1, w->payload, w->size, 0);
+    bpf_map_delete_elem(&tls_pending_writes, &id);
+    return 1;
+}
+
+static inline __attribute__((__always_inline__))
+int tls_session_write(void *ctx, __u64 session, char *buf, __u64 size) {
+    __u64 id = bpf_get_current_pid_tgid();
+    struct tls_session *s = tls_session_lookup(id >> 32, session);
+    if (s) {
+        return trace_enter_write(ctx, s->fd, 1, buf, size, 0);
+    }
+    __u32 zero = 0;
+    struct tls_pending_write *w = bpf_map_lookup_elem(&tls_pending_write_heap, &zero);
+    if (!w) {
+        return 0;
+    }
+    w->session = session;
+    w->ns = bpf_ktime_get_ns();
+    COPY_PAYLOAD(w->payload, size, buf);
+    w->size = size;
+    bpf_map_update_elem(&tls_pending_writes, &id, w, BPF_ANY);
+    return 0;
+}
+
+static inline __attribute__((__always_inline__))
+int tls_session_write_exit() {
+    __u64 id = bpf_get_current_pid_tgid();
+    bpf_map_delete_elem(&tls_pending_writes, &id);
+    return 0;
+}
+
+static inline __attribute__((__always_inline__))
+int tls_session_read_enter(__u64 session, char *buf) {
+    struct tls_call call = {};
+    call.session = session;
+    call.buf = buf;
+    __u64 id = bpf_get_current_pid_tgid();
+    bpf_map_update_elem(&tls_calls, &id, &call, BPF_ANY);
+    return 0;
+}
+
+static inline __attribute__((__always_inline__))
+int tls_session_read_exit(void *ctx, long int ret) {
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    __u32 pid = pid_tgid >> 32;
+    struct tls_call *call = bpf_map_lookup_elem(&tls_calls, &pid_tgid);
+    if (!call) {
+        return 0;
+    }
+    __u64 session = call->session;
+    char *buf = call->buf;
+    bpf_map_delete_elem(&tls_calls, &pid_tgid);
+    __u64 fd = 0;
+    struct tls_session *s = tls_session_lookup(pid, session);
+    if (s) {
+        fd = s->fd;
+    } else {
+        __u64 *read_fd = bpf_map_lookup_elem(&tls_thread_read_fds, &pid_tgid);
+        if (!read_fd) {
+            return 0;
+        }
+        fd = *read_fd;
+        __u64 connection_timestamp = get_connection_timestamp(pid, fd);
+        if (!connection_timestamp) {
+            return 0;
+        }
+        tls_session_bind(session, fd, connection_timestamp);
+    }
+    __u64 id = pid_tgid | IS_TLS_READ_ID;
+    trace_enter_read(id, fd, buf, 0, 0);
+    return trace_exit_read(ctx, id, pid, 1, ret);
+}
+
+// tls_session_free is called when the library frees a session, its address may be reused by the next one
+static inline __attribute__((__always_inline__))
+int tls_session_free(__u64 session) {
+    bpf_map_delete_elem(&tls_session_fds, &session);
+    return 0;
+}
@@ -7,11 +7,7 @@ struct proc_event {
     __u32 reason;
 };
 
-struct {
-    __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
-    __uint(key_size, sizeof(int));
-    __uint(value_size, sizeof(int));
-} proc_events SEC(".maps");
+EVENTS_MAP(proc_events);
 
 struct {
     __uint(type, BPF_MAP_TYPE_HASH);
@@ -37,7 +33,7 @@ int task_newtask(struct trace_event_raw_task_newtask__stub *args)
         .type = EVENT_TYPE_PROCESS_START,
         .pid = args->pid,
     };
-    bpf_perf_event_output(args, &proc_events, BPF_F_CURRENT_CPU, &e, sizeof(e));
+    bpf_events_output(args, &proc_events, &e, sizeof(e));
     return 0;
 }
 
@@ -62,7 +58,7 @@ int sched_process_exit(struct trace_event_raw_sched_process_template__stub *args
         e.reason = EVENT_REASON_OOM_KILL;
         bpf_map_delete_elem(&oom_info, &e.pid);
     }
-    bpf_perf_event_output(args, &proc_events, BPF_F_CURRENT_CPU, &e, sizeof(e));
+    bpf_events_output(args, &proc_events, &e, sizeof(e));
     return 0;
 }
 
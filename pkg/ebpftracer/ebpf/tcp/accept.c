@@ -0,0 +1,91 @@
+struct trace_event_raw_sys_exit_accept__stub {
+    __u64 unused;
+    long int id;
+    long int ret;
+};
+
+// inet_csk_accept returns the socket taken from the accept queue, it's kept until the syscall returns the fd
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(key_size, sizeof(__u64));
+    __uint(value_size, sizeof(void *));
+    __uint(max_entries, 10240);
+} accepted_socks SEC(".maps");
+
+// the connections accepted by the traced processes, the value is the connection timestamp,
+// so a connection opened later with the same fd isn't taken for a server one
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(key_size, sizeof(struct sk_info));
+    __uint(value_size, sizeof(__u64));
+    __uint(max_entries, 32768);
+} accepted_connections SEC(".maps");
+
+SEC("kretprobe/inet_csk_accept")
+int inet_csk_accept_exit(struct pt_regs *ctx)
+{
+    void *sk = (void *)PT_REGS_RC(ctx);
+    if (!sk) {
+        return 0;
+    }
+    __u64 id = bpf_get_current_pid_tgid();
+    bpf_map_update_elem(&accepted_socks, &id, &sk, BPF_ANY);
+    return 0;
+}
+
+// the addresses are recorded by inet_sock_set_state when the connection is established, before it's accepted
+static inline __attribute__((__always_inline__))
+int trace_exit_accept(void *ctx, long int ret)
+{
+    __u64 id = bpf_get_current_pid_tgid();
+    void **skp = bpf_map_lookup_elem(&accepted_socks, &id);
+    void *sk = 0;
+    if (skp) {
+        sk = *skp;
+        bpf_map_delete_elem(&accepted_socks, &id);
+    }
+    if (ret < 0) {
+        return 0;
+    }
+    struct tcp_event e = {};
+    e.type = EVENT_TYPE_CONNECTION_ACCEPT;
+    e.pid = id >> 32;
+    e.fd = ret;
+    e.timestamp = bpf_ktime_get_ns();
+    if (sk) {
+        struct sk_addrs *a = bpf_map_lookup_elem(&passive_sk_addrs, &sk);
+        if (a) {
+            e.sport = a->sport;
+            e.dport = a->dport;
+            __builtin_memcpy(&e.saddr, &a->saddr, sizeof(e.saddr));
+            __builtin_memcpy(&e.daddr, &a->daddr, sizeof(e.daddr));
+            bpf_map_delete_elem(&passive_sk_addrs, &sk);
+        }
+        struct established_sk es = {};
+        es.fd = e.fd;
+        es.pid = e.pid;
+        es.timestamp = e.timestamp;
+        bpf_map_update_elem(&established_socks, &sk, &es, BPF_ANY);
+    }
+
+    struct sk_info k = {};
+    k.pid = e.pid;
+    k.fd = e.fd;
+    bpf_map_update_elem(&connection_timestamps, &k, &e.timestamp, BPF_ANY);
+    bpf_map_update_elem(&accepted_connections, &k, &e.timestamp, BPF_ANY);
+
+    bpf_events_output(ctx, &tcp_connect_events, &e, sizeof(e));
+    return 0;
+}
+
+SEC("tracepoint/syscalls/sys_exit_accept")
+int sys_exit_accept(struct trace_event_raw_sys_exit_accept__stub *ctx)
+{
+    return trace_exit_accept(ctx, ctx->ret);
+}
+
+SEC("tracepoint/syscalls/sys_exit_accept4")
+int sys_exit_accept4(struct trace_event_raw_sys_exit_accept__stub *ctx)
+{
+    return trace_exit_accept(ctx, ctx->ret);
+}
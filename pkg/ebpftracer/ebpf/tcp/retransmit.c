@@ -1,8 +1,4 @@
-struct {
-    __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
-    __uint(key_size, sizeof(int));
-    __uint(value_size, sizeof(int));
-} tcp_retransmit_events SEC(".maps");
+EVENTS_MAP(tcp_retransmit_events);
 
 struct trace_event_raw_tcp_event_sk_skb__stub {
     __u64 unused;
@@ -33,7 +29,7 @@ int tcp_retransmit_skb(struct trace_event_raw_tcp_event_sk_skb__stub *args)
     __builtin_memcpy(&e.saddr, &args->saddr_v6, sizeof(e.saddr));
     __builtin_memcpy(&e.daddr, &args->daddr_v6, sizeof(e.daddr));
 
-    bpf_perf_event_output(args, &tcp_retransmit_events, BPF_F_CURRENT_CPU, &e, sizeof(e));
+    bpf_events_output(args, &tcp_retransmit_events, &e, sizeof(e));
 
     return 0;
 }
@@ -11,17 +11,9 @@ struct tcp_event {
     __u8 daddr[16];
 };
 
-struct {
-    __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
-    __uint(key_size, sizeof(int));
-    __uint(value_size, sizeof(int));
-} tcp_listen_events SEC(".maps");
+EVENTS_MAP(tcp_listen_events);
 
-struct {
-    __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
-    __uint(key_size, sizeof(int));
-    __uint(value_size, sizeof(int));
-} tcp_connect_events SEC(".maps");
+EVENTS_MAP(tcp_connect_events);
 
 struct trace_event_raw_inet_sock_set_state__stub {
     __u64 unused;
@@ -67,6 +59,35 @@ struct {
     __uint(max_entries, 32768);
 } connection_timestamps SEC(".maps");
 
+struct sk_addrs {
+    __u16 sport;
+    __u16 dport;
+    __u8 saddr[16];
+    __u8 daddr[16];
+};
+
+// the addresses of the connections established by the peers, until they are accepted
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(key_size, sizeof(void *));
+    __uint(value_size, sizeof(struct sk_addrs));
+    __uint(max_entries, 32768);
+} passive_sk_addrs SEC(".maps");
+
+struct established_sk {
+    __u64 fd;
+    __u64 timestamp;
+    __u32 pid;
+};
+
+// the process and the fd of the established connections, the close transition runs in softirq without them
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(key_size, sizeof(void *));
+    __uint(value_size, sizeof(struct established_sk));
+    __uint(max_entries, 65536);
+} established_socks SEC(".maps");
+
 SEC("tracepoint/sock/inet_sock_set_state")
 int inet_sock_set_state(void *ctx)
 {
@@ -94,10 +115,20 @@ int inet_sock_set_state(void *ctx)
         return 0;
     }
 
+    if (args.oldstate == BPF_TCP_SYN_RECV && args.newstate == BPF_TCP_ESTABLISHED) {
+        struct sk_addrs a = {};
+        a.sport = args.sport;
+        a.dport = args.dport;
+        __builtin_memcpy(&a.saddr, &args.saddr_v6, sizeof(a.saddr));
+        __builtin_memcpy(&a.daddr, &args.daddr_v6, sizeof(a.daddr));
+        bpf_map_update_elem(&passive_sk_addrs, &args.skaddr, &a, BPF_ANY);
+        return 0;
+    }
+
     __u64 fd = 0;
     __u32 type = 0;
     __u64 timestamp = 0;
-    void *map = &tcp_connect_events;
+    int listen = 0;
     if (args.oldstate == BPF_TCP_SYN_SENT) {
         struct sk_info *i = bpf_map_lookup_elem(&sk_info, &args.skaddr);
         if (!i) {
@@ -109,6 +140,11 @@ int inet_sock_set_state(void *ctx)
             k.pid = i->pid;
             k.fd = i->fd;
             bpf_map_update_elem(&connection_timestamps, &k, &timestamp, BPF_ANY);
+            struct established_sk es = {};
+            es.fd = i->fd;
+            es.pid = i->pid;
+            es.timestamp = timestamp;
+            bpf_map_update_elem(&established_socks, &args.skaddr, &es, BPF_ANY);
             type = EVENT_TYPE_CONNECTION_OPEN;
         } else if (args.newstate == BPF_TCP_CLOSE) {
             type = EVENT_TYPE_CONNECTION_ERROR;
@@ -120,14 +156,21 @@ int inet_sock_set_state(void *ctx)
     if (args.oldstate == BPF_TCP_ESTABLISHED && (args.newstate == BPF_TCP_FIN_WAIT1 || args.newstate == BPF_TCP_CLOSE_WAIT)) {
         pid = 0;
         type = EVENT_TYPE_CONNECTION_CLOSE;
+        struct established_sk *es = bpf_map_lookup_elem(&established_socks, &args.skaddr);
+        if (es) {
+            pid = es->pid;
+            fd = es->fd;
+            timestamp = es->timestamp;
+            bpf_map_delete_elem(&established_socks, &args.skaddr);
+        }
     }
     if (args.oldstate == BPF_TCP_CLOSE && args.newstate == BPF_TCP_LISTEN) {
         type = EVENT_TYPE_LISTEN_OPEN;
-        map = &tcp_listen_events;
+        listen = 1;
     }
     if (args.oldstate == BPF_TCP_LISTEN && args.newstate == BPF_TCP_CLOSE) {
         type = EVENT_TYPE_LISTEN_CLOSE;
-        map = &tcp_listen_events;
+        listen = 1;
     }
 
     if (type == 0) {
@@ -144,7 +187,12 @@ int inet_sock_set_state(void *ctx)
     __builtin_memcpy(&e.saddr, &args.saddr_v6, sizeof(e.saddr));
     __builtin_memcpy(&e.daddr, &args.daddr_v6, sizeof(e.saddr));
 
-    bpf_perf_event_output(ctx, map, BPF_F_CURRENT_CPU, &e, sizeof(e));
+    // the map is named in each call, bpf_events_output counts the lost events per map
+    if (listen) {
+        bpf_events_output(ctx, &tcp_listen_events, &e, sizeof(e));
+    } else {
+        bpf_events_output(ctx, &tcp_connect_events, &e, sizeof(e));
+    }
 
     return 0;
 }
@@ -2,17 +2,15 @@ package ebpftracer
 
 import (
 	"bytes"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"runtime"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cilium/ebpf"
-	"github.com/cilium/ebpf/link"
-	"github.com/cilium/ebpf/perf"
 	"golang.org/x/mod/semver"
 	"inet.af/netaddr"
 	"k8s.io/klog/v2"
@@ -21,85 +19,109 @@ import (
 	"github.com/kwaisu/sense-agent/pkg/system"
 )
 
-const MaxPayloadSize = 1024
+const (
+	MaxPayloadSize   = 1024
+	readErrorBackoff = time.Second
+)
 
 type EBPFTracer struct {
-	collection       *ebpf.Collection
-	readers          map[string]*perfReader
-	links            []link.Link
-	uprobes          map[string]*ebpf.Program
-	disableL7Tracing bool
-	subscribers      map[EventType][]chan Event
-	lock             sync.Mutex
+	collection   *ebpf.Collection
+	readers      map[string]*perfReader
+	spec         *ebpf.CollectionSpec
+	loader       programLoader
+	features     map[Feature]*featureState
+	featuresLock sync.Mutex
+	l7Protocols  atomic.Uint64
+	subscribers  atomic.Pointer[[]*subscriber]
+	containers   containerIds
+	redactor     atomic.Pointer[l7.Redactor]
+	http2        http2Connections
+	lock         sync.Mutex
+	// done is closed by Close, the readers and the blocked publishers return then
+	done      chan struct{}
+	closeOnce sync.Once
+	running   sync.WaitGroup
 }
 type perfReader struct {
-	*perf.Reader
+	eventReader
 	perfEventMap
+	stats readerStats
 }
 
-func NewTracer(kernelVersion string) (*EBPFTracer, error) {
-	trace := &EBPFTracer{
-		readers:     map[string]*perfReader{},
-		uprobes:     map[string]*ebpf.Program{},
-		subscribers: map[EventType][]chan Event{},
+func newEBPFTracer() *EBPFTracer {
+	return &EBPFTracer{
+		readers:    map[string]*perfReader{},
+		features:   map[Feature]*featureState{},
+		containers: containerIds{ids: map[uint32]string{}, read: readContainerId},
+		done:       make(chan struct{}),
 	}
-	if prog, err := getProgram(kernelVersion); err != nil {
+}
+
+// NewTracer loads the programs of every feature, see NewTracerWithFeatures.
+func NewTracer(kernelVersion string) (*EBPFTracer, error) {
+	return NewTracerWithFeatures(kernelVersion, DefaultFeatureConfig())
+}
+
+// NewTracerWithFeatures creates the maps and loads the programs of the enabled features, a feature failing
+// to attach doesn't fail the tracer, it's reported by Features.
+func NewTracerWithFeatures(kernelVersion string, config FeatureConfig) (*EBPFTracer, error) {
+	trace := newEBPFTracer()
+	if redactor, err := l7.NewRedactor(l7.RedactionConfig{}); err != nil {
 		return nil, err
 	} else {
-		collectionSpec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(prog))
-		if err != nil {
-			return nil, fmt.Errorf("collection spec from reader error: %w", err)
-		}
-		collection, err := ebpf.NewCollection(collectionSpec)
+		trace.redactor.Store(redactor)
+	}
+	prog, err := getProgram(kernelVersion)
+	if err != nil {
+		return nil, err
+	}
+	collectionSpec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(prog))
+	if err != nil {
+		return nil, fmt.Errorf("collection spec from reader error: %w", err)
+	}
+	setRingBufferSizes(collectionSpec)
+	// the programs are loaded per feature by SetFeatures
+	mapsSpec := collectionSpec.Copy()
+	mapsSpec.Programs = nil
+	collection, err := ebpf.NewCollection(mapsSpec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to new collection error : %w", err)
+	}
+	trace.collection = collection
+	trace.spec = collectionSpec
+	trace.loader = collectionLoader{spec: collectionSpec, maps: collection.Maps}
+	for _, pe := range perfEvenMaps {
+		reader, err := newEventReader(collection.Maps[pe.name], collection.Maps[pe.name+"_lost"], pe)
 		if err != nil {
-			return nil, fmt.Errorf("failed to new collection error : %w", err)
-		}
-		trace.collection = collection
-		var l link.Link
-		for _, programSpec := range collectionSpec.Programs {
-			program := collection.Programs[programSpec.Name]
-			switch programSpec.Type {
-			case ebpf.TracePoint:
-				parts := strings.SplitN(programSpec.AttachTo, "/", 2)
-				if l, err = link.Tracepoint(parts[0], parts[1], program, nil); err == nil {
-					trace.links = append(trace.links, l)
-				}
-			case ebpf.Kprobe:
-				if strings.HasPrefix(programSpec.SectionName, "uprobe/") {
-					trace.uprobes[programSpec.Name] = program
-					continue
-				}
-				if l, err = link.Kprobe(programSpec.AttachTo, program, nil); err == nil {
-					trace.links = append(trace.links, l)
-				}
-			}
-		}
-		for _, pe := range perfEvenMaps {
-			reader, err := perf.NewReader(collection.Maps[string(pe.name)], pe.perCPUBufferSize)
-			if err != nil {
-				reader.Close()
-				return nil, fmt.Errorf("failed to new  %s perfEvent Reader ", pe.name)
-			}
-			trace.readers[string(pe.name)] = &perfReader{Reader: reader, perfEventMap: pe}
+			trace.Close()
+			return nil, fmt.Errorf("failed to new  %s perfEvent Reader: %w", pe.name, err)
 		}
+		trace.readers[pe.name] = &perfReader{eventReader: reader, perfEventMap: pe}
+	}
+	if err = trace.SetFeatures(config); err != nil {
+		klog.Warning(err)
 	}
-
 	return trace, nil
 }
 
+// Close stops the readers and waits for them to return before detaching the programs,
+// the events being published to the subscribers are dropped. It's safe to call Close more than once.
 func (t *EBPFTracer) Close() {
-	for _, p := range t.uprobes {
-		_ = p.Close()
-	}
-	for _, l := range t.links {
-		_ = l.Close()
-	}
-	for _, r := range t.readers {
-		_ = r.Close()
-	}
-	t.collection.Close()
+	t.closeOnce.Do(func() {
+		close(t.done)
+		for _, r := range t.readers {
+			_ = r.Close()
+		}
+		t.running.Wait()
+		t.unloadFeatures()
+		if t.collection != nil {
+			t.collection.Close()
+		}
+	})
 }
 
+// getProgram returns the newest build supported by the kernel, the builds for 5.8 and later
+// send the events through ring buffers instead of perf event arrays.
 func getProgram(kernelVersion string) ([]byte, error) {
 	if _, ok := ebpfProg[runtime.GOARCH]; !ok {
 		return nil, fmt.Errorf("Unsupported  architecture: %s  ", runtime.GOARCH)
@@ -121,98 +143,87 @@ func getProgram(kernelVersion string) ([]byte, error) {
 	return prg, nil
 }
 
+// Reader reads the events of a map until the tracer is closed.
 func (t *EBPFTracer) Reader(perfReader *perfReader) {
+	stats := &perfReader.stats
+	var buf [4]Event
 	for {
-		record, err := perfReader.Read()
+		sample, lostSamples, err := perfReader.read()
 		if err != nil {
-			klog.Info("perf reader read error :", err)
+			if errors.Is(err, os.ErrClosed) {
+				return
+			}
+			klog.Warningf("failed to read from %s: %s", perfReader.name, err)
+			// a failing reader mustn't spin, the errors are retried at a slower pace
+			select {
+			case <-t.done:
+				return
+			case <-time.After(readErrorBackoff):
+			}
 			continue
 		}
-		if record.LostSamples > 0 {
-			klog.Errorf(" %s lost samples: %d", perfReader.name, record.LostSamples)
+		if lostSamples > 0 {
+			stats.lost.Add(lostSamples)
+			klog.V(2).Infof("%s lost samples: %d", perfReader.name, lostSamples)
 			continue
 		}
-		var event Event
-		switch perfReader.typ {
-		case perfMapTypeL7Events:
-			v := &l7Event{}
-			reader := bytes.NewBuffer(record.RawSample)
-			if err := binary.Read(reader, binary.LittleEndian, v); err != nil {
-				klog.Warningln("failed to read msg:", err)
-				continue
-			}
-			payload := reader.Bytes()
-			req := &l7.RequestData{
-				Protocol:    l7.Protocol(v.Protocol),
-				Status:      l7.Status(v.Status),
-				Duration:    time.Duration(v.Duration),
-				Method:      l7.Method(v.Method),
-				StatementId: v.StatementId,
-			}
-			switch {
-			case v.PayloadSize == 0:
-			case v.PayloadSize > MaxPayloadSize:
-				req.Payload = payload[:MaxPayloadSize]
-			default:
-				req.Payload = payload[:v.PayloadSize]
-			}
-			if strings.Index(string(req.Payload), "CUPS/2.4.1") < 0 {
-				event = Event{Type: EventTypeL7Request, Pid: v.Pid, Fd: v.Fd, Timestamp: v.ConnectionTimestamp, L7Request: req}
-			}
-		case perfMapTypeFileEvents:
-			v := &fileEvent{}
-			if err := binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, v); err != nil {
-				klog.Warningln("failed to read msg:", err)
-				continue
-			}
-			event = Event{Type: v.Type, Pid: v.Pid, Fd: v.Fd}
-		case perfMapTypeProcEvents:
-			v := &procEvent{}
-			if err := binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, v); err != nil {
-				klog.Warningln("failed to read msg:", err)
-				continue
-			}
-			event = Event{Type: v.Type, Reason: EventReason(v.Reason), Pid: v.Pid}
-		case perfMapTypeTCPEvents:
-			v := &tcpEvent{}
-			if err := binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, v); err != nil {
-				klog.Warningln("failed to read msg:", err)
-				continue
-			}
-			event = Event{
-				Type:      v.Type,
-				Pid:       v.Pid,
-				SrcAddr:   ipPort(v.SAddr, v.SPort),
-				DstAddr:   ipPort(v.DAddr, v.DPort),
-				Fd:        v.Fd,
-				Timestamp: v.Timestamp,
-			}
-		default:
+		stats.received.Add(1)
+		events, err := t.decode(perfReader.typ, sample, buf[:0])
+		if err != nil {
+			stats.decodeErrors.Add(1)
+			klog.V(2).Infof("failed to decode a sample from %s: %s", perfReader.name, err)
 			continue
 		}
-		if eventsChan, ok := t.subscribers[event.Type]; ok {
-			for _, ch := range eventsChan {
-				ch <- event
-			}
+		for _, event := range events {
+			t.publish(event, stats)
 		}
-
 	}
 }
 
-func (t *EBPFTracer) SubscribeEvents(eventType EventType, ch chan Event) error {
-	t.lock.Lock()
-	defer t.lock.Unlock()
-	if eventsCh, ok := t.subscribers[eventType]; ok {
-		t.subscribers[eventType] = append(eventsCh, ch)
-	} else {
-		t.subscribers[eventType] = []chan Event{ch}
+// publish queues the event for the matching subscribers, every subscriber holds a reference to a pooled L7 request.
+// The events dropped by a subscriber or because the tracer is closed are counted in stats, which may be nil.
+func (t *EBPFTracer) publish(event Event, stats *readerStats) {
+	var buf [8]*subscriber
+	matched := buf[:0]
+	for _, s := range t.subscriberList() {
+		if s.match(event, &t.containers) {
+			matched = append(matched, s)
+		}
+	}
+	switch event.Type {
+	case EventTypeProcessExit:
+		t.containers.forget(event.Pid)
+		t.http2.forgetProcess(event.Pid)
+	case EventTypeConnectionClose:
+		t.http2.forget(event.Pid, event.Fd, event.Timestamp)
 	}
-	return nil
+	if event.L7Request != nil {
+		if len(matched) == 0 || !t.l7ProtocolEnabled(event.L7Request.Protocol) {
+			event.L7Request.Release()
+			return
+		}
+		event.L7Request.Retain(int32(len(matched) - 1))
+	}
+	for _, s := range matched {
+		if !s.enqueue(event, t.done) && stats != nil {
+			stats.dropped.Add(1)
+		}
+	}
+}
+
+// SetRedactor replaces the redactor applied to the L7 payloads before they are published,
+// the built-in rules are applied by default.
+func (t *EBPFTracer) SetRedactor(redactor *l7.Redactor) {
+	t.redactor.Store(redactor)
 }
 
 func (t *EBPFTracer) Run() {
 	for _, reader := range t.readers {
-		go t.Reader(reader)
+		t.running.Add(1)
+		go func(r *perfReader) {
+			defer t.running.Done()
+			t.Reader(r)
+		}(reader)
 	}
 }
 
@@ -10,16 +10,17 @@ type EventType uint32
 type EventReason uint32
 
 const (
-	EventTypeProcessStart    EventType = 1
-	EventTypeProcessExit     EventType = 2
-	EventTypeConnectionOpen  EventType = 3
-	EventTypeConnectionClose EventType = 4
-	EventTypeConnectionError EventType = 5
-	EventTypeListenOpen      EventType = 6
-	EventTypeListenClose     EventType = 7
-	EventTypeFileOpen        EventType = 8
-	EventTypeTCPRetransmit   EventType = 9
-	EventTypeL7Request       EventType = 10
+	EventTypeProcessStart     EventType = 1
+	EventTypeProcessExit      EventType = 2
+	EventTypeConnectionOpen   EventType = 3
+	EventTypeConnectionClose  EventType = 4
+	EventTypeConnectionError  EventType = 5
+	EventTypeListenOpen       EventType = 6
+	EventTypeListenClose      EventType = 7
+	EventTypeFileOpen         EventType = 8
+	EventTypeTCPRetransmit    EventType = 9
+	EventTypeL7Request        EventType = 10
+	EventTypeConnectionAccept EventType = 11
 
 	EventReasonNone    EventReason = 0
 	EventReasonOOMKill EventReason = 1
@@ -33,7 +34,7 @@ type l7Event struct {
 	Duration            uint64
 	Protocol            uint8
 	Method              uint8
-	Padding             uint16
+	Server              uint16
 	StatementId         uint32
 	PayloadSize         uint64
 }
@@ -69,12 +70,16 @@ type Event struct {
 	Fd        uint64
 	Timestamp uint64
 	L7Request *l7.RequestData
+	// PreExisting is set for the sockets and files opened before the tracer started, see EBPFTracer.Init
+	PreExisting bool
 }
 
 type perfEventMap struct {
 	name             string
 	perCPUBufferSize int
-	typ              perfMapType
+	// ringBufferSize is the size in bytes of the ring buffer shared by all CPUs, a power of 2 multiple of the page size
+	ringBufferSize int
+	typ            perfMapType
 }
 
 type perfMapType uint8
@@ -87,9 +92,9 @@ const (
 )
 
 var perfEvenMaps = []perfEventMap{
-	{name: "proc_events", perCPUBufferSize: 4, typ: perfMapTypeProcEvents},
-	{name: "tcp_listen_events", perCPUBufferSize: 4, typ: perfMapTypeTCPEvents},
-	{name: "tcp_connect_events", perCPUBufferSize: 8, typ: perfMapTypeTCPEvents},
-	{name: "tcp_retransmit_events", perCPUBufferSize: 4, typ: perfMapTypeTCPEvents},
-	{name: "file_events", perCPUBufferSize: 4, typ: perfMapTypeFileEvents},
-	{name: "l7_events", perCPUBufferSize: 32, typ: perfMapTypeL7Events}}
+	{name: "proc_events", perCPUBufferSize: 4, ringBufferSize: 256 << 10, typ: perfMapTypeProcEvents},
+	{name: "tcp_listen_events", perCPUBufferSize: 4, ringBufferSize: 256 << 10, typ: perfMapTypeTCPEvents},
+	{name: "tcp_connect_events", perCPUBufferSize: 8, ringBufferSize: 1 << 20, typ: perfMapTypeTCPEvents},
+	{name: "tcp_retransmit_events", perCPUBufferSize: 4, ringBufferSize: 256 << 10, typ: perfMapTypeTCPEvents},
+	{name: "file_events", perCPUBufferSize: 4, ringBufferSize: 256 << 10, typ: perfMapTypeFileEvents},
+	{name: "l7_events", perCPUBufferSize: 32, ringBufferSize: 8 << 20, typ: perfMapTypeL7Events}}
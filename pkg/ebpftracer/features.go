@@ -0,0 +1,328 @@
+package ebpftracer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"k8s.io/klog/v2"
+
+	"github.com/kwaisu/sense-agent/pkg/ebpftracer/l7"
+)
+
+// Feature is a group of programs loaded and attached together.
+type Feature string
+
+const (
+	FeatureProcess Feature = "process"
+	FeatureTcp     Feature = "tcp"
+	FeatureFile    Feature = "file"
+	FeatureL7      Feature = "l7"
+	// FeatureTls loads the uprobes, they are attached to the TLS libraries of the processes by AttachTlsUprobes.
+	FeatureTls Feature = "tls"
+)
+
+var features = []Feature{FeatureProcess, FeatureTcp, FeatureFile, FeatureL7, FeatureTls}
+
+// programFeatures maps the tracepoints and the kernel functions to the features of their programs
+var programFeatures = map[string]Feature{
+	"task/task_newtask":           FeatureProcess,
+	"sched/sched_process_exit":    FeatureProcess,
+	"oom/mark_victim":             FeatureProcess,
+	"sock/inet_sock_set_state":    FeatureTcp,
+	"syscalls/sys_enter_connect":  FeatureTcp,
+	"syscalls/sys_exit_connect":   FeatureTcp,
+	"syscalls/sys_exit_accept":    FeatureTcp,
+	"syscalls/sys_exit_accept4":   FeatureTcp,
+	"tcp/tcp_retransmit_skb":      FeatureTcp,
+	"inet_csk_accept":             FeatureTcp,
+	"syscalls/sys_enter_open":     FeatureFile,
+	"syscalls/sys_exit_open":      FeatureFile,
+	"syscalls/sys_enter_openat":   FeatureFile,
+	"syscalls/sys_exit_openat":    FeatureFile,
+	"syscalls/sys_enter_write":    FeatureL7,
+	"syscalls/sys_enter_writev":   FeatureL7,
+	"syscalls/sys_enter_sendmsg":  FeatureL7,
+	"syscalls/sys_enter_sendto":   FeatureL7,
+	"syscalls/sys_enter_read":     FeatureL7,
+	"syscalls/sys_enter_readv":    FeatureL7,
+	"syscalls/sys_enter_recvmsg":  FeatureL7,
+	"syscalls/sys_enter_recvfrom": FeatureL7,
+	"syscalls/sys_exit_read":      FeatureL7,
+	"syscalls/sys_exit_readv":     FeatureL7,
+	"syscalls/sys_exit_recvmsg":   FeatureL7,
+	"syscalls/sys_exit_recvfrom":  FeatureL7,
+}
+
+// FeatureConfig selects the programs loaded by the tracer, see DefaultFeatureConfig.
+type FeatureConfig struct {
+	Process bool
+	Tcp     bool
+	File    bool
+	L7      bool
+	// L7Protocols are the protocols of the published L7 requests, all of them when empty.
+	// The protocols are detected by the same programs, so it doesn't change what is attached.
+	L7Protocols []l7.Protocol
+	// Tls requires L7, the decrypted payloads are matched with the responses by the L7 programs.
+	Tls bool
+}
+
+// DefaultFeatureConfig enables every feature.
+func DefaultFeatureConfig() FeatureConfig {
+	return FeatureConfig{Process: true, Tcp: true, File: true, L7: true, Tls: true}
+}
+
+func (c FeatureConfig) enabled(f Feature) bool {
+	switch f {
+	case FeatureProcess:
+		return c.Process
+	case FeatureTcp:
+		return c.Tcp
+	case FeatureFile:
+		return c.File
+	case FeatureL7:
+		return c.L7
+	case FeatureTls:
+		return c.Tls
+	}
+	return false
+}
+
+// FeatureStatus tells which programs of a feature are attached and why the others aren't.
+type FeatureStatus struct {
+	Feature Feature
+	Enabled bool
+	// Error is why an enabled feature isn't loaded at all
+	Error string
+	// Programs are the attached programs, the loaded uprobes for FeatureTls
+	Programs []string
+	// Errors are keyed by the name of the program which failed to load or attach
+	Errors map[string]string
+}
+
+type featureState struct {
+	enabled  bool
+	err      string
+	programs map[string]*ebpf.Program
+	links    map[string]link.Link
+	errors   map[string]string
+}
+
+// programLoader loads and attaches a single program, the maps are shared by all the programs of the tracer.
+type programLoader interface {
+	load(spec *ebpf.ProgramSpec) (*ebpf.Program, error)
+	attach(spec *ebpf.ProgramSpec, program *ebpf.Program) (link.Link, error)
+}
+
+// collectionLoader loads the programs with the maps of the collection created by NewTracer,
+// so a feature is enabled without reloading the maps read by the other features.
+type collectionLoader struct {
+	spec *ebpf.CollectionSpec
+	maps map[string]*ebpf.Map
+}
+
+func (l collectionLoader) load(spec *ebpf.ProgramSpec) (*ebpf.Program, error) {
+	cs := &ebpf.CollectionSpec{
+		Maps:      map[string]*ebpf.MapSpec{},
+		Programs:  map[string]*ebpf.ProgramSpec{spec.Name: spec},
+		ByteOrder: l.spec.ByteOrder,
+		Types:     l.spec.Types,
+	}
+	replacements := map[string]*ebpf.Map{}
+	for _, ins := range spec.Instructions {
+		name := ins.Reference()
+		if !ins.IsLoadFromMap() || name == "" {
+			continue
+		}
+		if m := l.maps[name]; m != nil {
+			cs.Maps[name] = l.spec.Maps[name]
+			replacements[name] = m
+		}
+	}
+	collection, err := ebpf.NewCollectionWithOptions(cs, ebpf.CollectionOptions{MapReplacements: replacements})
+	if err != nil {
+		return nil, err
+	}
+	defer collection.Close()
+	return collection.DetachProgram(spec.Name), nil
+}
+
+func (l collectionLoader) attach(spec *ebpf.ProgramSpec, program *ebpf.Program) (link.Link, error) {
+	switch spec.Type {
+	case ebpf.TracePoint:
+		parts := strings.SplitN(spec.AttachTo, "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid tracepoint %s", spec.AttachTo)
+		}
+		return link.Tracepoint(parts[0], parts[1], program, nil)
+	case ebpf.Kprobe:
+		if strings.HasPrefix(spec.SectionName, "kretprobe/") {
+			return link.Kretprobe(spec.AttachTo, program, nil)
+		}
+		return link.Kprobe(spec.AttachTo, program, nil)
+	}
+	return nil, fmt.Errorf("unsupported program type %s", spec.Type)
+}
+
+// programFeature returns the feature of a program, the uprobes belong to FeatureTls.
+func programFeature(spec *ebpf.ProgramSpec) Feature {
+	if isUprobe(spec) {
+		return FeatureTls
+	}
+	return programFeatures[spec.AttachTo]
+}
+
+func isUprobe(spec *ebpf.ProgramSpec) bool {
+	return strings.HasPrefix(spec.SectionName, "uprobe/")
+}
+
+// SetFeatures loads and attaches the programs of the enabled features and detaches and unloads the programs
+// of the disabled ones, the programs of unchanged features keep running. It returns an error if a feature
+// failed to attach entirely, Features tells which programs failed.
+func (t *EBPFTracer) SetFeatures(config FeatureConfig) error {
+	t.setL7Protocols(config.L7Protocols)
+	t.featuresLock.Lock()
+	defer t.featuresLock.Unlock()
+	var failed []string
+	for _, f := range features {
+		s := t.features[f]
+		if s == nil {
+			s = &featureState{}
+			t.features[f] = s
+		}
+		enabled := config.enabled(f)
+		var err string
+		if f == FeatureTls && enabled && !config.L7 {
+			err = "requires the l7 feature"
+		}
+		if enabled == s.enabled && err == s.err {
+			continue
+		}
+		s.unload()
+		s.enabled, s.err = enabled, err
+		if !enabled {
+			continue
+		}
+		if err == "" {
+			t.loadFeature(f, s)
+		}
+		if err != "" || len(s.programs) == 0 && len(s.errors) > 0 {
+			failed = append(failed, string(f))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to attach features: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// loadFeature must be called with featuresLock held
+func (t *EBPFTracer) loadFeature(f Feature, s *featureState) {
+	s.programs = map[string]*ebpf.Program{}
+	s.links = map[string]link.Link{}
+	s.errors = map[string]string{}
+	if t.spec == nil {
+		return
+	}
+	for _, spec := range t.spec.Programs {
+		if programFeature(spec) != f {
+			continue
+		}
+		program, err := t.loader.load(spec)
+		if err != nil {
+			s.errors[spec.Name] = err.Error()
+			klog.Warningf("failed to load %s: %s", spec.Name, err)
+			continue
+		}
+		if isUprobe(spec) {
+			s.programs[spec.Name] = program
+			continue
+		}
+		l, err := t.loader.attach(spec, program)
+		if err != nil {
+			_ = program.Close()
+			s.errors[spec.Name] = err.Error()
+			klog.Warningf("failed to attach %s to %s: %s", spec.Name, spec.AttachTo, err)
+			continue
+		}
+		s.programs[spec.Name] = program
+		s.links[spec.Name] = l
+	}
+}
+
+func (s *featureState) unload() {
+	for _, l := range s.links {
+		_ = l.Close()
+	}
+	for _, p := range s.programs {
+		_ = p.Close()
+	}
+	s.programs, s.links, s.errors = nil, nil, nil
+}
+
+// Features returns the status of every feature.
+func (t *EBPFTracer) Features() []FeatureStatus {
+	t.featuresLock.Lock()
+	defer t.featuresLock.Unlock()
+	var res []FeatureStatus
+	for _, f := range features {
+		status := FeatureStatus{Feature: f}
+		if s := t.features[f]; s != nil {
+			status.Enabled, status.Error = s.enabled, s.err
+			for name := range s.programs {
+				status.Programs = append(status.Programs, name)
+			}
+			sort.Strings(status.Programs)
+			if len(s.errors) > 0 {
+				status.Errors = map[string]string{}
+				for name, err := range s.errors {
+					status.Errors[name] = err
+				}
+			}
+		}
+		res = append(res, status)
+	}
+	return res
+}
+
+func (t *EBPFTracer) featureEnabled(f Feature) bool {
+	t.featuresLock.Lock()
+	defer t.featuresLock.Unlock()
+	s := t.features[f]
+	return s != nil && s.enabled && s.err == ""
+}
+
+// uprobe returns the loaded uprobe program, nil when FeatureTls is disabled.
+func (t *EBPFTracer) uprobe(name string) *ebpf.Program {
+	t.featuresLock.Lock()
+	defer t.featuresLock.Unlock()
+	if s := t.features[FeatureTls]; s != nil {
+		return s.programs[name]
+	}
+	return nil
+}
+
+// setL7Protocols stores the protocols as a bit mask, the zero mask publishes every protocol
+func (t *EBPFTracer) setL7Protocols(protocols []l7.Protocol) {
+	var mask uint64
+	for _, p := range protocols {
+		mask |= 1 << (uint64(p) % 64)
+	}
+	t.l7Protocols.Store(mask)
+}
+
+func (t *EBPFTracer) l7ProtocolEnabled(p l7.Protocol) bool {
+	mask := t.l7Protocols.Load()
+	return mask == 0 || mask&(1<<(uint64(p)%64)) != 0
+}
+
+func (t *EBPFTracer) unloadFeatures() {
+	t.featuresLock.Lock()
+	defer t.featuresLock.Unlock()
+	for _, s := range t.features {
+		s.unload()
+		s.enabled, s.err = false, ""
+	}
+}
@@ -0,0 +1,114 @@
+package ebpftracer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kwaisu/sense-agent/pkg/ebpftracer/l7"
+)
+
+type testProgramLink struct {
+	link.Link
+	name   string
+	loader *testProgramLoader
+}
+
+func (l testProgramLink) Close() error {
+	delete(l.loader.attached, l.name)
+	return nil
+}
+
+type testProgramLoader struct {
+	failLoad   map[string]bool
+	failAttach map[string]bool
+	attached   map[string]bool
+}
+
+func (l *testProgramLoader) load(spec *ebpf.ProgramSpec) (*ebpf.Program, error) {
+	if l.failLoad[spec.Name] {
+		return nil, errors.New("permission denied")
+	}
+	return nil, nil
+}
+
+func (l *testProgramLoader) attach(spec *ebpf.ProgramSpec, program *ebpf.Program) (link.Link, error) {
+	if l.failAttach[spec.Name] {
+		return nil, errors.New("no such file or directory")
+	}
+	l.attached[spec.Name] = true
+	return testProgramLink{name: spec.Name, loader: l}, nil
+}
+
+func TestSetFeatures(t *testing.T) {
+	loader := &testProgramLoader{
+		failLoad:   map[string]bool{"sys_enter_openat": true},
+		failAttach: map[string]bool{"oom_mark_victim": true, "tcp_retransmit": true},
+		attached:   map[string]bool{},
+	}
+	tracer := newEBPFTracer()
+	tracer.loader = loader
+	tracer.spec = &ebpf.CollectionSpec{Programs: map[string]*ebpf.ProgramSpec{}}
+	for name, attachTo := range map[string]string{
+		"task_newtask":     "task/task_newtask",
+		"oom_mark_victim":  "oom/mark_victim",
+		"tcp_retransmit":   "tcp/tcp_retransmit_skb",
+		"sys_enter_openat": "syscalls/sys_enter_openat",
+		"sys_enter_read":   "syscalls/sys_enter_read",
+	} {
+		tracer.spec.Programs[name] = &ebpf.ProgramSpec{Name: name, Type: ebpf.TracePoint, SectionName: "tracepoint/" + attachTo, AttachTo: attachTo}
+	}
+	tracer.spec.Programs["openssl_SSL_write_enter"] = &ebpf.ProgramSpec{Name: "openssl_SSL_write_enter", Type: ebpf.Kprobe, SectionName: "uprobe/openssl_SSL_write_enter"}
+
+	err := tracer.SetFeatures(FeatureConfig{Process: true, Tcp: true, File: true, Tls: true})
+	assert.EqualError(t, err, "failed to attach features: tcp, file, tls")
+	assert.Equal(t, map[string]bool{"task_newtask": true}, loader.attached)
+	assert.Equal(t, []FeatureStatus{
+		{Feature: FeatureProcess, Enabled: true, Programs: []string{"task_newtask"}, Errors: map[string]string{"oom_mark_victim": "no such file or directory"}},
+		{Feature: FeatureTcp, Enabled: true, Errors: map[string]string{"tcp_retransmit": "no such file or directory"}},
+		{Feature: FeatureFile, Enabled: true, Errors: map[string]string{"sys_enter_openat": "permission denied"}},
+		{Feature: FeatureL7},
+		{Feature: FeatureTls, Enabled: true, Error: "requires the l7 feature"},
+	}, tracer.Features())
+	assert.False(t, tracer.featureEnabled(FeatureTls))
+
+	// the process programs stay attached, tls is loaded once l7 is enabled
+	loader.failAttach = nil
+	assert.NoError(t, tracer.SetFeatures(FeatureConfig{Process: true, L7: true, Tls: true}))
+	assert.Equal(t, map[string]bool{"task_newtask": true, "sys_enter_read": true}, loader.attached)
+	status := tracer.Features()
+	assert.Equal(t, FeatureStatus{Feature: FeatureTls, Enabled: true, Programs: []string{"openssl_SSL_write_enter"}}, status[4])
+	assert.Equal(t, map[string]string{"oom_mark_victim": "no such file or directory"}, status[0].Errors)
+	assert.True(t, tracer.featureEnabled(FeatureTls))
+
+	tracer.Close()
+	assert.Empty(t, loader.attached)
+	assert.False(t, tracer.featureEnabled(FeatureL7))
+}
+
+func TestL7ProtocolFilter(t *testing.T) {
+	tracer := newEBPFTracer()
+	ch := make(chan Event, 10)
+	assert.NoError(t, tracer.Subscribe("test", SubscriptionConfig{}, ch))
+	defer tracer.Close()
+
+	assert.NoError(t, tracer.SetFeatures(FeatureConfig{L7: true, L7Protocols: []l7.Protocol{l7.ProtocolHTTP}}))
+	for _, p := range []l7.Protocol{l7.ProtocolPostgres, l7.ProtocolHTTP} {
+		r := l7.AcquireRequestData()
+		r.Protocol = p
+		tracer.publish(Event{Type: EventTypeL7Request, L7Request: r}, nil)
+	}
+	e := <-ch
+	assert.Equal(t, l7.ProtocolHTTP, e.L7Request.Protocol)
+	assert.Empty(t, ch)
+
+	assert.NoError(t, tracer.SetFeatures(FeatureConfig{L7: true}))
+	r := l7.AcquireRequestData()
+	r.Protocol = l7.ProtocolPostgres
+	tracer.publish(Event{Type: EventTypeL7Request, L7Request: r}, nil)
+	e = <-ch
+	assert.Equal(t, l7.ProtocolPostgres, e.L7Request.Protocol)
+}
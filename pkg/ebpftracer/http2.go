@@ -0,0 +1,76 @@
+package ebpftracer
+
+import (
+	"sync"
+
+	"github.com/kwaisu/sense-agent/pkg/ebpftracer/l7"
+)
+
+type pidFd struct {
+	pid uint32
+	fd  uint64
+}
+
+type http2Connection struct {
+	timestamp uint64
+	parser    *l7.Http2Parser
+}
+
+// http2Connections keeps an HTTP/2 parser per connection, the HPACK tables are built from every frame
+// of the connection. The parser of a closed connection is replaced when the fd is reused.
+type http2Connections struct {
+	lock        sync.Mutex
+	connections map[pidFd]*http2Connection
+}
+
+func (c *http2Connections) parse(pid uint32, fd, timestamp uint64, method l7.Method, payload []byte, kernelTime uint64) []l7.Http2Request {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.connections == nil {
+		c.connections = map[pidFd]*http2Connection{}
+	}
+	key := pidFd{pid: pid, fd: fd}
+	conn := c.connections[key]
+	if conn == nil || conn.timestamp != timestamp {
+		conn = &http2Connection{timestamp: timestamp, parser: l7.NewHttp2Parser()}
+		c.connections[key] = conn
+	}
+	return conn.parser.Parse(method, payload, kernelTime)
+}
+
+// forget drops the parser of a closed connection, the timestamp is zero when it's unknown.
+func (c *http2Connections) forget(pid uint32, fd, timestamp uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := pidFd{pid: pid, fd: fd}
+	if conn := c.connections[key]; conn != nil && (timestamp == 0 || conn.timestamp == timestamp) {
+		delete(c.connections, key)
+	}
+}
+
+func (c *http2Connections) forgetProcess(pid uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key := range c.connections {
+		if key.pid == pid {
+			delete(c.connections, key)
+		}
+	}
+}
+
+// http2Requests converts the requests completed by the frames of an L7 event to events,
+// the frames that don't complete a request aren't published.
+func (t *EBPFTracer) http2Requests(v *l7Event, payload []byte, events []Event) []Event {
+	requests := t.http2.parse(v.Pid, v.Fd, v.ConnectionTimestamp, l7.Method(v.Method), payload, v.Duration)
+	for _, r := range requests {
+		req := l7.AcquireRequestData()
+		req.Protocol = l7.ProtocolHTTP2
+		// both directions of a connection accepted by the process are sent with the server flag
+		req.Server = v.Server == 1
+		req.Status = r.Status
+		req.Duration = r.Duration
+		req.TraceContext = r.TraceContext
+		events = append(events, Event{Type: EventTypeL7Request, Pid: v.Pid, Fd: v.Fd, Timestamp: v.ConnectionTimestamp, L7Request: req})
+	}
+	return events
+}
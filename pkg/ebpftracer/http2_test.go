@@ -0,0 +1,141 @@
+package ebpftracer
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"inet.af/netaddr"
+
+	"github.com/kwaisu/sense-agent/pkg/ebpftracer/l7"
+	"github.com/kwaisu/sense-agent/pkg/exporter/trace"
+)
+
+// headersEncoder keeps the HPACK table of one direction of a connection
+type headersEncoder struct {
+	buf bytes.Buffer
+	enc *hpack.Encoder
+}
+
+func newHeadersEncoder() *headersEncoder {
+	e := &headersEncoder{}
+	e.enc = hpack.NewEncoder(&e.buf)
+	return e
+}
+
+// http2Sample encodes the frames written or read by a client, the duration of the event is the kernel time.
+func http2Sample(t testing.TB, method l7.Method, kernelTime uint64, e *headersEncoder, streams map[uint32][]hpack.HeaderField) []byte {
+	return http2ConnectionSample(t, 0, method, kernelTime, e, streams)
+}
+
+// http2ConnectionSample encodes the frames of a connection, server is set for the connections accepted by the process.
+func http2ConnectionSample(t testing.TB, server uint16, method l7.Method, kernelTime uint64, e *headersEncoder, streams map[uint32][]hpack.HeaderField) []byte {
+	frames := bytes.NewBuffer(nil)
+	framer := http2.NewFramer(frames, nil)
+	for id := uint32(1); int(id) <= 2*len(streams); id += 2 {
+		e.buf.Reset()
+		for _, f := range streams[id] {
+			assert.NoError(t, e.enc.WriteField(f))
+		}
+		assert.NoError(t, framer.WriteHeaders(http2.HeadersFrameParam{StreamID: id, BlockFragment: e.buf.Bytes(), EndHeaders: true}))
+	}
+	return encode(t, &l7Event{
+		Fd: 9, ConnectionTimestamp: 555, Pid: 4242, Duration: kernelTime,
+		Protocol: uint8(l7.ProtocolHTTP2), Method: uint8(method), Server: server, PayloadSize: uint64(frames.Len()),
+	}, frames.Bytes())
+}
+
+func TestHttp2DecodeToSpan(t *testing.T) {
+	tracer := testTracer(t)
+	recorder := tracetest.NewSpanRecorder()
+	exporter := trace.NewTracerExporter(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test"))
+	tr := trace.NewTraceProvider(exporter, nil).NewTrace("c1", netaddr.MustParseIPPort("10.0.0.2:443"))
+
+	clientEnc, serverEnc := newHeadersEncoder(), newHeadersEncoder()
+	events, err := tracer.decode(perfMapTypeL7Events, http2Sample(t, l7.MethodHttp2ClientFrames, 1000, clientEnc, map[uint32][]hpack.HeaderField{
+		1: {{Name: ":method", Value: "GET"}, {Name: ":path", Value: "/users"}, {Name: "traceparent", Value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}},
+		3: {{Name: ":method", Value: "POST"}, {Name: ":path", Value: "/orders"}},
+	}), nil)
+	assert.NoError(t, err)
+	assert.Empty(t, events, "the requests are published once they are answered")
+
+	// both streams are answered by a single read
+	events, err = tracer.decode(perfMapTypeL7Events, http2Sample(t, l7.MethodHttp2ServerFrames, uint64(time.Millisecond)+1000, serverEnc, map[uint32][]hpack.HeaderField{
+		1: {{Name: ":status", Value: "200"}},
+		3: {{Name: ":status", Value: "503"}},
+	}), nil)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	for _, e := range events {
+		assert.Equal(t, uint64(9), e.Fd)
+		assert.Equal(t, uint64(555), e.Timestamp)
+		assert.Equal(t, l7.ProtocolHTTP2, e.L7Request.Protocol)
+		assert.Equal(t, time.Millisecond, e.L7Request.Duration)
+		tr.L7Request(e.L7Request)
+	}
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 2)
+	var parented int
+	for _, s := range spans {
+		assert.Equal(t, oteltrace.SpanKindClient, s.SpanKind())
+		if s.Parent().IsValid() {
+			parented++
+			assert.True(t, s.Parent().IsRemote())
+			assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", s.SpanContext().TraceID().String())
+			assert.Equal(t, "00f067aa0ba902b7", s.Parent().SpanID().String())
+		}
+	}
+	assert.Equal(t, 1, parented, "only the GET request propagated the trace context")
+}
+
+func TestHttp2ServerRequest(t *testing.T) {
+	tracer := testTracer(t)
+	clientEnc, serverEnc := newHeadersEncoder(), newHeadersEncoder()
+	// a gRPC call read by the server
+	events, err := tracer.decode(perfMapTypeL7Events, http2ConnectionSample(t, 1, l7.MethodHttp2ClientFrames, 1000, clientEnc, map[uint32][]hpack.HeaderField{
+		1: {
+			{Name: ":method", Value: "POST"}, {Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: "/helloworld.Greeter/SayHello"}, {Name: "content-type", Value: "application/grpc"},
+		},
+	}), nil)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+
+	events, err = tracer.decode(perfMapTypeL7Events, http2ConnectionSample(t, 1, l7.MethodHttp2ServerFrames, uint64(2*time.Millisecond)+1000, serverEnc, map[uint32][]hpack.HeaderField{
+		1: {{Name: ":status", Value: "200"}, {Name: "content-type", Value: "application/grpc"}},
+	}), nil)
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	r := events[0].L7Request
+	assert.True(t, r.Server)
+	assert.Equal(t, l7.ProtocolHTTP2, r.Protocol)
+	assert.Equal(t, l7.Status(200), r.Status)
+	assert.Equal(t, 2*time.Millisecond, r.Duration)
+}
+
+func TestHttp2Connections(t *testing.T) {
+	c := &http2Connections{}
+	c.parse(1, 9, 100, l7.MethodHttp2ClientFrames, nil, 0)
+	p := c.connections[pidFd{pid: 1, fd: 9}].parser
+
+	// a new connection using the same fd starts with an empty HPACK table
+	c.parse(1, 9, 200, l7.MethodHttp2ClientFrames, nil, 0)
+	assert.NotSame(t, p, c.connections[pidFd{pid: 1, fd: 9}].parser)
+
+	c.forget(1, 9, 100)
+	assert.Len(t, c.connections, 1, "the close of the previous connection is ignored")
+	c.forget(1, 9, 200)
+	assert.Empty(t, c.connections)
+
+	c.parse(1, 9, 300, l7.MethodHttp2ClientFrames, nil, 0)
+	c.parse(2, 9, 300, l7.MethodHttp2ClientFrames, nil, 0)
+	c.forgetProcess(1)
+	assert.Len(t, c.connections, 1)
+}
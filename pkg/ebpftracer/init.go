@@ -17,6 +17,8 @@ type sock struct {
 	pid uint32
 	fd  uint64
 	system.Sock
+	// inbound sockets were accepted on a port listened in the same network namespace
+	inbound bool
 }
 
 func readFds(pids []uint32) (files []file, socks []sock) {
@@ -35,8 +37,14 @@ func readFds(pids []uint32) (files []file, socks []sock) {
 			if ss, err := system.GetSockets(pid); err != nil {
 				klog.Warningln(err)
 			} else {
+				listens := map[uint16]bool{}
 				for _, s := range ss {
-					sockets[s.Inode] = sock{Sock: s}
+					if s.Listen {
+						listens[s.SAddr.Port()] = true
+					}
+				}
+				for _, s := range ss {
+					sockets[s.Inode] = sock{Sock: s, inbound: !s.Listen && listens[s.SAddr.Port()]}
 				}
 			}
 		}
@@ -60,3 +68,29 @@ func readFds(pids []uint32) (files []file, socks []sock) {
 	}
 	return
 }
+
+// Init returns the listens, connections and files that were open before the tracer started,
+// so requests on long-lived connections aren't missed. The events aren't published: a burst of them
+// would overflow the queues of the subscribers, the caller applies them after the processes are known.
+// They are marked as PreExisting and have no timestamp, it's only known for connections established while tracing.
+func (t *EBPFTracer) Init(pids []uint32) []Event {
+	files, socks := readFds(pids)
+	events := make([]Event, 0, len(socks)+len(files))
+	for _, s := range socks {
+		e := Event{Pid: s.pid, Fd: s.fd, SrcAddr: s.SAddr, DstAddr: s.DAddr, PreExisting: true}
+		switch {
+		case s.Listen:
+			e.Type = EventTypeListenOpen
+		case s.inbound:
+			e.Type = EventTypeConnectionAccept
+		default:
+			e.Type = EventTypeConnectionOpen
+		}
+		events = append(events, e)
+	}
+	for _, f := range files {
+		events = append(events, Event{Type: EventTypeFileOpen, Pid: f.pid, Fd: f.fd, PreExisting: true})
+	}
+	klog.Infof("found %d sockets and %d files opened before start", len(socks), len(files))
+	return events
+}
@@ -0,0 +1,51 @@
+package ebpftracer
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadFds(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+	conn, err := l.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, socks := readFds([]uint32{uint32(os.Getpid())})
+	found := map[string]sock{}
+	for _, s := range socks {
+		found[s.SAddr.String()+"-"+s.DAddr.String()] = s
+	}
+	listen, ok := found[l.Addr().String()+"-0.0.0.0:0"]
+	assert.True(t, ok)
+	assert.True(t, listen.Listen)
+	accepted, ok := found[conn.LocalAddr().String()+"-"+conn.RemoteAddr().String()]
+	assert.True(t, ok)
+	assert.True(t, accepted.inbound)
+	dialed, ok := found[client.LocalAddr().String()+"-"+client.RemoteAddr().String()]
+	assert.True(t, ok)
+	assert.False(t, dialed.inbound)
+}
+
+func TestInit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	var listens int
+	for _, e := range newEBPFTracer().Init([]uint32{uint32(os.Getpid())}) {
+		assert.True(t, e.PreExisting)
+		if e.Type == EventTypeListenOpen && e.SrcAddr.String() == l.Addr().String() {
+			listens++
+		}
+	}
+	assert.Equal(t, 1, listens)
+}
@@ -0,0 +1,256 @@
+// sense_jsse is a JVMTI agent exposing the plaintext of the JSSE sockets to the uprobes of the tracer.
+//
+// JSSE is Java code compiled by the JIT into the anonymous code cache of the JVM, and the kernel attaches uprobes
+// to file-backed code only. The agent sets breakpoints on the application streams of sun.security.ssl.SSLSocketImpl
+// and passes their buffers to sense_jsse_write and sense_jsse_read: functions doing nothing but being exported
+// by this library, so the tracer finds them in the mappings of the JVM and attaches its uprobes to them.
+// The arguments follow SSL_write and SSL_read, the session is the tag of the stream and its fd is learned
+// from the socket syscalls the thread makes around the calls, like for Node.js.
+//
+// A JVM opts in by loading the agent at startup:
+//     java -agentpath:/path/to/libsense_jsse.so ...
+// or while running:
+//     jcmd <pid> JVMTI.agent_load /path/to/libsense_jsse.so
+//
+// The breakpoints make the JVM interpret the stream methods, and the reads run interpreted until they return.
+
+#include <jvmti.h>
+#include <string.h>
+
+// the uprobes copy at most MAX_PAYLOAD_SIZE bytes of a buffer, see l7.c
+#define MAX_PAYLOAD_SIZE 1024
+
+struct jsse_method {
+    const char *class;
+    const char *name;
+    const char *signature;
+    int read;
+};
+
+// SSLSocketImpl has been rewritten in Java 11, the streams were top-level classes before
+static const struct jsse_method jsse_methods[] = {
+    {"Lsun/security/ssl/SSLSocketImpl$AppOutputStream;", "write", "([BII)V", 0},
+    {"Lsun/security/ssl/SSLSocketImpl$AppInputStream;", "read", "([BII)I", 1},
+    {"Lsun/security/ssl/AppOutputStream;", "write", "([BII)V", 0},
+    {"Lsun/security/ssl/AppInputStream;", "read", "([BII)I", 1},
+};
+
+#define JSSE_METHODS (sizeof(jsse_methods) / sizeof(jsse_methods[0]))
+
+static volatile jmethodID jsse_method_ids[JSSE_METHODS];
+static jlong jsse_last_session;
+
+// the read in progress on the thread, its buffer is filled when the method returns
+struct jsse_read {
+    jmethodID method;
+    jlong session;
+    jbyteArray buf;
+    jint off;
+};
+
+static __thread struct jsse_read jsse_pending_read;
+static __thread char jsse_buf[MAX_PAYLOAD_SIZE];
+
+__attribute__((noinline, visibility("default")))
+int sense_jsse_write(jlong session, const char *buf, int len) {
+    asm volatile("" ::: "memory");
+    return len;
+}
+
+__attribute__((noinline, visibility("default")))
+int sense_jsse_read(jlong session, const char *buf, int len) {
+    asm volatile("" ::: "memory");
+    return len;
+}
+
+__attribute__((noinline, visibility("default")))
+void sense_jsse_free(jlong session) {
+    asm volatile("" ::: "memory");
+}
+
+// jsse_session tags the stream on its first call, ObjectFree reports the tag once the stream is collected
+static jlong jsse_session(jvmtiEnv *jvmti, jobject stream) {
+    jlong tag = 0;
+    if ((*jvmti)->GetTag(jvmti, stream, &tag) != JVMTI_ERROR_NONE) {
+        return 0;
+    }
+    if (tag == 0) {
+        tag = __atomic_add_fetch(&jsse_last_session, 1, __ATOMIC_RELAXED);
+        if ((*jvmti)->SetTag(jvmti, stream, tag) != JVMTI_ERROR_NONE) {
+            return 0;
+        }
+    }
+    return tag;
+}
+
+// jsse_copy copies the head of the Java buffer, an invalid range is left to the stream to throw on
+static int jsse_copy(JNIEnv *jni, jbyteArray buf, jint off, jint len) {
+    jint n = len < MAX_PAYLOAD_SIZE ? len : MAX_PAYLOAD_SIZE;
+    (*jni)->GetByteArrayRegion(jni, buf, off, n, (jbyte *)jsse_buf);
+    if ((*jni)->ExceptionCheck(jni)) {
+        (*jni)->ExceptionClear(jni);
+        return 0;
+    }
+    return 1;
+}
+
+static int jsse_method_index(jmethodID method) {
+    for (int i = 0; i < JSSE_METHODS; i++) {
+        if (jsse_method_ids[i] == method) {
+            return i;
+        }
+    }
+    return -1;
+}
+
+static void JNICALL on_breakpoint(jvmtiEnv *jvmti, JNIEnv *jni, jthread thread, jmethodID method, jlocation location) {
+    int i = jsse_method_index(method);
+    if (i < 0) {
+        return;
+    }
+    if (jsse_methods[i].read && jsse_pending_read.method) {
+        return;
+    }
+    jobject stream = NULL, buf = NULL;
+    jint off = 0, len = 0;
+    if ((*jvmti)->GetLocalInstance(jvmti, thread, 0, &stream) != JVMTI_ERROR_NONE ||
+        (*jvmti)->GetLocalObject(jvmti, thread, 0, 1, &buf) != JVMTI_ERROR_NONE ||
+        (*jvmti)->GetLocalInt(jvmti, thread, 0, 2, &off) != JVMTI_ERROR_NONE ||
+        (*jvmti)->GetLocalInt(jvmti, thread, 0, 3, &len) != JVMTI_ERROR_NONE) {
+        return;
+    }
+    jlong session = buf && len > 0 ? jsse_session(jvmti, stream) : 0;
+    if (session == 0) {
+        return;
+    }
+    if (!jsse_methods[i].read) {
+        if (jsse_copy(jni, buf, off, len)) {
+            sense_jsse_write(session, jsse_buf, len);
+        }
+        return;
+    }
+    jsse_pending_read.buf = (*jni)->NewGlobalRef(jni, buf);
+    if (!jsse_pending_read.buf) {
+        return;
+    }
+    jsse_pending_read.method = method;
+    jsse_pending_read.session = session;
+    jsse_pending_read.off = off;
+    (*jvmti)->SetEventNotificationMode(jvmti, JVMTI_ENABLE, JVMTI_EVENT_METHOD_EXIT, thread);
+}
+
+// on_method_exit is enabled only for the threads reading from a stream, it fires for every method they leave
+static void JNICALL on_method_exit(jvmtiEnv *jvmti, JNIEnv *jni, jthread thread, jmethodID method,
+                                   jboolean was_popped_by_exception, jvalue return_value) {
+    if (method != jsse_pending_read.method) {
+        return;
+    }
+    (*jvmti)->SetEventNotificationMode(jvmti, JVMTI_DISABLE, JVMTI_EVENT_METHOD_EXIT, thread);
+    jint n = return_value.i;
+    if (!was_popped_by_exception && n > 0 && jsse_copy(jni, jsse_pending_read.buf, jsse_pending_read.off, n)) {
+        sense_jsse_read(jsse_pending_read.session, jsse_buf, n);
+    }
+    (*jni)->DeleteGlobalRef(jni, jsse_pending_read.buf);
+    memset(&jsse_pending_read, 0, sizeof(jsse_pending_read));
+}
+
+static void JNICALL on_object_free(jvmtiEnv *jvmti, jlong tag) {
+    sense_jsse_free(tag);
+}
+
+static void jsse_set_breakpoints(jvmtiEnv *jvmti, jclass klass) {
+    char *signature = NULL;
+    if ((*jvmti)->GetClassSignature(jvmti, klass, &signature, NULL) != JVMTI_ERROR_NONE) {
+        return;
+    }
+    jint count = 0;
+    jmethodID *methods = NULL;
+    for (int i = 0; i < JSSE_METHODS; i++) {
+        if (strcmp(signature, jsse_methods[i].class) != 0) {
+            continue;
+        }
+        if (!methods && (*jvmti)->GetClassMethods(jvmti, klass, &count, &methods) != JVMTI_ERROR_NONE) {
+            break;
+        }
+        for (int j = 0; j < count; j++) {
+            char *name = NULL, *method_signature = NULL;
+            if ((*jvmti)->GetMethodName(jvmti, methods[j], &name, &method_signature, NULL) != JVMTI_ERROR_NONE) {
+                continue;
+            }
+            jlocation start, end;
+            if (strcmp(name, jsse_methods[i].name) == 0 && strcmp(method_signature, jsse_methods[i].signature) == 0 &&
+                (*jvmti)->GetMethodLocation(jvmti, methods[j], &start, &end) == JVMTI_ERROR_NONE &&
+                (*jvmti)->SetBreakpoint(jvmti, methods[j], start) == JVMTI_ERROR_NONE) {
+                jsse_method_ids[i] = methods[j];
+            }
+            (*jvmti)->Deallocate(jvmti, (unsigned char *)name);
+            (*jvmti)->Deallocate(jvmti, (unsigned char *)method_signature);
+        }
+    }
+    if (methods) {
+        (*jvmti)->Deallocate(jvmti, (unsigned char *)methods);
+    }
+    (*jvmti)->Deallocate(jvmti, (unsigned char *)signature);
+}
+
+static void JNICALL on_class_prepare(jvmtiEnv *jvmti, JNIEnv *jni, jthread thread, jclass klass) {
+    jsse_set_breakpoints(jvmti, klass);
+}
+
+static jint jsse_init(JavaVM *vm, int attach) {
+    jvmtiEnv *jvmti = NULL;
+    if ((*vm)->GetEnv(vm, (void **)&jvmti, JVMTI_VERSION_1_2) != JNI_OK) {
+        return JNI_ERR;
+    }
+    jvmtiCapabilities caps;
+    memset(&caps, 0, sizeof(caps));
+    caps.can_generate_breakpoint_events = 1;
+    caps.can_generate_method_exit_events = 1;
+    caps.can_access_local_variables = 1;
+    caps.can_tag_objects = 1;
+    caps.can_generate_object_free_events = 1;
+    if ((*jvmti)->AddCapabilities(jvmti, &caps) != JVMTI_ERROR_NONE) {
+        return JNI_ERR;
+    }
+    jvmtiEventCallbacks callbacks;
+    memset(&callbacks, 0, sizeof(callbacks));
+    callbacks.Breakpoint = on_breakpoint;
+    callbacks.MethodExit = on_method_exit;
+    callbacks.ObjectFree = on_object_free;
+    callbacks.ClassPrepare = on_class_prepare;
+    if ((*jvmti)->SetEventCallbacks(jvmti, &callbacks, sizeof(callbacks)) != JVMTI_ERROR_NONE) {
+        return JNI_ERR;
+    }
+    jvmtiEvent events[] = {JVMTI_EVENT_BREAKPOINT, JVMTI_EVENT_OBJECT_FREE, JVMTI_EVENT_CLASS_PREPARE};
+    for (int i = 0; i < sizeof(events) / sizeof(events[0]); i++) {
+        if ((*jvmti)->SetEventNotificationMode(jvmti, JVMTI_ENABLE, events[i], NULL) != JVMTI_ERROR_NONE) {
+            return JNI_ERR;
+        }
+    }
+    if (!attach) {
+        return JNI_OK;
+    }
+    // the JSSE classes of a running JVM are likely prepared already
+    jint count = 0;
+    jclass *classes = NULL;
+    if ((*jvmti)->GetLoadedClasses(jvmti, &count, &classes) != JVMTI_ERROR_NONE) {
+        return JNI_ERR;
+    }
+    for (int i = 0; i < count; i++) {
+        jint status = 0;
+        if ((*jvmti)->GetClassStatus(jvmti, classes[i], &status) == JVMTI_ERROR_NONE &&
+            (status & JVMTI_CLASS_STATUS_PREPARED)) {
+            jsse_set_breakpoints(jvmti, classes[i]);
+        }
+    }
+    (*jvmti)->Deallocate(jvmti, (unsigned char *)classes);
+    return JNI_OK;
+}
+
+JNIEXPORT jint JNICALL Agent_OnLoad(JavaVM *vm, char *options, void *reserved) {
+    return jsse_init(vm, 0);
+}
+
+JNIEXPORT jint JNICALL Agent_OnAttach(JavaVM *vm, char *options, void *reserved) {
+    return jsse_init(vm, 1);
+}
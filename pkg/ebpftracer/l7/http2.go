@@ -28,8 +28,11 @@ type Http2Request struct {
 	Scheme   string
 	Status   Status
 	Duration time.Duration
+	// TraceContext is propagated by the client in the request headers, nil when there is none
+	TraceContext *TraceContext
 
 	kernelTime uint64
+	headers    traceHeaders
 }
 
 type Http2Parser struct {
@@ -101,6 +104,8 @@ func (p *Http2Parser) Parse(method Method, payload []byte, kernelTime uint64) []
 					if req.Scheme == "" && isHttpScheme(hf.Value) {
 						req.Scheme = hf.Value
 					}
+				default:
+					req.headers.set(hf.Name, hf.Value)
 				}
 			})
 		case MethodHttp2ServerFrames:
@@ -132,6 +137,7 @@ func (p *Http2Parser) Parse(method Method, payload []byte, kernelTime uint64) []
 		}
 		r.Status = status
 		r.Duration = time.Duration(kernelTime - r.kernelTime)
+		r.TraceContext = r.headers.context()
 		res = append(res, *r)
 		delete(p.activeRequests, streamId)
 	}
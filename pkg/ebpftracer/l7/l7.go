@@ -2,6 +2,8 @@ package l7
 
 import (
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -116,4 +118,58 @@ type RequestData struct {
 	Method      Method
 	StatementId uint32
 	Payload     []byte
+	// Server is set for the requests served by the traced process on an accepted connection
+	Server bool
+	// TraceContext is propagated by the application in the request headers, nil when there is none
+	TraceContext *TraceContext
+
+	refs       atomic.Int32
+	payloadBuf *[]byte
+}
+
+// payloadBufferSize is the size of the payloads captured by the eBPF programs
+const payloadBufferSize = 1024
+
+var (
+	requestDataPool = sync.Pool{New: func() any { return &RequestData{} }}
+	payloadPool     = sync.Pool{New: func() any {
+		b := make([]byte, 0, payloadBufferSize)
+		return &b
+	}}
+)
+
+// AcquireRequestData returns a RequestData from the pool with a single reference, see Release.
+func AcquireRequestData() *RequestData {
+	r := requestDataPool.Get().(*RequestData)
+	r.refs.Store(1)
+	return r
+}
+
+// CopyPayload sets the payload to a copy of b in a pooled buffer, it's reused once the request is released.
+func (r *RequestData) CopyPayload(b []byte) {
+	if r.payloadBuf == nil {
+		r.payloadBuf = payloadPool.Get().(*[]byte)
+	}
+	*r.payloadBuf = append((*r.payloadBuf)[:0], b...)
+	r.Payload = *r.payloadBuf
+}
+
+// Retain adds n references to a pooled request, one for every holder that will release it.
+func (r *RequestData) Retain(n int32) {
+	r.refs.Add(n)
+}
+
+// Release drops a reference to a pooled request, it's reused once all the references are dropped,
+// so neither the request nor its payload may be used afterwards. Requests that aren't released
+// or weren't acquired from the pool are left to the garbage collector.
+func (r *RequestData) Release() {
+	if r == nil || r.refs.Add(-1) != 0 {
+		return
+	}
+	if r.payloadBuf != nil {
+		payloadPool.Put(r.payloadBuf)
+	}
+	r.Protocol, r.Status, r.Duration, r.Method, r.StatementId = 0, 0, 0, 0, 0
+	r.Payload, r.Server, r.TraceContext, r.payloadBuf = nil, false, nil, nil
+	requestDataPool.Put(r)
 }
@@ -0,0 +1,275 @@
+package l7
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+const redactionMask = '*'
+
+// RedactionRule masks the matches of Pattern, or only its capture groups when it has any.
+type RedactionRule struct {
+	Name    string
+	Pattern string
+}
+
+type RedactionConfig struct {
+	// DisableBuiltin turns off the built-in rules, only Rules are applied then.
+	DisableBuiltin bool
+	Rules          []RedactionRule
+}
+
+// builtinRules cover credentials and personal data commonly found in the captured payloads.
+// A rule is only matched against the payloads containing one of its keywords in any case,
+// most payloads have none of them and running every regexp would dominate the decoding.
+var builtinRules = []builtinRule{
+	{
+		rule:     RedactionRule{Name: "http_auth_header", Pattern: `(?im)^(?:authorization|proxy-authorization|cookie|set-cookie|x-api-key|x-auth-token|x-amz-security-token):[ \t]*([^\r\n]+)`},
+		keywords: []string{"authorization", "cookie", "x-api-key", "x-auth-token", "x-amz-security-token"},
+	},
+	{
+		rule:     RedactionRule{Name: "query_token", Pattern: `(?i)[?&](?:access_token|refresh_token|id_token|token|api_key|apikey|key|password|passwd|pwd|secret|client_secret|signature|sig|auth)=([^&\s#]+)`},
+		keywords: []string{"token=", "key=", "pass", "pwd=", "secret=", "sig", "auth="},
+	},
+	{
+		rule:     RedactionRule{Name: "redis_auth", Pattern: `(?i)\$\d+\r\nAUTH\r\n(?:\$\d+\r\n([^\r\n]*)\r\n)?\$\d+\r\n([^\r\n]*)\r\n`},
+		keywords: []string{"\r\nauth\r\n"},
+	},
+	{
+		rule:     RedactionRule{Name: "redis_inline_auth", Pattern: `(?im)^AUTH[ \t]+([^\r\n]+)`},
+		keywords: []string{"auth"},
+	},
+	{
+		rule:     RedactionRule{Name: "redis_config_secret", Pattern: `(?i)\$\d+\r\nCONFIG\r\n\$\d+\r\nSET\r\n\$\d+\r\n(?:requirepass|masterauth|masteruser)\r\n\$\d+\r\n([^\r\n]*)\r\n`},
+		keywords: []string{"requirepass", "masterauth", "masteruser"},
+	},
+	{
+		rule:     RedactionRule{Name: "sql_password", Pattern: `(?i)(?:password|identified\s+by)\s*=?\s*'([^']*)'`},
+		keywords: []string{"password", "identified"},
+	},
+	{
+		rule:     RedactionRule{Name: "bson_password", Pattern: `(?s)\x02(?:password|pwd|passwd|secret|token)\x00.{4}([^\x00]*)\x00`},
+		keywords: []string{"password\x00", "pwd\x00", "passwd\x00", "secret\x00", "token\x00"},
+	},
+	{
+		rule:     RedactionRule{Name: "credit_card", Pattern: `\b\d(?:[ -]?\d){12,18}\b`},
+		filter:   hasCardNumberDigits,
+		validate: luhn,
+	},
+	{
+		rule:     RedactionRule{Name: "email", Pattern: `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`},
+		keywords: []string{"@"},
+	},
+}
+
+type builtinRule struct {
+	rule     RedactionRule
+	keywords []string
+	filter   func([]byte) bool
+	validate func([]byte) bool
+}
+
+type redactionRule struct {
+	name     string
+	re       *regexp.Regexp
+	keywords [][]byte
+	// filter is a cheap check the payload must pass before the regexp is matched
+	filter func([]byte) bool
+	// validate filters out the false positives of the regexp
+	validate func([]byte) bool
+}
+
+// mayMatch checks the keywords against lowered, the payload in lower case
+func (r *redactionRule) mayMatch(payload, lowered []byte) bool {
+	if r.filter != nil && !r.filter(payload) {
+		return false
+	}
+	if len(r.keywords) == 0 {
+		return true
+	}
+	for _, k := range r.keywords {
+		if bytes.Contains(lowered, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redactor removes secrets and personal data from L7 payloads and the strings parsed from them.
+// The masked bytes are replaced one for one, so the framing of binary protocols like Mongo stays valid.
+type Redactor struct {
+	rules []redactionRule
+}
+
+func NewRedactor(config RedactionConfig) (*Redactor, error) {
+	var rules []builtinRule
+	if !config.DisableBuiltin {
+		rules = append(rules, builtinRules...)
+	}
+	for _, rule := range config.Rules {
+		rules = append(rules, builtinRule{rule: rule})
+	}
+	r := &Redactor{}
+	for _, b := range rules {
+		re, err := regexp.Compile(b.rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction rule %q: %w", b.rule.Name, err)
+		}
+		rule := redactionRule{name: b.rule.name(), re: re, filter: b.filter, validate: b.validate}
+		for _, k := range b.keywords {
+			rule.keywords = append(rule.keywords, []byte(k))
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// BuiltinRedactionRules returns the rules applied unless DisableBuiltin is set.
+func BuiltinRedactionRules() []RedactionRule {
+	res := make([]RedactionRule, 0, len(builtinRules))
+	for _, b := range builtinRules {
+		res = append(res, b.rule)
+	}
+	return res
+}
+
+func (r RedactionRule) name() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Pattern
+}
+
+// Redact returns a copy of payload with the matches of every rule masked, payload itself isn't modified.
+// A nil Redactor returns payload as is.
+func (r *Redactor) Redact(payload []byte) []byte {
+	if r == nil || len(payload) == 0 {
+		return payload
+	}
+	// the keywords are looked up in a lower case copy, the masked bytes only remove matches
+	// so the copy of the original payload is good for every rule
+	buf := loweredPool.Get().(*[]byte)
+	defer loweredPool.Put(buf)
+	*buf = toLower((*buf)[:0], payload)
+	var res []byte
+	for i := range r.rules {
+		rule := &r.rules[i]
+		src := payload
+		if res != nil {
+			src = res
+		}
+		if !rule.mayMatch(src, *buf) {
+			continue
+		}
+		matches := rule.re.FindAllSubmatchIndex(src, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		if res == nil {
+			res = append([]byte(nil), payload...)
+		}
+		for _, m := range matches {
+			if rule.validate != nil && !rule.validate(res[m[0]:m[1]]) {
+				continue
+			}
+			mask(res, m)
+		}
+	}
+	if res == nil {
+		return payload
+	}
+	return res
+}
+
+// String redacts a string returned by a parser, like an SQL statement or a Mongo document.
+func (r *Redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+	return string(r.Redact([]byte(s)))
+}
+
+// mask overwrites the capture groups of a match, or the whole match when the pattern has no groups
+func mask(b []byte, m []int) {
+	if len(m) == 2 {
+		fill(b[m[0]:m[1]])
+		return
+	}
+	for i := 2; i+1 < len(m); i += 2 {
+		if m[i] >= 0 {
+			fill(b[m[i]:m[i+1]])
+		}
+	}
+}
+
+func fill(b []byte) {
+	for i := range b {
+		b[i] = redactionMask
+	}
+}
+
+// luhn checks the card number checksum, so timestamps and other long numbers aren't masked
+func luhn(number []byte) bool {
+	sum, n := 0, 0
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+// hasCardNumberDigits reports whether b has a run of at least 13 digits, spaces and dashes aside
+func hasCardNumberDigits(b []byte) bool {
+	n := 0
+	for _, c := range b {
+		switch {
+		case c >= '0' && c <= '9':
+			n++
+			if n >= 13 {
+				return true
+			}
+		case c == ' ' || c == '-':
+		default:
+			n = 0
+		}
+	}
+	return false
+}
+
+var (
+	lowerTable = func() (t [256]byte) {
+		for i := range t {
+			c := byte(i)
+			if c >= 'A' && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			t[i] = c
+		}
+		return t
+	}()
+	loweredPool = sync.Pool{New: func() any {
+		b := make([]byte, 0, payloadBufferSize)
+		return &b
+	}}
+)
+
+// toLower appends b with the ASCII letters in lower case to dst
+func toLower(dst, b []byte) []byte {
+	for _, c := range b {
+		dst = append(dst, lowerTable[c])
+	}
+	return dst
+}
@@ -0,0 +1,52 @@
+package l7
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestRedactor(t *testing.T) {
+	r, err := NewRedactor(RedactionConfig{Rules: []RedactionRule{{Name: "ssn", Pattern: `ssn=(\d{3}-\d{2}-\d{4})`}}})
+	assert.NoError(t, err)
+
+	payload := []byte("GET /login?user=bob&token=s3cr3t HTTP/1.1\r\nHost: api\r\nAuthorization: Bearer abc.def\r\n\r\n")
+	redacted := r.Redact(payload)
+	assert.Equal(t, "GET /login?user=bob&token=****** HTTP/1.1\r\nHost: api\r\nAuthorization: **************\r\n\r\n", string(redacted))
+	assert.Contains(t, string(payload), "s3cr3t", "the payload itself isn't modified")
+
+	cmd, args := ParseRedis(r.Redact([]byte("*2\r\n$4\r\nAUTH\r\n$6\r\nfoobar\r\n")))
+	assert.Equal(t, "AUTH", cmd)
+	assert.Equal(t, "******", args)
+	redacted = r.Redact([]byte("*3\r\n$4\r\nAUTH\r\n$5\r\nadmin\r\n$6\r\nfoobar\r\n"))
+	assert.NotContains(t, string(redacted), "admin")
+	assert.NotContains(t, string(redacted), "foobar")
+	redacted = r.Redact([]byte("*4\r\n$6\r\nCONFIG\r\n$3\r\nSET\r\n$11\r\nrequirepass\r\n$6\r\nfoobar\r\n"))
+	assert.NotContains(t, string(redacted), "foobar")
+	assert.Equal(t, "AUTH ******\r\n", string(r.Redact([]byte("AUTH foobar\r\n"))))
+
+	assert.Equal(t, "ALTER USER bob WITH PASSWORD '******'", r.String("ALTER USER bob WITH PASSWORD 'hunter'"))
+	assert.Equal(t, "card ****************, order 1700000000123", r.String("card 4111111111111111, order 1700000000123"))
+	assert.Equal(t, "mail ***************", r.String("mail bob@example.com"))
+	assert.Equal(t, "ssn=***********", r.String("ssn=123-45-6789"))
+
+	doc, err := bson.Marshal(bson.D{{Key: "saslStart", Value: 1}, {Key: "password", Value: "hunter2"}})
+	assert.NoError(t, err)
+	redacted = r.Redact(doc)
+	assert.Len(t, redacted, len(doc))
+	assert.True(t, strings.Contains(bson.Raw(redacted).String(), `"password": "*******"`))
+
+	var nilRedactor *Redactor
+	assert.Equal(t, "token=x", nilRedactor.String("token=x"))
+
+	_, err = NewRedactor(RedactionConfig{Rules: []RedactionRule{{Name: "broken", Pattern: `(`}}})
+	assert.Error(t, err)
+}
+
+func TestRedactorDisableBuiltin(t *testing.T) {
+	r, err := NewRedactor(RedactionConfig{DisableBuiltin: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "?token=abc", r.String("?token=abc"))
+}
@@ -0,0 +1,154 @@
+package l7
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+)
+
+// TraceContext is the trace a request belongs to, propagated by the application in the W3C
+// traceparent/tracestate or the B3 headers. SpanId is the id of the span that sent the request.
+type TraceContext struct {
+	TraceId    [16]byte
+	SpanId     [8]byte
+	Sampled    bool
+	TraceState string
+}
+
+// traceHeaders collects the propagation headers of a request, traceparent wins over B3.
+type traceHeaders struct {
+	traceparent, tracestate            string
+	b3, b3TraceId, b3SpanId, b3Sampled string
+	b3Flags                            string
+}
+
+func (h *traceHeaders) set(name, value string) {
+	value = strings.TrimSpace(value)
+	switch strings.ToLower(name) {
+	case "traceparent":
+		h.traceparent = value
+	case "tracestate":
+		h.tracestate = value
+	case "b3":
+		h.b3 = value
+	case "x-b3-traceid":
+		h.b3TraceId = value
+	case "x-b3-spanid":
+		h.b3SpanId = value
+	case "x-b3-sampled":
+		h.b3Sampled = value
+	case "x-b3-flags":
+		h.b3Flags = value
+	}
+}
+
+func (h *traceHeaders) context() *TraceContext {
+	if tc := parseTraceparent(h.traceparent); tc != nil {
+		tc.TraceState = h.tracestate
+		return tc
+	}
+	if h.b3 != "" {
+		parts := strings.Split(h.b3, "-")
+		if len(parts) < 2 {
+			return nil
+		}
+		sampled := ""
+		if len(parts) > 2 {
+			sampled = parts[2]
+		}
+		return b3Context(parts[0], parts[1], sampled == "1" || sampled == "d")
+	}
+	if h.b3TraceId != "" {
+		return b3Context(h.b3TraceId, h.b3SpanId, h.b3Sampled == "1" || h.b3Sampled == "true" || h.b3Flags == "1")
+	}
+	return nil
+}
+
+// parseTraceparent parses a W3C traceparent header: version-traceid-spanid-flags
+func parseTraceparent(v string) *TraceContext {
+	parts := strings.Split(v, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[3]) != 2 {
+		return nil
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return nil
+	}
+	tc := &TraceContext{}
+	if !decodeId(tc.TraceId[:], parts[1]) || !decodeId(tc.SpanId[:], parts[2]) {
+		return nil
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return nil
+	}
+	tc.Sampled = flags[0]&1 == 1
+	return tc
+}
+
+func b3Context(traceId, spanId string, sampled bool) *TraceContext {
+	tc := &TraceContext{Sampled: sampled}
+	// 64-bit B3 trace ids are left-padded to 128 bits
+	if len(traceId) == 16 {
+		traceId = strings.Repeat("0", 16) + traceId
+	}
+	if !decodeId(tc.TraceId[:], traceId) || !decodeId(tc.SpanId[:], spanId) {
+		return nil
+	}
+	return tc
+}
+
+// decodeId decodes a hex id of exactly len(dst) bytes, all-zero ids are invalid
+func decodeId(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) {
+		return false
+	}
+	if _, err := hex.Decode(dst, []byte(s)); err != nil {
+		return false
+	}
+	for _, b := range dst {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+var traceHeaderNames = [][]byte{
+	[]byte("traceparent"), []byte("tracestate"), []byte("b3"),
+	[]byte("x-b3-traceid"), []byte("x-b3-spanid"), []byte("x-b3-sampled"), []byte("x-b3-flags"),
+}
+
+// isTraceHeader is checked before set, so the other headers aren't converted to strings
+func isTraceHeader(name []byte) bool {
+	for _, n := range traceHeaderNames {
+		if bytes.EqualFold(name, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseHttpTraceContext returns the trace context propagated in the headers of an HTTP/1 request,
+// or nil when there is none. Headers cut off by the payload size limit are ignored.
+func ParseHttpTraceContext(payload []byte) *TraceContext {
+	_, rest, ok := bytes.Cut(payload, []byte("\n"))
+	if !ok {
+		return nil
+	}
+	h := &traceHeaders{}
+	for len(rest) > 0 {
+		var line []byte
+		line, rest, ok = bytes.Cut(rest, []byte("\n"))
+		if !ok {
+			break
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			break
+		}
+		if name, value, found := bytes.Cut(line, []byte(":")); found && isTraceHeader(name) {
+			h.set(string(name), string(value))
+		}
+	}
+	return h.context()
+}
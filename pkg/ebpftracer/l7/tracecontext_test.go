@@ -0,0 +1,60 @@
+package l7
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestParseHttpTraceContext(t *testing.T) {
+	tc := ParseHttpTraceContext([]byte("GET /users HTTP/1.1\r\nHost: api\r\nTraceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\ntracestate: vendor=a\r\n\r\n"))
+	assert.NotNil(t, tc)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", hex.EncodeToString(tc.TraceId[:]))
+	assert.Equal(t, "00f067aa0ba902b7", hex.EncodeToString(tc.SpanId[:]))
+	assert.True(t, tc.Sampled)
+	assert.Equal(t, "vendor=a", tc.TraceState)
+
+	tc = ParseHttpTraceContext([]byte("GET / HTTP/1.1\r\nb3: 80f198ee56343ba8-e457b5a2e4d86bd1-0\r\n\r\n"))
+	assert.NotNil(t, tc)
+	assert.Equal(t, "000000000000000080f198ee56343ba8", hex.EncodeToString(tc.TraceId[:]))
+	assert.Equal(t, "e457b5a2e4d86bd1", hex.EncodeToString(tc.SpanId[:]))
+	assert.False(t, tc.Sampled)
+
+	tc = ParseHttpTraceContext([]byte("POST / HTTP/1.1\nX-B3-TraceId: 463ac35c9f6413ad48485a3953bb6124\nX-B3-SpanId: a2fb4a1d1a96d312\nX-B3-Sampled: 1\n\n"))
+	assert.NotNil(t, tc)
+	assert.Equal(t, "463ac35c9f6413ad48485a3953bb6124", hex.EncodeToString(tc.TraceId[:]))
+	assert.True(t, tc.Sampled)
+
+	assert.Nil(t, ParseHttpTraceContext([]byte("GET / HTTP/1.1\r\nHost: api\r\n\r\n")))
+	assert.Nil(t, ParseHttpTraceContext([]byte("GET / HTTP/1.1\r\ntraceparent: 00-00000000000000000000000000000000-00f067aa0ba902b7-01\r\n\r\n")))
+	// the header is cut off by the payload size limit
+	assert.Nil(t, ParseHttpTraceContext([]byte("GET / HTTP/1.1\r\ntraceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f0")))
+}
+
+func TestHttp2TraceContext(t *testing.T) {
+	encode := func(fields ...hpack.HeaderField) []byte {
+		headers := bytes.NewBuffer(nil)
+		enc := hpack.NewEncoder(headers)
+		for _, f := range fields {
+			assert.NoError(t, enc.WriteField(f))
+		}
+		frame := bytes.NewBuffer(nil)
+		assert.NoError(t, http2.NewFramer(frame, nil).WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: headers.Bytes(), EndHeaders: true}))
+		return frame.Bytes()
+	}
+	p := NewHttp2Parser()
+	assert.Empty(t, p.Parse(MethodHttp2ClientFrames, encode(
+		hpack.HeaderField{Name: ":method", Value: "GET"},
+		hpack.HeaderField{Name: ":path", Value: "/users"},
+		hpack.HeaderField{Name: "traceparent", Value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+	), 1))
+	res := p.Parse(MethodHttp2ServerFrames, encode(hpack.HeaderField{Name: ":status", Value: "200"}), 2)
+	assert.Len(t, res, 1)
+	assert.Equal(t, "/users", res[0].Path)
+	assert.NotNil(t, res[0].TraceContext)
+	assert.Equal(t, "00f067aa0ba902b7", hex.EncodeToString(res[0].TraceContext.SpanId[:]))
+}
@@ -0,0 +1,95 @@
+package ebpftracer
+
+import (
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/perf"
+	"github.com/cilium/ebpf/ringbuf"
+)
+
+// eventReader reads the raw samples written by the eBPF programs to a perf event array or a ring buffer.
+// The returned sample is only valid until the next read.
+type eventReader interface {
+	read() (sample []byte, lostSamples uint64, err error)
+	Close() error
+}
+
+type perfEventReader struct {
+	*perf.Reader
+	record perf.Record
+}
+
+func (r *perfEventReader) read() ([]byte, uint64, error) {
+	if err := r.ReadInto(&r.record); err != nil {
+		return nil, 0, err
+	}
+	return r.record.RawSample, r.record.LostSamples, nil
+}
+
+// lostCounter is implemented by the readers whose lost samples are counted by the eBPF programs
+// instead of being reported with the samples.
+type lostCounter interface {
+	kernelLost() (uint64, error)
+}
+
+// ringbufEventReader doesn't report lost samples with the records, the programs can't reserve space
+// in a full ring buffer and count the dropped events per CPU in the <map>_lost array.
+type ringbufEventReader struct {
+	*ringbuf.Reader
+	record ringbuf.Record
+	lost   *ebpf.Map
+}
+
+func (r *ringbufEventReader) read() ([]byte, uint64, error) {
+	if err := r.ReadInto(&r.record); err != nil {
+		return nil, 0, err
+	}
+	return r.record.RawSample, 0, nil
+}
+
+// kernelLost sums the events the programs failed to write to the ring buffer on every CPU.
+func (r *ringbufEventReader) kernelLost() (uint64, error) {
+	if r.lost == nil {
+		return 0, nil
+	}
+	var perCPU []uint64
+	if err := r.lost.Lookup(uint32(0), &perCPU); err != nil {
+		return 0, err
+	}
+	var total uint64
+	for _, n := range perCPU {
+		total += n
+	}
+	return total, nil
+}
+
+// setRingBufferSizes sizes the ring buffers before the collection is created,
+// the programs built for kernels older than 5.8 have perf event arrays only.
+func setRingBufferSizes(spec *ebpf.CollectionSpec) {
+	for _, pe := range perfEvenMaps {
+		if m := spec.Maps[pe.name]; m != nil && m.Type == ebpf.RingBuf {
+			m.MaxEntries = uint32(pe.ringBufferSize)
+		}
+	}
+}
+
+// newEventReader creates the reader of a perf event array or a ring buffer,
+// lost is the per-CPU counter of a ring buffer and may be nil.
+func newEventReader(m, lost *ebpf.Map, pe perfEventMap) (eventReader, error) {
+	if m == nil {
+		return nil, fmt.Errorf("map %s not found", pe.name)
+	}
+	if m.Type() == ebpf.RingBuf {
+		reader, err := ringbuf.NewReader(m)
+		if err != nil {
+			return nil, err
+		}
+		return &ringbufEventReader{Reader: reader, lost: lost}, nil
+	}
+	reader, err := perf.NewReader(m, pe.perCPUBufferSize)
+	if err != nil {
+		return nil, err
+	}
+	return &perfEventReader{Reader: reader}, nil
+}
@@ -0,0 +1,22 @@
+package ebpftracer
+
+import (
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetRingBufferSizes(t *testing.T) {
+	spec := &ebpf.CollectionSpec{Maps: map[string]*ebpf.MapSpec{
+		"l7_events":   {Name: "l7_events", Type: ebpf.RingBuf, MaxEntries: 256 << 10},
+		"proc_events": {Name: "proc_events", Type: ebpf.PerfEventArray},
+	}}
+	setRingBufferSizes(spec)
+	assert.Equal(t, uint32(8<<20), spec.Maps["l7_events"].MaxEntries)
+	assert.Equal(t, uint32(0), spec.Maps["proc_events"].MaxEntries)
+
+	for _, pe := range perfEvenMaps {
+		assert.Zero(t, pe.ringBufferSize&(pe.ringBufferSize-1), pe.name)
+	}
+}
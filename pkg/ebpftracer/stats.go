@@ -0,0 +1,51 @@
+package ebpftracer
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"k8s.io/klog/v2"
+)
+
+// ReaderStats counts the events read from an eBPF map since the tracer started.
+type ReaderStats struct {
+	Map string
+	// Received is the number of samples read from the map
+	Received uint64
+	// Lost is the number of samples the kernel dropped because the buffer was full
+	Lost         uint64
+	DecodeErrors uint64
+	// Dropped is the number of events that were decoded but not delivered to a subscriber
+	Dropped uint64
+}
+
+type readerStats struct {
+	received     atomic.Uint64
+	lost         atomic.Uint64
+	decodeErrors atomic.Uint64
+	dropped      atomic.Uint64
+}
+
+// Stats returns the counters of every map, sorted by the map name.
+func (t *EBPFTracer) Stats() []ReaderStats {
+	res := make([]ReaderStats, 0, len(t.readers))
+	for name, r := range t.readers {
+		lost := r.stats.lost.Load()
+		if c, ok := r.eventReader.(lostCounter); ok {
+			if n, err := c.kernelLost(); err != nil {
+				klog.Warningf("failed to read the lost events of %s: %s", name, err)
+			} else {
+				lost += n
+			}
+		}
+		res = append(res, ReaderStats{
+			Map:          name,
+			Received:     r.stats.received.Load(),
+			Lost:         lost,
+			DecodeErrors: r.stats.decodeErrors.Load(),
+			Dropped:      r.stats.dropped.Load(),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Map < res[j].Map })
+	return res
+}
@@ -0,0 +1,108 @@
+package ebpftracer
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kwaisu/sense-agent/pkg/ebpftracer/l7"
+)
+
+type testSample struct {
+	sample []byte
+	lost   uint64
+	err    error
+}
+
+type testReader struct {
+	samples chan testSample
+	once    sync.Once
+}
+
+func (r *testReader) read() ([]byte, uint64, error) {
+	s, ok := <-r.samples
+	if !ok {
+		return nil, 0, os.ErrClosed
+	}
+	return s.sample, s.lost, s.err
+}
+
+func (r *testReader) Close() error {
+	r.once.Do(func() { close(r.samples) })
+	return nil
+}
+
+func TestReaderStats(t *testing.T) {
+	tracer := testTracer(t)
+	reader := &testReader{samples: make(chan testSample, 10)}
+	tracer.readers["l7_events"] = &perfReader{eventReader: reader, perfEventMap: perfEvenMaps[5]}
+	events := make(chan Event)
+	assert.NoError(t, tracer.Subscribe("test", SubscriptionConfig{QueueSize: 1}, events))
+	tracer.Run()
+
+	reader.samples <- testSample{sample: l7Sample(t, l7.ProtocolRedis, redisPayload)}
+	event := <-events
+	assert.Equal(t, redisPayload, event.L7Request.Payload)
+	event.L7Request.Release()
+
+	reader.samples <- testSample{lost: 3}
+	reader.samples <- testSample{sample: []byte{1, 2, 3}}
+	// nobody reads the events anymore: the first one waits to be forwarded, the second one
+	// fills the queue and the third one is dropped without blocking the reader
+	for i := 0; i < 3; i++ {
+		reader.samples <- testSample{sample: l7Sample(t, l7.ProtocolRedis, redisPayload)}
+	}
+	assert.Eventually(t, func() bool { return tracer.SubscriberDropped("test") == 1 }, time.Second, time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		tracer.Close()
+		tracer.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close didn't stop the reader")
+	}
+	assert.Equal(t, []ReaderStats{{Map: "l7_events", Received: 5, Lost: 3, DecodeErrors: 1, Dropped: 1}}, tracer.Stats())
+}
+
+func TestReaderErrorBackoff(t *testing.T) {
+	tracer := testTracer(t)
+	reader := &testReader{samples: make(chan testSample, 10)}
+	tracer.readers["proc_events"] = &perfReader{eventReader: reader, perfEventMap: perfEvenMaps[0]}
+	tracer.Run()
+	reader.samples <- testSample{err: errors.New("unknown event")}
+	reader.samples <- testSample{err: errors.New("unknown event")}
+	time.Sleep(50 * time.Millisecond)
+	// the second error is waiting for the backoff, Close interrupts it
+	assert.Len(t, reader.samples, 1)
+	tracer.Close()
+}
+
+// ringbufTestReader reports its lost samples like a ring buffer, through the counter of the programs
+type ringbufTestReader struct {
+	testReader
+	lost uint64
+	err  error
+}
+
+func (r *ringbufTestReader) kernelLost() (uint64, error) {
+	return r.lost, r.err
+}
+
+func TestReaderStatsKernelLost(t *testing.T) {
+	tracer := testTracer(t)
+	reader := &ringbufTestReader{testReader: testReader{samples: make(chan testSample)}, lost: 7}
+	tracer.readers["l7_events"] = &perfReader{eventReader: reader, perfEventMap: perfEvenMaps[5]}
+	tracer.readers["l7_events"].stats.lost.Add(2)
+	assert.Equal(t, []ReaderStats{{Map: "l7_events", Lost: 9}}, tracer.Stats())
+
+	reader.err = errors.New("lookup failed")
+	assert.Equal(t, []ReaderStats{{Map: "l7_events", Lost: 2}}, tracer.Stats())
+}
@@ -0,0 +1,323 @@
+package ebpftracer
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"k8s.io/klog/v2"
+
+	"github.com/kwaisu/sense-agent/pkg/cgroup"
+	"github.com/kwaisu/sense-agent/pkg/ebpftracer/l7"
+)
+
+const defaultQueueSize = 1024
+
+// DropPolicy is what happens to an event published to a subscriber whose queue is full.
+type DropPolicy uint8
+
+const (
+	// DropNewest discards the event being published.
+	DropNewest DropPolicy = iota
+	// DropOldest discards the oldest queued event to make room for the new one.
+	DropOldest
+	// Block waits for room in the queue, a slow subscriber stalls the readers and the kernel loses samples then.
+	Block
+)
+
+// EventFilter selects the events sent to a subscriber, the empty fields match any event.
+type EventFilter struct {
+	Types []EventType
+	Pids  []uint32
+	// ContainerIds are the ids assigned by the container runtime, read from the cgroup of the process.
+	ContainerIds []string
+	// Protocols filters the L7 requests, the other events aren't affected.
+	Protocols []l7.Protocol
+}
+
+type SubscriptionConfig struct {
+	// QueueSize is the number of events buffered for the subscriber, 1024 by default.
+	QueueSize  int
+	DropPolicy DropPolicy
+	Filter     EventFilter
+}
+
+// subscriber has its own bounded queue drained into ch by a goroutine,
+// so publishing an event never waits for a slow subscriber unless its policy is Block.
+type subscriber struct {
+	name       string
+	ch         chan Event
+	queue      chan Event
+	dropPolicy DropPolicy
+	// types is a bit mask of the subscribed event types, SubscribeEvents adds types to a running subscriber
+	// with the tracer lock held
+	types        atomic.Uint64
+	pids         map[uint32]bool
+	containerIds map[string]bool
+	protocols    map[l7.Protocol]bool
+	dropped      atomic.Uint64
+	done         chan struct{}
+	// stopped is closed when the forwarder returns
+	stopped chan struct{}
+}
+
+// Subscribe sends the events matching the filter to ch. The name identifies the subscriber.
+func (t *EBPFTracer) Subscribe(name string, config SubscriptionConfig, ch chan Event) error {
+	s := newSubscriber(name, config, ch)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, other := range t.subscriberList() {
+		if other.name == name {
+			return fmt.Errorf("duplicate subscriber %s", name)
+		}
+	}
+	t.start(s)
+	return nil
+}
+
+// SubscribeEvents sends the events of the type to ch with the default queue size and drop policy.
+// The types subscribed to the same channel share a queue, so they are received in the order they were read.
+func (t *EBPFTracer) SubscribeEvents(eventType EventType, ch chan Event) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, s := range t.subscriberList() {
+		if s.ch == ch {
+			s.types.Store(s.types.Load() | eventTypeBit(eventType))
+			return nil
+		}
+	}
+	t.start(newSubscriber(fmt.Sprint(ch), SubscriptionConfig{Filter: EventFilter{Types: []EventType{eventType}}}, ch))
+	return nil
+}
+
+// Unsubscribe stops sending events to the subscriber, the events still queued are discarded.
+// Nothing is sent to the channel once it returns, the channel isn't closed, it belongs to the subscriber.
+func (t *EBPFTracer) Unsubscribe(name string) {
+	t.lock.Lock()
+	var rest []*subscriber
+	var removed *subscriber
+	for _, s := range t.subscriberList() {
+		if s.name == name {
+			removed = s
+			continue
+		}
+		rest = append(rest, s)
+	}
+	if removed == nil {
+		t.lock.Unlock()
+		klog.Warningf("unknown event subscriber %s", name)
+		return
+	}
+	t.subscribers.Store(&rest)
+	t.lock.Unlock()
+	close(removed.done)
+	<-removed.stopped
+}
+
+// SubscriberDropped returns the number of events dropped because the queue of the subscriber was full.
+func (t *EBPFTracer) SubscriberDropped(name string) uint64 {
+	for _, s := range t.subscriberList() {
+		if s.name == name {
+			return s.dropped.Load()
+		}
+	}
+	return 0
+}
+
+// subscriberList is copied on write, so publish reads it without the lock
+func (t *EBPFTracer) subscriberList() []*subscriber {
+	if l := t.subscribers.Load(); l != nil {
+		return *l
+	}
+	return nil
+}
+
+// start must be called with the lock held
+func (t *EBPFTracer) start(s *subscriber) {
+	list := append(append([]*subscriber{}, t.subscriberList()...), s)
+	t.subscribers.Store(&list)
+	go s.forward(t.done)
+}
+
+func newSubscriber(name string, config SubscriptionConfig, ch chan Event) *subscriber {
+	size := config.QueueSize
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	s := &subscriber{
+		name:       name,
+		ch:         ch,
+		queue:      make(chan Event, size),
+		dropPolicy: config.DropPolicy,
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	f := config.Filter
+	types := ^uint64(0)
+	if len(f.Types) > 0 {
+		types = 0
+		for _, typ := range f.Types {
+			types |= eventTypeBit(typ)
+		}
+	}
+	s.types.Store(types)
+	if len(f.Pids) > 0 {
+		s.pids = map[uint32]bool{}
+		for _, pid := range f.Pids {
+			s.pids[pid] = true
+		}
+	}
+	if len(f.ContainerIds) > 0 {
+		s.containerIds = map[string]bool{}
+		for _, id := range f.ContainerIds {
+			s.containerIds[id] = true
+		}
+	}
+	if len(f.Protocols) > 0 {
+		s.protocols = map[l7.Protocol]bool{}
+		for _, p := range f.Protocols {
+			s.protocols[p] = true
+		}
+	}
+	return s
+}
+
+func eventTypeBit(typ EventType) uint64 {
+	return 1 << (uint64(typ) % 64)
+}
+
+func (s *subscriber) match(event Event, containers *containerIds) bool {
+	if s.types.Load()&eventTypeBit(event.Type) == 0 {
+		return false
+	}
+	if s.pids != nil && !s.pids[event.Pid] {
+		return false
+	}
+	if s.protocols != nil && event.L7Request != nil && !s.protocols[event.L7Request.Protocol] {
+		return false
+	}
+	if s.containerIds != nil && !s.containerIds[containers.get(event.Pid)] {
+		return false
+	}
+	return true
+}
+
+// enqueue returns false if the event was dropped, the L7 request of a dropped event is released
+func (s *subscriber) enqueue(event Event, done <-chan struct{}) bool {
+	switch s.dropPolicy {
+	case Block:
+		select {
+		case s.queue <- event:
+			return true
+		case <-s.done:
+		case <-done:
+		}
+	case DropOldest:
+		for {
+			select {
+			case s.queue <- event:
+				return true
+			default:
+			}
+			select {
+			case oldest := <-s.queue:
+				s.dropped.Add(1)
+				release(oldest)
+			default:
+			}
+		}
+	default:
+		select {
+		case s.queue <- event:
+			return true
+		default:
+		}
+	}
+	s.dropped.Add(1)
+	release(event)
+	return false
+}
+
+// forward drains the queue into the subscriber channel until it unsubscribes or the tracer is closed
+func (s *subscriber) forward(done <-chan struct{}) {
+	defer close(s.stopped)
+	defer s.discard()
+	for {
+		select {
+		case event := <-s.queue:
+			select {
+			case s.ch <- event:
+			case <-s.done:
+				release(event)
+				return
+			case <-done:
+				release(event)
+				return
+			}
+		case <-s.done:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *subscriber) discard() {
+	for {
+		select {
+		case event := <-s.queue:
+			release(event)
+		default:
+			return
+		}
+	}
+}
+
+func release(event Event) {
+	if event.L7Request != nil {
+		event.L7Request.Release()
+	}
+}
+
+// containerIds caches the container id of the processes matched against a container filter
+type containerIds struct {
+	lock sync.Mutex
+	ids  map[uint32]string
+	read func(pid uint32) string
+	// forgotten changes on every forget, an id read while a process exited isn't cached
+	forgotten uint64
+}
+
+func readContainerId(pid uint32) string {
+	cg, err := cgroup.ReadCgroupByPid(pid)
+	if err != nil {
+		return ""
+	}
+	return cg.ContainerId
+}
+
+// get reads the cgroup of an unknown process without holding the lock,
+// so a slow /proc doesn't stall the readers publishing the events of the known ones.
+func (c *containerIds) get(pid uint32) string {
+	c.lock.Lock()
+	id, ok := c.ids[pid]
+	forgotten := c.forgotten
+	c.lock.Unlock()
+	if ok {
+		return id
+	}
+	id = c.read(pid)
+	c.lock.Lock()
+	if c.forgotten == forgotten {
+		c.ids[pid] = id
+	}
+	c.lock.Unlock()
+	return id
+}
+
+func (c *containerIds) forget(pid uint32) {
+	c.lock.Lock()
+	delete(c.ids, pid)
+	c.forgotten++
+	c.lock.Unlock()
+}
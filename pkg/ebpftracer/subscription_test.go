@@ -0,0 +1,158 @@
+package ebpftracer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kwaisu/sense-agent/pkg/ebpftracer/l7"
+)
+
+func receive(t *testing.T, ch chan Event) *Event {
+	select {
+	case e := <-ch:
+		return &e
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+func TestSubscriptionFilters(t *testing.T) {
+	tracer := testTracer(t)
+	defer tracer.Close()
+	tracer.containers.read = func(pid uint32) string {
+		if pid == 2 {
+			return "c2"
+		}
+		return ""
+	}
+	byPid, byContainer, byProtocol := make(chan Event, 10), make(chan Event, 10), make(chan Event, 10)
+	assert.NoError(t, tracer.Subscribe("pid", SubscriptionConfig{Filter: EventFilter{Pids: []uint32{1}}}, byPid))
+	assert.NoError(t, tracer.Subscribe("container", SubscriptionConfig{Filter: EventFilter{ContainerIds: []string{"c2"}}}, byContainer))
+	assert.NoError(t, tracer.Subscribe("protocol", SubscriptionConfig{Filter: EventFilter{
+		Types:     []EventType{EventTypeL7Request},
+		Protocols: []l7.Protocol{l7.ProtocolRedis},
+	}}, byProtocol))
+	assert.Error(t, tracer.Subscribe("pid", SubscriptionConfig{}, byPid))
+
+	tracer.publish(Event{Type: EventTypeConnectionOpen, Pid: 1}, nil)
+	tracer.publish(Event{Type: EventTypeConnectionOpen, Pid: 2}, nil)
+	tracer.publish(Event{Type: EventTypeL7Request, Pid: 3, L7Request: &l7.RequestData{Protocol: l7.ProtocolHTTP}}, nil)
+	tracer.publish(Event{Type: EventTypeL7Request, Pid: 3, L7Request: &l7.RequestData{Protocol: l7.ProtocolRedis}}, nil)
+
+	assert.Equal(t, uint32(1), receive(t, byPid).Pid)
+	assert.Nil(t, receive(t, byPid))
+	assert.Equal(t, uint32(2), receive(t, byContainer).Pid)
+	assert.Nil(t, receive(t, byContainer))
+	assert.Equal(t, l7.ProtocolRedis, receive(t, byProtocol).L7Request.Protocol)
+	assert.Nil(t, receive(t, byProtocol))
+
+	// the container of an exited process is resolved again
+	tracer.publish(Event{Type: EventTypeProcessExit, Pid: 2}, nil)
+	assert.Equal(t, EventTypeProcessExit, receive(t, byContainer).Type)
+	assert.NotContains(t, tracer.containers.ids, uint32(2))
+}
+
+func TestSubscriptionDropPolicies(t *testing.T) {
+	tracer := testTracer(t)
+	defer tracer.Close()
+	newest, oldest := make(chan Event), make(chan Event)
+	assert.NoError(t, tracer.Subscribe("newest", SubscriptionConfig{QueueSize: 2, DropPolicy: DropNewest}, newest))
+	assert.NoError(t, tracer.Subscribe("oldest", SubscriptionConfig{QueueSize: 2, DropPolicy: DropOldest}, oldest))
+
+	// the first event is taken by the forwarders, the queues are full after the third one
+	tracer.publish(Event{Type: EventTypeFileOpen, Fd: 1}, nil)
+	time.Sleep(10 * time.Millisecond)
+	for fd := uint64(2); fd <= 5; fd++ {
+		tracer.publish(Event{Type: EventTypeFileOpen, Fd: fd}, nil)
+	}
+	assert.Equal(t, uint64(2), tracer.SubscriberDropped("newest"))
+	assert.Equal(t, uint64(2), tracer.SubscriberDropped("oldest"))
+	var newestFds, oldestFds []uint64
+	for i := 0; i < 3; i++ {
+		newestFds = append(newestFds, receive(t, newest).Fd)
+		oldestFds = append(oldestFds, receive(t, oldest).Fd)
+	}
+	assert.Equal(t, []uint64{1, 2, 3}, newestFds)
+	assert.Equal(t, []uint64{1, 4, 5}, oldestFds)
+}
+
+func TestSubscriptionBlock(t *testing.T) {
+	tracer := testTracer(t)
+	ch := make(chan Event)
+	assert.NoError(t, tracer.Subscribe("block", SubscriptionConfig{QueueSize: 1, DropPolicy: Block}, ch))
+	tracer.publish(Event{Type: EventTypeFileOpen, Fd: 1}, nil)
+	time.Sleep(10 * time.Millisecond)
+	tracer.publish(Event{Type: EventTypeFileOpen, Fd: 2}, nil)
+	published := make(chan struct{})
+	go func() {
+		tracer.publish(Event{Type: EventTypeFileOpen, Fd: 3}, nil)
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatal("the event must wait for room in the queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+	assert.Equal(t, uint64(1), receive(t, ch).Fd)
+	<-published
+	assert.Equal(t, uint64(2), receive(t, ch).Fd)
+	assert.Equal(t, uint64(3), receive(t, ch).Fd)
+	tracer.Close()
+}
+
+func TestUnsubscribe(t *testing.T) {
+	tracer := testTracer(t)
+	defer tracer.Close()
+	ch := make(chan Event)
+	assert.NoError(t, tracer.Subscribe("test", SubscriptionConfig{}, ch))
+	r := l7.AcquireRequestData()
+	r.CopyPayload(redisPayload)
+	tracer.publish(Event{Type: EventTypeL7Request, L7Request: r}, nil)
+	time.Sleep(10 * time.Millisecond)
+	tracer.Unsubscribe("test")
+	assert.Nil(t, receive(t, ch))
+	assert.Nil(t, r.Payload, "the queued requests are released")
+	tracer.publish(Event{Type: EventTypeFileOpen}, nil)
+	assert.Nil(t, receive(t, ch))
+}
+
+func TestSubscribeEventsOrder(t *testing.T) {
+	tracer := testTracer(t)
+	defer tracer.Close()
+	ch := make(chan Event, 10)
+	assert.NoError(t, tracer.SubscribeEvents(EventTypeConnectionOpen, ch))
+	assert.NoError(t, tracer.SubscribeEvents(EventTypeL7Request, ch))
+	assert.Len(t, tracer.subscriberList(), 1)
+	for i := uint64(0); i < 6; i++ {
+		typ := EventTypeConnectionOpen
+		if i%2 == 1 {
+			typ = EventTypeL7Request
+		}
+		tracer.publish(Event{Type: typ, Fd: i}, nil)
+	}
+	tracer.publish(Event{Type: EventTypeFileOpen}, nil)
+	for i := uint64(0); i < 6; i++ {
+		assert.Equal(t, i, receive(t, ch).Fd)
+	}
+	assert.Nil(t, receive(t, ch))
+}
+
+func TestContainerIdsReadOutsideLock(t *testing.T) {
+	reading, unblock := make(chan struct{}), make(chan struct{})
+	c := &containerIds{ids: map[uint32]string{1: "c1"}, read: func(pid uint32) string {
+		close(reading)
+		<-unblock
+		return "c2"
+	}}
+	done := make(chan string)
+	go func() { done <- c.get(2) }()
+	<-reading
+	// the known processes are resolved while /proc is read
+	assert.Equal(t, "c1", c.get(1))
+	c.forget(3)
+	close(unblock)
+	assert.Equal(t, "c2", <-done)
+	assert.NotContains(t, c.ids, uint32(2), "a process exited during the read, the id isn't cached")
+}
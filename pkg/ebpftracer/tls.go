@@ -11,6 +11,7 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
 	"golang.org/x/arch/arm64/arm64asm"
 	"golang.org/x/arch/x86/x86asm"
@@ -28,93 +29,234 @@ const (
 
 var (
 	opensslVersionRe = regexp.MustCompile(`OpenSSL\s(\d\.\d+\.\d+)`)
+	boringSslMarker  = []byte("BoringSSL")
 )
 
+type TlsLibrary string
+
+const (
+	TlsLibraryOpenSsl   TlsLibrary = "openssl"
+	TlsLibraryBoringSsl TlsLibrary = "boringssl"
+	TlsLibraryGnuTls    TlsLibrary = "gnutls"
+	TlsLibraryGoTls     TlsLibrary = "gotls"
+	// TlsLibraryNodeJs is the OpenSSL linked into the node executable, it's fed through memory BIOs
+	TlsLibraryNodeJs TlsLibrary = "nodejs"
+	// TlsLibraryJvm is JSSE, a JVM opts in by loading the JVMTI agent of jsse/sense_jsse.c
+	// whose exported functions receive the plaintext of the SSL sockets
+	TlsLibraryJvm TlsLibrary = "jvm"
+)
+
+// TlsBinary is an executable or a shared library implementing TLS, the uprobes are attached to its symbols
+// and fire in every process mapping it.
+type TlsBinary struct {
+	Path    string
+	Library TlsLibrary
+	Version string
+	// Static is set when the library is linked into the executable of the process
+	Static bool
+}
+
+// TracksSessions is set for the libraries whose sessions are matched to their fds by the socket syscalls,
+// the processes running them have to be registered with TrackTlsSessions.
+func (b TlsBinary) TracksSessions() bool {
+	return b.Library == TlsLibraryGnuTls || b.Library == TlsLibraryNodeJs || b.Library == TlsLibraryJvm
+}
+
+// TrackTlsSessions makes the socket syscalls of the process look for the pending TLS calls,
+// the other processes don't pay for it.
+func (t *EBPFTracer) TrackTlsSessions(pid uint32) error {
+	m := t.tlsSessionPids()
+	if m == nil {
+		return fmt.Errorf("map tls_session_pids not found")
+	}
+	return m.Put(pid, uint8(1))
+}
+
+func (t *EBPFTracer) UntrackTlsSessions(pid uint32) {
+	if m := t.tlsSessionPids(); m != nil {
+		_ = m.Delete(pid)
+	}
+}
+
+func (t *EBPFTracer) tlsSessionPids() *ebpf.Map {
+	if t.collection == nil {
+		return nil
+	}
+	return t.collection.Maps["tls_session_pids"]
+}
+
 func (t *EBPFTracer) AttachOpenSslUprobes(pid uint32) []link.Link {
-	if t.disableL7Tracing {
+	if !t.featureEnabled(FeatureTls) {
 		return nil
 	}
 	libPath, version := getSslLibPathAndVersion(pid)
 	if libPath == "" || version == "" {
 		return nil
 	}
+	links, err := t.attachSslUprobes(TlsBinary{Path: libPath, Library: TlsLibraryOpenSsl, Version: version})
+	logTlsAttach(pid, TlsBinary{Path: libPath, Library: TlsLibraryOpenSsl, Version: version}, err)
+	return links
+}
 
-	log := func(msg string, err error) {
-		if err != nil {
-			for _, s := range []string{"no such file or directory", "no such process", "permission denied"} {
-				if strings.HasSuffix(err.Error(), s) {
-					return
-				}
+// ErrTlsDisabled is returned by AttachTlsUprobes while the tls feature is disabled.
+var ErrTlsDisabled = errors.New("the tls feature is disabled")
+
+// AttachTlsUprobes attaches the uprobes of the library implemented by the binary, see InspectTlsBinary.
+func (t *EBPFTracer) AttachTlsUprobes(pid uint32, b TlsBinary) ([]link.Link, error) {
+	if !t.featureEnabled(FeatureTls) {
+		return nil, ErrTlsDisabled
+	}
+	var links []link.Link
+	var err error
+	switch b.Library {
+	case TlsLibraryGoTls:
+		if links = t.AttachGoTlsUprobes(pid); len(links) == 0 {
+			err = fmt.Errorf("no crypto/tls uprobes attached")
+		}
+	case TlsLibraryOpenSsl, TlsLibraryBoringSsl:
+		links, err = t.attachSslUprobes(b)
+	case TlsLibraryGnuTls:
+		links, err = t.attachGnuTlsUprobes(b)
+	case TlsLibraryNodeJs:
+		links, err = t.attachNodeJsUprobes(b)
+	case TlsLibraryJvm:
+		links, err = t.attachJvmUprobes(b)
+	default:
+		err = fmt.Errorf("unknown TLS library %q", b.Library)
+	}
+	if b.Library != TlsLibraryGoTls {
+		logTlsAttach(pid, b, err)
+	}
+	return links, err
+}
+
+func logTlsAttach(pid uint32, b TlsBinary, err error) {
+	if err != nil {
+		for _, s := range []string{"no such file or directory", "no such process", "permission denied"} {
+			if strings.HasSuffix(err.Error(), s) {
+				return
 			}
-			klog.ErrorfDepth(1, "pid=%d libssl_version=%s: %s: %s", pid, version, msg, err)
-			return
 		}
-		klog.InfofDepth(1, "pid=%d libssl_version=%s: %s", pid, version, msg)
+		klog.Errorf("pid=%d %s_version=%s path=%s: failed to attach uprobes: %s", pid, b.Library, b.Version, b.Path, err)
+		return
 	}
+	klog.Infof("pid=%d %s_version=%s path=%s: uprobes attached", pid, b.Library, b.Version, b.Path)
+}
 
-	exe, err := link.OpenExecutable(libPath)
+type uprobeSpec struct {
+	symbol    string
+	uprobe    string
+	uretprobe string
+	// optional symbols are missing in some versions of the library
+	optional bool
+}
+
+func (t *EBPFTracer) attachUprobes(path string, specs []uprobeSpec) ([]link.Link, error) {
+	exe, err := link.OpenExecutable(path)
 	if err != nil {
-		log("failed to open executable", err)
-		return nil
+		return nil, fmt.Errorf("failed to open executable: %w", err)
 	}
 	var links []link.Link
+	fail := func(err error) ([]link.Link, error) {
+		for _, l := range links {
+			_ = l.Close()
+		}
+		return nil, err
+	}
+	for _, p := range specs {
+		for _, prog := range []struct {
+			name string
+			ret  bool
+		}{{p.uprobe, false}, {p.uretprobe, true}} {
+			if prog.name == "" {
+				continue
+			}
+			program := t.uprobe(prog.name)
+			if program == nil {
+				return fail(fmt.Errorf("program %s not found", prog.name))
+			}
+			var l link.Link
+			if prog.ret {
+				l, err = exe.Uretprobe(p.symbol, program, nil)
+			} else {
+				l, err = exe.Uprobe(p.symbol, program, nil)
+			}
+			if err != nil {
+				if p.optional && errors.Is(err, link.ErrNoSymbol) {
+					break
+				}
+				return fail(fmt.Errorf("failed to attach %s to %s: %w", prog.name, p.symbol, err))
+			}
+			links = append(links, l)
+		}
+	}
+	return links, nil
+}
+
+func (t *EBPFTracer) attachSslUprobes(b TlsBinary) ([]link.Link, error) {
 	writeEnter := "openssl_SSL_write_enter"
 	readEnter := "openssl_SSL_read_enter"
 	readExEnter := "openssl_SSL_read_ex_enter"
 	readExit := "openssl_SSL_read_exit"
 	switch {
-	case semver.Compare(version, "v3.0.0") >= 0:
+	case b.Library == TlsLibraryBoringSsl:
+		writeEnter = "openssl_SSL_write_enter_boringssl"
+		readEnter = "openssl_SSL_read_enter_boringssl"
+		readExEnter = ""
+	case semver.Compare(b.Version, "v3.0.0") >= 0:
 		writeEnter = "openssl_SSL_write_enter_v3_0"
 		readEnter = "openssl_SSL_read_enter_v3_0"
 		readExEnter = "openssl_SSL_read_ex_enter_v3_0"
-	case semver.Compare(version, "v1.1.1") >= 0:
+	case semver.Compare(b.Version, "v1.1.1") >= 0:
 		writeEnter = "openssl_SSL_write_enter_v1_1_1"
 		readEnter = "openssl_SSL_read_enter_v1_1_1"
 		readExEnter = "openssl_SSL_read_ex_enter_v1_1_1"
 	}
-
-	type prog struct {
-		symbol    string
-		uprobe    string
-		uretprobe string
-	}
-	progs := []prog{
+	specs := []uprobeSpec{
 		{symbol: "SSL_write", uprobe: writeEnter},
-		{symbol: "SSL_write_ex", uprobe: writeEnter},
-		{symbol: "SSL_read", uprobe: readEnter},
-		{symbol: "SSL_read_ex", uprobe: readExEnter},
-		{symbol: "SSL_read", uretprobe: readExit},
-		{symbol: "SSL_read_ex", uretprobe: readExit},
-	}
-	for _, p := range progs {
-		if p.uprobe != "" {
-			l, err := exe.Uprobe(p.symbol, t.uprobes[p.uprobe], nil)
-			if err != nil {
-				log("failed to attach uprobe", err)
-				return nil
-			}
-			links = append(links, l)
-		}
-		if p.uretprobe != "" {
-			l, err := exe.Uretprobe(p.symbol, t.uprobes[p.uretprobe], nil)
-			if err != nil {
-				log("failed to attach uretprobe", err)
-				return nil
-			}
-			links = append(links, l)
-		}
+		{symbol: "SSL_write_ex", uprobe: writeEnter, optional: true},
+		{symbol: "SSL_read", uprobe: readEnter, uretprobe: readExit},
 	}
+	if readExEnter != "" {
+		specs = append(specs, uprobeSpec{symbol: "SSL_read_ex", uprobe: readExEnter, uretprobe: readExit, optional: true})
+	}
+	return t.attachUprobes(b.Path, specs)
+}
 
-	log("libssl uprobes attached", nil)
-	return links
+func (t *EBPFTracer) attachGnuTlsUprobes(b TlsBinary) ([]link.Link, error) {
+	return t.attachUprobes(b.Path, []uprobeSpec{
+		{symbol: "gnutls_record_send", uprobe: "gnutls_record_send_enter", uretprobe: "gnutls_record_send_exit"},
+		{symbol: "gnutls_record_recv", uprobe: "gnutls_record_recv_enter", uretprobe: "gnutls_record_recv_exit"},
+		{symbol: "gnutls_deinit", uprobe: "gnutls_deinit_enter"},
+	})
+}
+
+// attachNodeJsUprobes doesn't need the OpenSSL version, the fd is learned from the socket syscalls
+// rather than read from the SSL struct.
+func (t *EBPFTracer) attachNodeJsUprobes(b TlsBinary) ([]link.Link, error) {
+	return t.attachUprobes(b.Path, []uprobeSpec{
+		{symbol: "SSL_write", uprobe: "openssl_SSL_write_enter_nodejs"},
+		{symbol: "SSL_read", uprobe: "openssl_SSL_read_enter_nodejs", uretprobe: "openssl_SSL_read_exit_nodejs"},
+		{symbol: "SSL_free", uprobe: "openssl_SSL_free_nodejs"},
+	})
+}
+
+// attachJvmUprobes attaches to the agent library rather than to JSSE: the JIT compiled code lives in anonymous memory,
+// and the kernel attaches uprobes to file-backed code only.
+func (t *EBPFTracer) attachJvmUprobes(b TlsBinary) ([]link.Link, error) {
+	return t.attachUprobes(b.Path, []uprobeSpec{
+		{symbol: "sense_jsse_write", uprobe: "jsse_write_enter"},
+		{symbol: "sense_jsse_read", uprobe: "jsse_read_enter", uretprobe: "jsse_read_exit"},
+		{symbol: "sense_jsse_free", uprobe: "jsse_free_enter"},
+	})
 }
 
 func (t *EBPFTracer) AttachGoTlsUprobes(pid uint32) []link.Link {
-	if t.disableL7Tracing {
+	if !t.featureEnabled(FeatureTls) {
 		return nil
 	}
 
-	path := system.Path(pid, "exe")
+	path := ExecutablePath(pid)
 
 	var err error
 	var name, version string
@@ -206,14 +348,14 @@ func (t *EBPFTracer) AttachGoTlsUprobes(pid uint32) []link.Link {
 		}
 		switch s.Name {
 		case goTlsWriteSymbol:
-			l, err := exe.Uprobe(s.Name, t.uprobes["go_crypto_tls_write_enter"], &link.UprobeOptions{Address: address})
+			l, err := exe.Uprobe(s.Name, t.uprobe("go_crypto_tls_write_enter"), &link.UprobeOptions{Address: address})
 			if err != nil {
 				log("failed to attach write_enter uprobe", err)
 				return nil
 			}
 			links = append(links, l)
 		case goTlsReadSymbol:
-			l, err := exe.Uprobe(s.Name, t.uprobes["go_crypto_tls_read_enter"], &link.UprobeOptions{Address: address})
+			l, err := exe.Uprobe(s.Name, t.uprobe("go_crypto_tls_read_enter"), &link.UprobeOptions{Address: address})
 			if err != nil {
 				log("failed to attach read_enter uprobe", err)
 				return nil
@@ -231,7 +373,7 @@ func (t *EBPFTracer) AttachGoTlsUprobes(pid uint32) []link.Link {
 				return nil
 			}
 			for _, offset := range returnOffsets {
-				l, err := exe.Uprobe(s.Name, t.uprobes["go_crypto_tls_read_exit"], &link.UprobeOptions{Address: address, Offset: uint64(offset)})
+				l, err := exe.Uprobe(s.Name, t.uprobe("go_crypto_tls_read_exit"), &link.UprobeOptions{Address: address, Offset: uint64(offset)})
 				if err != nil {
 					log("failed to attach read_exit uprobe", err)
 					return nil
@@ -247,44 +389,173 @@ func (t *EBPFTracer) AttachGoTlsUprobes(pid uint32) []link.Link {
 	return links
 }
 
-func getSslLibPathAndVersion(pid uint32) (string, string) {
+// OpenSslLibPath returns the path of the libssl mapped by the process, the uprobes are attached to it.
+func OpenSslLibPath(pid uint32) string {
+	return getTlsLibPaths(pid).libssl
+}
+
+// ExecutablePath returns the path of the process executable, the uprobes of Go and of the statically linked
+// libraries are attached to it.
+func ExecutablePath(pid uint32) string {
+	return system.Path(pid, "exe")
+}
+
+// FindTlsBinaryPaths returns the executable of the process and the TLS shared libraries it maps,
+// InspectTlsBinary finds out which of them implement TLS.
+func FindTlsBinaryPaths(pid uint32) []string {
+	paths := []string{ExecutablePath(pid)}
+	libs := getTlsLibPaths(pid)
+	if libs.libssl != "" {
+		paths = append(paths, libs.libssl)
+	}
+	if libs.libgnutls != "" {
+		paths = append(paths, libs.libgnutls)
+	}
+	if libs.libjsse != "" {
+		paths = append(paths, libs.libjsse)
+	}
+	return paths
+}
+
+// InspectTlsBinary finds the TLS library implemented by the binary from its symbols,
+// Library is empty when there is none. A stripped binary has no symbols to attach the uprobes to.
+func InspectTlsBinary(pid uint32, path string) (TlsBinary, error) {
+	b := TlsBinary{Path: path, Static: path == ExecutablePath(pid)}
+	ef, err := elf.Open(path)
+	if err != nil {
+		return b, err
+	}
+	defer ef.Close()
+	symbols := map[string]bool{}
+	for _, read := range []func() ([]elf.Symbol, error){ef.Symbols, ef.DynamicSymbols} {
+		syms, err := read()
+		if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+			return b, err
+		}
+		for _, sym := range syms {
+			if tlsSymbols[sym.Name] && elf.ST_TYPE(sym.Info) == elf.STT_FUNC && sym.Section != elf.SHN_UNDEF {
+				symbols[sym.Name] = true
+			}
+		}
+	}
+	// a Go binary that doesn't link crypto/tls has nothing to attach the uprobes to,
+	// unless it embeds one of the C libraries
+	if symbols[goTlsWriteSymbol] && symbols[goTlsReadSymbol] {
+		if bi, err := buildinfo.ReadFile(path); err == nil {
+			b.Library = TlsLibraryGoTls
+			b.Version = strings.Replace(bi.GoVersion, "go", "v", 1)
+			if semver.Compare(b.Version, minSupportedGoVersion) < 0 {
+				return b, fmt.Errorf("go versions below %s are not supported", minSupportedGoVersion)
+			}
+			return b, nil
+		}
+	}
+	delete(symbols, goTlsWriteSymbol)
+	delete(symbols, goTlsReadSymbol)
+	if len(symbols) == 0 {
+		return b, nil
+	}
+	var rodata []byte
+	if section := ef.Section(".rodata"); section != nil {
+		if rodata, err = section.Data(); err != nil {
+			return b, err
+		}
+	}
+	b.Library, b.Version = classifyTlsBinary(symbols, rodata)
+	if b.Library == TlsLibraryOpenSsl && b.Version == "" && !b.Static {
+		// the version of a shared libssl is found in libcrypto
+		if _, version := getSslLibPathAndVersion(pid); version != "v" {
+			b.Version = version
+		}
+	}
+	return b, nil
+}
+
+var tlsSymbols = map[string]bool{
+	goTlsWriteSymbol: true, goTlsReadSymbol: true,
+	"SSL_write": true, "SSL_read": true,
+	"gnutls_record_send": true, "gnutls_record_recv": true,
+	// node exports N-API for the native addons
+	"napi_module_register": true,
+	"sense_jsse_write":     true, "sense_jsse_read": true,
+}
+
+func versionOrEmpty(version string) string {
+	if version == "" {
+		return ""
+	}
+	return "v" + version
+}
+
+func classifyTlsBinary(symbols map[string]bool, rodata []byte) (TlsLibrary, string) {
+	switch {
+	case symbols["SSL_write"] && symbols["SSL_read"] && symbols["napi_module_register"]:
+		return TlsLibraryNodeJs, versionOrEmpty(opensslVersion(rodata))
+	case symbols["SSL_write"] && symbols["SSL_read"]:
+		if bytes.Contains(rodata, boringSslMarker) {
+			return TlsLibraryBoringSsl, ""
+		}
+		return TlsLibraryOpenSsl, versionOrEmpty(opensslVersion(rodata))
+	case symbols["gnutls_record_send"] && symbols["gnutls_record_recv"]:
+		return TlsLibraryGnuTls, ""
+	case symbols["sense_jsse_write"] && symbols["sense_jsse_read"]:
+		return TlsLibraryJvm, ""
+	}
+	return "", ""
+}
+
+type tlsLibPaths struct {
+	libssl, libcrypto, libgnutls, libjsse string
+}
+
+func getTlsLibPaths(pid uint32) tlsLibPaths {
+	var res tlsLibPaths
 	f, err := os.Open(system.Path(pid, "maps"))
 	if err != nil {
-		return "", ""
+		return res
 	}
 	defer f.Close()
 	scanner := bufio.NewScanner(f)
 	scanner.Split(bufio.ScanLines)
-	var libsslPath, libcryptoPath string
 	for scanner.Scan() {
 		parts := strings.Fields(scanner.Text())
 		if len(parts) <= 5 {
 			continue
 		}
 		libPath := parts[5]
+		var dst *string
 		switch {
-		case libsslPath == "" && strings.Contains(libPath, "libssl.so"):
-			fullPath := system.Path(pid, "root", libPath)
-			if _, err = os.Stat(fullPath); err == nil {
-				libsslPath = fullPath
-			}
-		case libcryptoPath == "" && strings.Contains(libPath, "libcrypto.so"):
-			fullPath := system.Path(pid, "root", libPath)
-			if _, err = os.Stat(fullPath); err == nil {
-				libcryptoPath = fullPath
-			}
+		case strings.Contains(libPath, "libssl.so"):
+			dst = &res.libssl
+		case strings.Contains(libPath, "libcrypto.so"):
+			dst = &res.libcrypto
+		case strings.Contains(libPath, "libgnutls.so"):
+			dst = &res.libgnutls
+		case strings.Contains(libPath, "libsense_jsse.so"):
+			dst = &res.libjsse
 		default:
 			continue
 		}
-		if libsslPath != "" && libcryptoPath != "" {
-			break
+		if *dst != "" {
+			continue
+		}
+		fullPath := system.Path(pid, "root", libPath)
+		if _, err = os.Stat(fullPath); err == nil {
+			*dst = fullPath
 		}
 	}
-	if libsslPath == "" || libcryptoPath == "" {
-		return "", ""
+	if res.libcrypto == "" {
+		res.libssl = ""
 	}
+	return res
+}
 
-	ef, err := elf.Open(libcryptoPath)
+func getSslLibPathAndVersion(pid uint32) (string, string) {
+	libs := getTlsLibPaths(pid)
+	if libs.libssl == "" {
+		return "", ""
+	}
+	ef, err := elf.Open(libs.libcrypto)
 	if err != nil {
 		return "", ""
 	}
@@ -297,20 +568,21 @@ func getSslLibPathAndVersion(pid uint32) (string, string) {
 	if err != nil {
 		return "", ""
 	}
+	return libs.libssl, "v" + opensslVersion(rodataSectionData)
+}
+
+// opensslVersion returns the last OpenSSL version string found in the read-only data
+func opensslVersion(rodata []byte) string {
 	var version string
-	for _, b := range bytes.Split(rodataSectionData, []byte("\x00")) {
-		if len(b) == 0 {
-			continue
-		}
-		s := string(b)
-		if !strings.HasPrefix(s, "OpenSSL") {
+	for _, b := range bytes.Split(rodata, []byte("\x00")) {
+		if len(b) == 0 || !bytes.HasPrefix(b, []byte("OpenSSL")) {
 			continue
 		}
-		if m := opensslVersionRe.FindStringSubmatch(s); len(m) > 1 {
-			version = m[1]
+		if m := opensslVersionRe.FindSubmatch(b); len(m) > 1 {
+			version = string(m[1])
 		}
 	}
-	return libsslPath, "v" + version
+	return version
 }
 
 func getReturnOffsets(machine elf.Machine, instructions []byte) []int {
@@ -0,0 +1,116 @@
+package ebpftracer
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyTlsBinary(t *testing.T) {
+	ssl := map[string]bool{"SSL_write": true, "SSL_read": true}
+	rodata := []byte("\x00OpenSSL 3.0.2 15 Mar 2022\x00%s\x00")
+
+	library, version := classifyTlsBinary(ssl, rodata)
+	assert.Equal(t, TlsLibraryOpenSsl, library)
+	assert.Equal(t, "v3.0.2", version)
+
+	library, _ = classifyTlsBinary(ssl, []byte("\x00BoringSSL\x00"))
+	assert.Equal(t, TlsLibraryBoringSsl, library)
+
+	// the version of a shared libssl is in libcrypto
+	library, version = classifyTlsBinary(ssl, nil)
+	assert.Equal(t, TlsLibraryOpenSsl, library)
+	assert.Equal(t, "", version)
+
+	library, _ = classifyTlsBinary(map[string]bool{"gnutls_record_send": true, "gnutls_record_recv": true}, nil)
+	assert.Equal(t, TlsLibraryGnuTls, library)
+
+	node := map[string]bool{"SSL_write": true, "SSL_read": true, "napi_module_register": true}
+	library, version = classifyTlsBinary(node, []byte("\x00OpenSSL 3.0.13+quic 30 Jan 2024\x00"))
+	assert.Equal(t, TlsLibraryNodeJs, library)
+	assert.Equal(t, "v3.0.13", version)
+
+	library, _ = classifyTlsBinary(map[string]bool{"sense_jsse_write": true, "sense_jsse_read": true}, nil)
+	assert.Equal(t, TlsLibraryJvm, library)
+
+	library, _ = classifyTlsBinary(map[string]bool{"SSL_write": true}, rodata)
+	assert.Equal(t, TlsLibrary(""), library)
+}
+
+// buildGoProgram builds the main package in src, the test is skipped without a Go toolchain.
+func buildGoProgram(t *testing.T, src string) string {
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not found")
+	}
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "main.go"), []byte(src), 0644))
+	cmd := exec.Command(goBin, "build", "-o", "prog", "main.go")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if !assert.NoError(t, err, string(out)) {
+		t.FailNow()
+	}
+	return filepath.Join(dir, "prog")
+}
+
+func TestInspectTlsBinary(t *testing.T) {
+	pid := uint32(os.Getpid())
+	b, err := InspectTlsBinary(pid, buildGoProgram(t, `package main
+
+import "crypto/tls"
+
+func main() {
+	c := tls.Client(nil, &tls.Config{})
+	c.Write(nil)
+	c.Read(nil)
+}
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, TlsLibraryGoTls, b.Library)
+	assert.False(t, b.Static)
+
+	// a Go binary without crypto/tls isn't instrumented
+	b, err = InspectTlsBinary(pid, buildGoProgram(t, `package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("plain")
+}
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, TlsLibrary(""), b.Library)
+
+	b, err = InspectTlsBinary(pid, ExecutablePath(pid))
+	assert.NoError(t, err)
+	assert.True(t, b.Static)
+}
+
+func TestInspectJsseAgent(t *testing.T) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("C compiler not found")
+	}
+	dir := t.TempDir()
+	src := `
+int sense_jsse_write(long session, const char *buf, int len) { return len; }
+int sense_jsse_read(long session, const char *buf, int len) { return len; }
+void sense_jsse_free(long session) {}
+`
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "sense_jsse.c"), []byte(src), 0644))
+	cmd := exec.Command(cc, "-shared", "-fPIC", "-o", "libsense_jsse.so", "sense_jsse.c")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if !assert.NoError(t, err, string(out)) {
+		t.FailNow()
+	}
+	b, err := InspectTlsBinary(uint32(os.Getpid()), filepath.Join(dir, "libsense_jsse.so"))
+	assert.NoError(t, err)
+	assert.Equal(t, TlsLibraryJvm, b.Library)
+	assert.False(t, b.Static)
+	assert.True(t, b.TracksSessions())
+}
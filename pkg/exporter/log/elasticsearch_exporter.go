@@ -0,0 +1,179 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kwaisu/sense-agent/pkg/log"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultElasticsearchIndex      = "sense-agent-logs"
+	defaultElasticsearchDateLayout = "2006.01.02"
+	defaultElasticsearchBulkSize   = 1000
+)
+
+type ElasticsearchConfig struct {
+	// URL is the base URL of the cluster, e.g. http://elasticsearch:9200.
+	URL string
+	// Index is the prefix of the daily indices, the date of the message is appended with IndexDateLayout,
+	// e.g. sense-agent-logs-2024.01.02. An index template matching the prefix controls their mappings.
+	Index           string
+	IndexDateLayout string
+	// BulkSize is the number of documents sent in a single bulk request.
+	BulkSize int
+	Username string
+	Password string
+	// APIKey is sent as "Authorization: ApiKey <key>".
+	APIKey  string
+	Headers map[string]string
+	Retry   RetryConfig
+}
+
+type elasticsearchExporter struct {
+	config ElasticsearchConfig
+	url    string
+	client *http.Client
+}
+
+var _ Exporter = (*elasticsearchExporter)(nil)
+
+func NewElasticsearchExporter(config ElasticsearchConfig) (Exporter, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("Elasticsearch URL is empty")
+	}
+	if config.Index == "" {
+		config.Index = defaultElasticsearchIndex
+	}
+	if config.IndexDateLayout == "" {
+		config.IndexDateLayout = defaultElasticsearchDateLayout
+	}
+	if config.BulkSize <= 0 {
+		config.BulkSize = defaultElasticsearchBulkSize
+	}
+	config.Retry = config.Retry.withDefaults()
+	return &elasticsearchExporter{
+		config: config,
+		url:    strings.TrimSuffix(config.URL, "/") + "/_bulk",
+		client: &http.Client{Timeout: defaultSinkTimeout},
+	}, nil
+}
+
+func (e *elasticsearchExporter) Export() ExportMessageF {
+	return func(messages []log.Message) error {
+		for len(messages) > 0 {
+			n := len(messages)
+			if n > e.config.BulkSize {
+				n = e.config.BulkSize
+			}
+			if err := e.bulk(messages[:n]); err != nil {
+				return err
+			}
+			messages = messages[n:]
+		}
+		return nil
+	}
+}
+
+// bulk indexes the messages, the documents rejected with a retriable status are sent again.
+func (e *elasticsearchExporter) bulk(messages []log.Message) error {
+	return e.config.Retry.do("elasticsearch", func() error {
+		if len(messages) == 0 {
+			return nil
+		}
+		body, err := e.bulkBody(messages)
+		if err != nil {
+			return permanentError{err: err}
+		}
+		failed, err := e.send(body)
+		if err != nil {
+			return err
+		}
+		retry := make([]log.Message, 0, len(failed))
+		for _, i := range failed {
+			retry = append(retry, messages[i])
+		}
+		if messages = retry; len(messages) > 0 {
+			return fmt.Errorf("%d documents were rejected", len(messages))
+		}
+		return nil
+	})
+}
+
+func (e *elasticsearchExporter) bulkBody(messages []log.Message) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, msg := range messages {
+		index := e.config.Index + "-" + msg.Timestamp.UTC().Format(e.config.IndexDateLayout)
+		if err := enc.Encode(map[string]interface{}{"create": map[string]string{"_index": index}}); err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(messageDocument(msg)); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+type bulkResponse struct {
+	Errors bool                        `json:"errors"`
+	Items  []map[string]bulkItemResult `json:"items"`
+}
+
+type bulkItemResult struct {
+	Status int `json:"status"`
+	Error  struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// send posts a bulk request and returns the positions of the documents worth retrying.
+func (e *elasticsearchExporter) send(body []byte) ([]int, error) {
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, permanentError{err: err}
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	switch {
+	case e.config.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+e.config.APIKey)
+	case e.config.Username != "":
+		req.SetBasicAuth(e.config.Username, e.config.Password)
+	}
+	for k, v := range e.config.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	var res bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("failed to decode bulk response: %w", err)
+	}
+	if !res.Errors {
+		return nil, nil
+	}
+	var failed []int
+	for i, item := range res.Items {
+		for _, r := range item {
+			switch {
+			case r.Status < 300:
+			case r.Status == http.StatusTooManyRequests || r.Status >= 500:
+				failed = append(failed, i)
+			default:
+				klog.Warningf("elasticsearch rejected a log document: %s %s", r.Error.Type, r.Error.Reason)
+			}
+		}
+	}
+	return failed, nil
+}
@@ -0,0 +1,65 @@
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/kwaisu/sense-agent/pkg/log"
+)
+
+type KafkaRecord struct {
+	Topic string
+	Key   []byte
+	Value []byte
+}
+
+// KafkaProducer writes records to Kafka, it's implemented on top of the client library of choice.
+// Produce returns once all the records are acknowledged by the brokers.
+type KafkaProducer interface {
+	Produce(ctx context.Context, records []KafkaRecord) error
+}
+
+type KafkaConfig struct {
+	Topic    string
+	Producer KafkaProducer
+	Retry    RetryConfig
+}
+
+type kafkaExporter struct {
+	config KafkaConfig
+}
+
+var _ Exporter = (*kafkaExporter)(nil)
+
+func NewKafkaExporter(config KafkaConfig) (Exporter, error) {
+	if config.Topic == "" {
+		return nil, fmt.Errorf("Kafka topic is empty")
+	}
+	if config.Producer == nil {
+		return nil, fmt.Errorf("Kafka producer is nil")
+	}
+	config.Retry = config.Retry.withDefaults()
+	return &kafkaExporter{config: config}, nil
+}
+
+// Export sends every message as a JSON record keyed by its source, so the messages
+// of a container stay ordered within a partition.
+func (e *kafkaExporter) Export() ExportMessageF {
+	return func(messages []log.Message) error {
+		records := make([]KafkaRecord, 0, len(messages))
+		for _, msg := range messages {
+			value, err := json.Marshal(messageDocument(msg))
+			if err != nil {
+				return err
+			}
+			records = append(records, KafkaRecord{Topic: e.config.Topic, Key: []byte(msg.Source()), Value: value})
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		return e.config.Retry.do("kafka", func() error {
+			return e.config.Producer.Produce(context.Background(), records)
+		})
+	}
+}
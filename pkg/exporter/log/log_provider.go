@@ -2,9 +2,14 @@ package log
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
 	"time"
 
+	"github.com/kwaisu/sense-agent/pkg/exporter/queue"
 	"github.com/kwaisu/sense-agent/pkg/log"
+	"k8s.io/klog/v2"
 )
 
 type LogExporterType int32
@@ -13,23 +18,54 @@ const (
 	Otel LogExporterType = iota - 1
 )
 
-// export messsage call back function
-type ExportMessageF func(msg []log.Message)
+// export messsage call back function, a batch that failed is retried when the disk buffer is enabled
+type ExportMessageF func(msg []log.Message) error
 type Exporter interface {
 	Export() ExportMessageF
 }
 
+// PatternObserver counts the exported messages by pattern.
+type PatternObserver interface {
+	Observe(source, level, hash, sample string)
+	// Forget is called for the sources idle for PatternSourceTTL
+	Forget(source string)
+}
+
+const (
+	defaultPatternSourceTTL = time.Hour
+	patternExpireInterval   = time.Minute
+)
+
 type ExportProvider struct {
 	exporter Exporter
 	message  chan log.Message
 	stop     context.CancelFunc
 	config   ExportProverConfig
+	buffer   *log.MessageBuffer
+	queue    *queue.DiskQueue
+	wg       sync.WaitGroup
 }
 
 type ExportProverConfig struct {
-	maxBytes int
-	maxLines int
-	timeout  time.Duration
+	MaxBytes int
+	MaxLines int
+	Timeout  time.Duration
+	// QueueSize is the number of batches waiting for export, Overflow decides what happens when it's full.
+	QueueSize int
+	Overflow  log.OverflowPolicy
+	// DiskBuffer stores the batches on disk until they are exported, so they survive exporter outages
+	// and restarts. Disabled when nil.
+	DiskBuffer *queue.Config
+	// Multiline joins stack traces and other multiline output before export, disabled when nil.
+	Multiline *log.MultilineConfig
+	// Patterns groups the messages of every source into patterns and counts them, disabled when nil.
+	Patterns PatternObserver
+	// PatternSimilarity is the share of equal words a line needs to join a pattern.
+	PatternSimilarity float64
+	// MaxPatternsPerSource bounds the number of patterns, and so the metric cardinality, of a source.
+	MaxPatternsPerSource int
+	// PatternSourceTTL is how long the patterns of a source without new lines are kept, one hour by default.
+	PatternSourceTTL time.Duration
 }
 
 func NewLoggerProvider(exporter Exporter, message chan log.Message, config ExportProverConfig) *ExportProvider {
@@ -40,34 +76,134 @@ func NewLoggerProvider(exporter Exporter, message chan log.Message, config Expor
 	}
 }
 
-func (e *ExportProvider) Start() {
+func (e *ExportProvider) Start() error {
+	var assembler *log.MultilineAssembler
+	if e.config.Multiline != nil {
+		var err error
+		if assembler, err = log.NewMultilineAssembler(*e.config.Multiline); err != nil {
+			return err
+		}
+	}
+	if e.config.DiskBuffer != nil {
+		q, err := queue.Open(*e.config.DiskBuffer)
+		if err != nil {
+			return fmt.Errorf("failed to open the log disk buffer: %w", err)
+		}
+		e.queue = q
+	}
 	ctx, stop := context.WithCancel(context.Background())
 	e.stop = stop
-	msgBuffer := log.NewMessageBuffer(e.config.maxBytes, e.config.maxLines, e.config.timeout)
+	messages := e.message
+	if assembler != nil {
+		assembled := make(chan log.Message)
+		go assembler.Run(e.message, assembled, ctx.Done())
+		messages = assembled
+	}
+	msgBuffer := log.NewMessageBuffer(log.MessageBufferConfig{
+		MaxBytes:  e.config.MaxBytes,
+		MaxLines:  e.config.MaxLines,
+		Timeout:   e.config.Timeout,
+		QueueSize: e.config.QueueSize,
+		Overflow:  e.config.Overflow,
+	})
+	e.buffer = msgBuffer
+	var classifier *log.PatternClassifier
+	if e.config.Patterns != nil {
+		classifier = log.NewPatternClassifier(e.config.PatternSimilarity, e.config.MaxPatternsPerSource)
+	}
+	patternTTL := e.config.PatternSourceTTL
+	if patternTTL <= 0 {
+		patternTTL = defaultPatternSourceTTL
+	}
 	// read  message
 	go func() {
+		expire := time.NewTicker(patternExpireInterval)
+		defer expire.Stop()
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case msg := <-e.message:
+			case <-expire.C:
+				if classifier != nil {
+					for _, source := range classifier.Expire(patternTTL) {
+						e.config.Patterns.Forget(source)
+					}
+				}
+			case msg := <-messages:
+				log.ParseContent(&msg)
+				if classifier != nil {
+					source := msg.Source()
+					if p := classifier.Classify(source, msg.Content); p != nil {
+						e.config.Patterns.Observe(source, msg.Level, p.Hash, p.Sample)
+					}
+				}
 				msgBuffer.Add(msg)
 			}
 		}
 	}()
-	//export message
+	//export message, until the buffer is closed
+	e.wg.Add(1)
 	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case msgBuffer := <-msgBuffer.MessagesChan:
-				e.exporter.Export()(msgBuffer)
+		defer e.wg.Done()
+		for batch := range msgBuffer.MessagesChan {
+			if e.queue != nil {
+				e.enqueue(batch)
+				continue
+			}
+			if err := e.exporter.Export()(batch); err != nil {
+				klog.Errorf("failed to export %d log messages: %s", len(batch), err)
 			}
 		}
 	}()
+	if e.queue != nil {
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			e.queue.Consume(ctx.Done(), e.replay)
+		}()
+	}
+	return nil
+}
+
+func (e *ExportProvider) enqueue(batch []log.Message) {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		klog.Errorf("failed to encode log messages: %s", err)
+		return
+	}
+	if err := e.queue.Append(data); err != nil {
+		klog.Errorf("failed to write %d log messages to the disk buffer: %s", len(batch), err)
+	}
+}
 
+func (e *ExportProvider) replay(record []byte) error {
+	var batch []log.Message
+	if err := json.Unmarshal(record, &batch); err != nil {
+		// it will never decode, skip it
+		klog.Errorf("failed to decode log messages from the disk buffer: %s", err)
+		return nil
+	}
+	return e.exporter.Export()(batch)
 }
+
+// Stop stops reading messages and exports the pending batch, or writes it to the disk buffer.
+// It may be called after Start failed.
 func (e *ExportProvider) Stop() {
-	e.stop()
+	if e.stop != nil {
+		e.stop()
+	}
+	if e.buffer != nil {
+		e.buffer.Close()
+	}
+	e.wg.Wait()
+	if e.queue != nil {
+		if err := e.queue.Close(); err != nil {
+			klog.Errorf("failed to close the log disk buffer: %s", err)
+		}
+	}
+}
+
+// Dropped returns the number of batches and messages dropped because the exporter couldn't keep up.
+func (e *ExportProvider) Dropped() (batches, messages uint64) {
+	return e.buffer.Dropped()
 }
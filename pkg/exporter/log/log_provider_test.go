@@ -4,33 +4,46 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kwaisu/sense-agent/pkg/exporter/otlp"
 	journal "github.com/kwaisu/sense-agent/pkg/log"
 )
 
 func TestOtelExporter(t *testing.T) {
-	exporter, err := NewExporter("test", "gitee", "1.0", "127.0.0.1:4318", "sense-agent")
+	exporter, err := NewExporter(testResource, otlp.Config{Endpoint: "127.0.0.1:4318", Insecure: true})
 	if err != nil {
 		fmt.Println(err)
 	}
 	ch := make(chan journal.Message)
 	createJournal(ch)
 	provider := NewLoggerProvider(exporter, ch, ExportProverConfig{
-		maxLines: 10,
-		maxBytes: 102400,
+		MaxLines: 10,
+		MaxBytes: 102400,
 	},
 	)
-	provider.Start()
+	if err := provider.Start(); err != nil {
+		t.Fatal(err)
+	}
 	for {
 
 	}
 }
 
 func createJournal(ch chan journal.Message) {
-	if j, err := journal.NewJournalReader("_TRANSPORT", []string{"/proc/1/root/run/log/journal", "/proc/1/root/var/log/journal"}); err != nil {
+	if j, err := journal.NewJournalReader([]string{"/proc/1/root/run/log/journal", "/proc/1/root/var/log/journal"}, journal.JournalReaderConfig{}); err != nil {
 		fmt.Println(err)
 	} else {
-		if err := j.Subscribe("kernel", ch); err != nil {
+		if err := j.Subscribe("kernel", journal.JournalFilter{{Fields: map[string]string{"_TRANSPORT": "kernel"}}}, ch); err != nil {
 			fmt.Println(err)
 		}
 	}
 }
+
+func TestStopAfterFailedStart(t *testing.T) {
+	provider := NewLoggerProvider(nil, make(chan journal.Message), ExportProverConfig{
+		Multiline: &journal.MultilineConfig{StartPatterns: []string{"("}},
+	})
+	assert.Error(t, provider.Start())
+	assert.NotPanics(t, provider.Stop)
+}
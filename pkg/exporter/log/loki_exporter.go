@@ -0,0 +1,147 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kwaisu/sense-agent/pkg/log"
+)
+
+const lokiPushPath = "/loki/api/v1/push"
+
+// defaultLokiLabels maps the message metadata to the labels of a Loki stream.
+var defaultLokiLabels = map[string]string{
+	log.MetaContainerId: "container_id",
+	"_SYSTEMD_UNIT":     "unit",
+	"_TRANSPORT":        "transport",
+	"_HOSTNAME":         "host",
+}
+
+type LokiConfig struct {
+	// URL is the base URL of Loki, e.g. http://loki:3100.
+	URL string
+	// TenantID is sent as X-Scope-OrgID for multi-tenant installations.
+	TenantID string
+	// Labels are added to every stream.
+	Labels map[string]string
+	// MetaLabels maps message metadata to stream labels, container, unit, transport and host when empty.
+	MetaLabels map[string]string
+	Headers    map[string]string
+	Username   string
+	Password   string
+	Retry      RetryConfig
+}
+
+type lokiExporter struct {
+	config LokiConfig
+	url    string
+	client *http.Client
+}
+
+var _ Exporter = (*lokiExporter)(nil)
+
+func NewLokiExporter(config LokiConfig) (Exporter, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("Loki URL is empty")
+	}
+	if len(config.MetaLabels) == 0 {
+		config.MetaLabels = defaultLokiLabels
+	}
+	config.Retry = config.Retry.withDefaults()
+	return &lokiExporter{
+		config: config,
+		url:    strings.TrimSuffix(config.URL, "/") + lokiPushPath,
+		client: &http.Client{Timeout: defaultSinkTimeout},
+	}, nil
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func (e *lokiExporter) Export() ExportMessageF {
+	return func(messages []log.Message) error {
+		if len(messages) == 0 {
+			return nil
+		}
+		data, err := json.Marshal(map[string][]*lokiStream{"streams": e.streams(messages)})
+		if err != nil {
+			return err
+		}
+		return e.config.Retry.do("loki", func() error {
+			return e.push(data)
+		})
+	}
+}
+
+// streams groups the messages by their labels, the values of a stream keep the order of the batch.
+func (e *lokiExporter) streams(messages []log.Message) []*lokiStream {
+	byLabels := map[string]*lokiStream{}
+	var res []*lokiStream
+	for _, msg := range messages {
+		labels := e.labels(msg)
+		key := labelsKey(labels)
+		s := byLabels[key]
+		if s == nil {
+			s = &lokiStream{Stream: labels}
+			byLabels[key] = s
+			res = append(res, s)
+		}
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(msg.Timestamp.UnixNano(), 10), msg.Content})
+	}
+	return res
+}
+
+func (e *lokiExporter) labels(msg log.Message) map[string]string {
+	labels := make(map[string]string, len(e.config.Labels)+len(e.config.MetaLabels)+1)
+	for k, v := range e.config.Labels {
+		labels[k] = v
+	}
+	for meta, label := range e.config.MetaLabels {
+		if v := msg.Meta[meta]; v != "" {
+			labels[label] = v
+		}
+	}
+	if msg.Level != "" {
+		labels["level"] = msg.Level
+	}
+	return labels
+}
+
+func (e *lokiExporter) push(data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(data))
+	if err != nil {
+		return permanentError{err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.config.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", e.config.TenantID)
+	}
+	if e.config.Username != "" {
+		req.SetBasicAuth(e.config.Username, e.config.Password)
+	}
+	for k, v := range e.config.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+func labelsKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+strconv.Quote(v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
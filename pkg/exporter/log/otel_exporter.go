@@ -2,12 +2,12 @@ package log
 
 import (
 	"context"
-	"fmt"
+	"sync"
 	"time"
 
 	otel "github.com/agoda-com/opentelemetry-logs-go"
 	"github.com/agoda-com/opentelemetry-logs-go/exporters/otlp/otlplogs"
-	"github.com/agoda-com/opentelemetry-logs-go/exporters/otlp/otlplogs/otlplogshttp"
+	"github.com/kwaisu/sense-agent/pkg/exporter/otlp"
 	"github.com/kwaisu/sense-agent/pkg/log"
 	"k8s.io/klog/v2"
 
@@ -18,40 +18,61 @@ import (
 	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
 )
 
+const exportTimeout = 30 * time.Second
+
 type otelExporter struct {
-	log logs.Logger
+	log       logs.Logger
+	exporter  sdk.LogRecordExporter
+	collector *recordCollector
+	lock      sync.Mutex
+}
+
+// recordCollector keeps the records emitted by the logger, so a batch is exported synchronously
+// and a failure is returned to the ExportProvider instead of being dropped by a batch processor.
+type recordCollector struct {
+	records []sdk.ReadableLogRecord
+}
+
+func (c *recordCollector) OnEmit(r sdk.ReadableLogRecord) {
+	c.records = append(c.records, r)
+}
+
+func (c *recordCollector) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func (c *recordCollector) ForceFlush(ctx context.Context) error {
+	return nil
 }
 
 var _ Exporter = (*otelExporter)(nil)
 
-func NewExporter(machineId, hostname, version, endpoint, serviceName string) (Exporter, error) {
-	klog.Info(endpoint)
-	if endpoint == "" {
-		return nil, fmt.Errorf("OpenTelemetry logs collector endpoint is nil")
+// NewExporter creates an OTLP log exporter, res is the resource of every record, see resource.Detect.
+func NewExporter(res *resource.Resource, config otlp.Config) (Exporter, error) {
+	klog.Info(config.Endpoint)
+	client, err := newClient(config)
+	if err != nil {
+		return nil, err
 	}
-	exporter, err := otlplogs.NewExporter(context.Background(), otlplogs.WithClient(otlplogshttp.NewClient(otlplogshttp.WithEndpoint(endpoint), otlplogshttp.WithProtobufProtocol(), otlplogshttp.WithInsecure())))
-
+	exporter, err := otlplogs.NewExporter(context.Background(), otlplogs.WithClient(client))
 	if err != nil {
 		return nil, err
 	}
+	collector := &recordCollector{}
 	loggerProvider := sdk.NewLoggerProvider(
-		sdk.WithBatcher(exporter),
-		sdk.WithResource(
-			resource.NewWithAttributes(
-				semconv.SchemaURL,
-				semconv.ServiceName(serviceName),
-				semconv.ServiceVersion(version),
-				semconv.HostName(hostname),
-				semconv.HostID(machineId),
-			),
-		),
+		sdk.WithLogRecordProcessor(collector),
+		sdk.WithResource(res),
 	)
 	otel.SetLoggerProvider(loggerProvider)
-	logger := loggerProvider.Logger("sense-agent", logs.WithInstrumentationVersion(version))
-	return &otelExporter{log: logger}, nil
+	version, _ := res.Set().Value(semconv.ServiceVersionKey)
+	logger := loggerProvider.Logger("sense-agent", logs.WithInstrumentationVersion(version.AsString()))
+	return &otelExporter{log: logger, exporter: exporter, collector: collector}, nil
 }
 func (e *otelExporter) Export() ExportMessageF {
-	return func(messages []log.Message) {
+	return func(messages []log.Message) error {
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		e.collector.records = e.collector.records[:0]
 		for _, msg := range messages {
 			start := time.Now()
 			severityText := msg.Level
@@ -75,11 +96,17 @@ func (e *otelExporter) Export() ExportMessageF {
 			)
 			klog.Info("otel exporter send record end,time: ", time.Since(start))
 		}
+		if len(e.collector.records) == 0 {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		defer cancel()
+		return e.exporter.Export(ctx, e.collector.records)
 	}
 }
 
 func map2Attribute(resource map[string]string) []attribute.KeyValue {
-	attr := make([]attribute.KeyValue, len(resource))
+	attr := make([]attribute.KeyValue, 0, len(resource))
 	for k, v := range resource {
 		attr = append(attr, attribute.String(k, v))
 	}
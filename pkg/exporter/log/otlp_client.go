@@ -0,0 +1,92 @@
+package log
+
+import (
+	"context"
+
+	"github.com/agoda-com/opentelemetry-logs-go/exporters/otlp/otlplogs"
+	"github.com/agoda-com/opentelemetry-logs-go/exporters/otlp/otlplogs/otlplogsgrpc"
+	"github.com/agoda-com/opentelemetry-logs-go/exporters/otlp/otlplogs/otlplogshttp"
+	"github.com/kwaisu/sense-agent/pkg/exporter/otlp"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/grpc/credentials"
+)
+
+// newClient creates the OTLP client described by config, logs are sent over HTTP unless another protocol is chosen.
+// Neither client waits for the collector, gRPC connections are established and re-established in the background.
+func newClient(config otlp.Config) (otlplogs.Client, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Local() {
+		w, err := otlp.NewJSONWriter(config)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonClient{writer: w}, nil
+	}
+	if config.Protocol == otlp.ProtocolGRPC {
+		opts := []otlplogsgrpc.Option{otlplogsgrpc.WithEndpoint(config.Endpoint)}
+		if config.Insecure {
+			opts = append(opts, otlplogsgrpc.WithInsecure())
+		} else {
+			tlsConfig, err := config.TLS.ClientConfig()
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, otlplogsgrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+		}
+		if len(config.Headers) > 0 {
+			opts = append(opts, otlplogsgrpc.WithHeaders(config.Headers))
+		}
+		if config.Gzip() {
+			opts = append(opts, otlplogsgrpc.WithCompressor(otlp.CompressionGzip))
+		}
+		if config.Timeout > 0 {
+			opts = append(opts, otlplogsgrpc.WithTimeout(config.Timeout))
+		}
+		if config.ReconnectionPeriod > 0 {
+			opts = append(opts, otlplogsgrpc.WithReconnectionPeriod(config.ReconnectionPeriod))
+		}
+		return otlplogsgrpc.NewClient(opts...), nil
+	}
+	opts := []otlplogshttp.Option{otlplogshttp.WithEndpoint(config.Endpoint), otlplogshttp.WithProtobufProtocol()}
+	if config.Insecure {
+		opts = append(opts, otlplogshttp.WithInsecure())
+	} else {
+		tlsConfig, err := config.TLS.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, otlplogshttp.WithTLSClientConfig(tlsConfig))
+	}
+	if config.URLPath != "" {
+		opts = append(opts, otlplogshttp.WithURLPath(config.URLPath))
+	}
+	if len(config.Headers) > 0 {
+		opts = append(opts, otlplogshttp.WithHeaders(config.Headers))
+	}
+	if config.Gzip() {
+		opts = append(opts, otlplogshttp.WithCompression(otlplogshttp.GzipCompression))
+	}
+	if config.Timeout > 0 {
+		opts = append(opts, otlplogshttp.WithTimeout(config.Timeout))
+	}
+	return otlplogshttp.NewClient(opts...), nil
+}
+
+// jsonClient writes the logs as JSON lines to stdout or a local file, for debugging.
+type jsonClient struct {
+	writer *otlp.JSONWriter
+}
+
+func (c *jsonClient) Start(ctx context.Context) error {
+	return nil
+}
+
+func (c *jsonClient) Stop(ctx context.Context) error {
+	return c.writer.Close()
+}
+
+func (c *jsonClient) UploadLogs(ctx context.Context, protoLogs []*logspb.ResourceLogs) error {
+	return c.writer.Write(&logspb.LogsData{ResourceLogs: protoLogs})
+}
@@ -0,0 +1,60 @@
+package log
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kwaisu/sense-agent/pkg/exporter/otlp"
+	"github.com/kwaisu/sense-agent/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+var testResource = resource.NewWithAttributes(semconv.SchemaURL,
+	semconv.ServiceName("sense-agent"), semconv.ServiceVersion("1.0"), semconv.HostName("node"), semconv.HostID("machine"))
+
+func TestOtlpHTTPExporter(t *testing.T) {
+	requests := make(chan *collogspb.ExportLogsServiceRequest, 1)
+	var fail atomic.Bool
+	fail.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		assert.Equal(t, "/v1/logs", r.URL.Path)
+		assert.Equal(t, "secret", r.Header.Get("X-Token"))
+		data, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		req := &collogspb.ExportLogsServiceRequest{}
+		assert.NoError(t, proto.Unmarshal(data, req))
+		requests <- req
+	}))
+	defer server.Close()
+
+	exporter, err := NewExporter(testResource, otlp.Config{
+		Endpoint: strings.TrimPrefix(server.URL, "http://"),
+		Insecure: true,
+		Headers:  map[string]string{"X-Token": "secret"},
+		Timeout:  time.Second,
+	})
+	assert.NoError(t, err)
+	batch := []log.Message{{Content: "started", Level: "INFO", Timestamp: time.Now()}}
+	assert.Error(t, exporter.Export()(batch))
+	fail.Store(false)
+	assert.NoError(t, exporter.Export()(batch))
+	req := <-requests
+	assert.Equal(t, "started", req.ResourceLogs[0].ScopeLogs[0].LogRecords[0].Body.GetStringValue())
+	assert.Len(t, req.ResourceLogs[0].Resource.Attributes, 4)
+
+	_, err = NewExporter(testResource, otlp.Config{})
+	assert.Error(t, err)
+}
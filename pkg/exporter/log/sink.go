@@ -0,0 +1,101 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/kwaisu/sense-agent/pkg/log"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultSinkMaxRetries = 3
+	defaultSinkMinBackoff = 500 * time.Millisecond
+	defaultSinkMaxBackoff = 10 * time.Second
+	defaultSinkTimeout    = 30 * time.Second
+)
+
+// RetryConfig controls how a sink retries a failed request.
+type RetryConfig struct {
+	// MaxRetries is the number of retries after the first attempt.
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the exponential delay between the attempts.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func (c RetryConfig) withDefaults() RetryConfig {
+	if c.MaxRetries <= 0 {
+		c.MaxRetries = defaultSinkMaxRetries
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = defaultSinkMinBackoff
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = defaultSinkMaxBackoff
+	}
+	return c
+}
+
+// permanentError is returned by a request that would fail again when retried.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// do calls send until it succeeds, returns a permanent error or the retries are exhausted.
+func (c RetryConfig) do(name string, send func() error) error {
+	backoff := c.MinBackoff
+	for attempt := 0; ; attempt++ {
+		err := send()
+		var permanent permanentError
+		if err == nil || errors.As(err, &permanent) || attempt >= c.MaxRetries {
+			return err
+		}
+		klog.Warningf("%s request failed, retrying in %s: %s", name, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > c.MaxBackoff {
+			backoff = c.MaxBackoff
+		}
+	}
+}
+
+// checkResponse turns an unsuccessful response into an error, client errors other than
+// throttling are permanent as retrying the same request won't help.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err := fmt.Errorf("%s %s", resp.Status, body)
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err: err}
+	}
+	return err
+}
+
+// messageDocument is the JSON representation of a message shared by the sinks.
+func messageDocument(msg log.Message) map[string]interface{} {
+	doc := map[string]interface{}{
+		"@timestamp": msg.Timestamp.UTC().Format(time.RFC3339Nano),
+		"message":    msg.Content,
+		"level":      msg.Level,
+	}
+	if len(msg.Fields) > 0 {
+		doc["fields"] = msg.Fields
+	}
+	if len(msg.Meta) > 0 {
+		doc["meta"] = msg.Meta
+	}
+	return doc
+}
@@ -0,0 +1,132 @@
+package log
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kwaisu/sense-agent/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+var testRetry = RetryConfig{MaxRetries: 2, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+func testMessages() []log.Message {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	return []log.Message{
+		{Content: "started", Level: "INFO", Timestamp: ts, Meta: map[string]string{log.MetaContainerId: "c1"}},
+		{Content: "failed", Level: "ERROR", Timestamp: ts, Meta: map[string]string{log.MetaContainerId: "c1"}},
+		{Content: "ready", Level: "INFO", Timestamp: ts.Add(time.Second), Meta: map[string]string{"_SYSTEMD_UNIT": "kubelet.service"}},
+	}
+}
+
+func TestLokiExporter(t *testing.T) {
+	var attempts atomic.Int32
+	pushed := make(chan map[string][]lokiStream, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, lokiPushPath, r.URL.Path)
+		assert.Equal(t, "tenant", r.Header.Get("X-Scope-OrgID"))
+		var body map[string][]lokiStream
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		pushed <- body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	e, err := NewLokiExporter(LokiConfig{URL: server.URL, TenantID: "tenant", Labels: map[string]string{"cluster": "dev"}, Retry: testRetry})
+	assert.NoError(t, err)
+	assert.NoError(t, e.Export()(testMessages()))
+	streams := (<-pushed)["streams"]
+	assert.Len(t, streams, 3)
+	assert.Equal(t, map[string]string{"cluster": "dev", "container_id": "c1", "level": "INFO"}, streams[0].Stream)
+	assert.Equal(t, [][2]string{{"1704164645000000000", "started"}}, streams[0].Values)
+	assert.Equal(t, map[string]string{"cluster": "dev", "unit": "kubelet.service", "level": "INFO"}, streams[2].Stream)
+
+	// client errors aren't retried
+	attempts.Store(0)
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+	e, err = NewLokiExporter(LokiConfig{URL: rejecting.URL, Retry: testRetry})
+	assert.NoError(t, err)
+	assert.Error(t, e.Export()(testMessages()))
+	assert.Equal(t, int32(1), attempts.Load())
+}
+
+func TestElasticsearchExporter(t *testing.T) {
+	var requests [][]map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_bulk", r.URL.Path)
+		var lines []map[string]interface{}
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var line map[string]interface{}
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+			lines = append(lines, line)
+		}
+		requests = append(requests, lines)
+		if len(requests) == 1 {
+			// the first document is throttled and the second one is invalid
+			fmt.Fprint(w, `{"errors":true,"items":[{"create":{"status":429}},{"create":{"status":400,"error":{"type":"mapper_parsing_exception"}}}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"errors":false,"items":[]}`)
+	}))
+	defer server.Close()
+
+	e, err := NewElasticsearchExporter(ElasticsearchConfig{URL: server.URL, BulkSize: 2, Retry: testRetry})
+	assert.NoError(t, err)
+	assert.NoError(t, e.Export()(testMessages()))
+	assert.Len(t, requests, 3)
+	assert.Len(t, requests[0], 4)
+	assert.Equal(t, map[string]interface{}{"create": map[string]interface{}{"_index": "sense-agent-logs-2024.01.02"}}, requests[0][0])
+	assert.Equal(t, "started", requests[0][1]["message"])
+	// only the throttled document is retried
+	assert.Len(t, requests[1], 2)
+	assert.Equal(t, "started", requests[1][1]["message"])
+	assert.Equal(t, "ready", requests[2][1]["message"])
+}
+
+type kafkaStub struct {
+	failures int
+	records  []KafkaRecord
+}
+
+func (k *kafkaStub) Produce(ctx context.Context, records []KafkaRecord) error {
+	if k.failures > 0 {
+		k.failures--
+		return fmt.Errorf("leader not available")
+	}
+	k.records = append(k.records, records...)
+	return nil
+}
+
+func TestKafkaExporter(t *testing.T) {
+	producer := &kafkaStub{failures: 1}
+	e, err := NewKafkaExporter(KafkaConfig{Topic: "logs", Producer: producer, Retry: testRetry})
+	assert.NoError(t, err)
+	assert.NoError(t, e.Export()(testMessages()))
+	assert.Len(t, producer.records, 3)
+	assert.Equal(t, "logs", producer.records[0].Topic)
+	assert.Equal(t, "c1", string(producer.records[1].Key))
+	assert.Equal(t, "kubelet.service", string(producer.records[2].Key))
+	var doc map[string]interface{}
+	assert.NoError(t, json.Unmarshal(producer.records[1].Value, &doc))
+	assert.Equal(t, "failed", doc["message"])
+	assert.Equal(t, "ERROR", doc["level"])
+
+	_, err = NewKafkaExporter(KafkaConfig{Topic: "logs"})
+	assert.Error(t, err)
+}
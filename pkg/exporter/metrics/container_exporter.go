@@ -2,8 +2,10 @@ package metrics
 
 import (
 	"encoding/json"
+	"strconv"
 
 	"github.com/kwaisu/sense-agent/pkg/container"
+	"github.com/kwaisu/sense-agent/pkg/ebpftracer/l7"
 	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/klog/v2"
 )
@@ -35,5 +37,20 @@ func (c *ContainerExporter) Collect(ch chan<- prometheus.Metric) {
 		dls := []string{c.container.Metadata.Image, c.container.Metadata.Name, labels, annotations}
 		ch <- NewMetrics(metrics.ContainerInfo, 1, dls...)
 	}
+	for k, s := range c.container.ServerStats() {
+		protocol, port := k.Protocol.String(), strconv.Itoa(int(k.Port))
+		for status, count := range s.Requests {
+			value := status.String()
+			if k.Protocol == l7.ProtocolHTTP {
+				value = status.Http()
+			}
+			ch <- NewCounter(metrics.L7ServerRequests, float64(count), protocol, port, value)
+		}
+		buckets := make(map[float64]uint64, len(s.LatencyBuckets))
+		for i, b := range container.L7LatencyBuckets {
+			buckets[b] = s.LatencyBuckets[i]
+		}
+		ch <- prometheus.MustNewConstHistogram(metrics.L7ServerLatency, s.LatencyCount, s.LatencySum, buckets, protocol, port)
+	}
 
 }
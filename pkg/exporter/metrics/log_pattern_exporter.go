@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type logPatternKey struct {
+	source string
+	level  string
+	hash   string
+}
+
+// LogPatternSample is the first line of a pattern. The samples hold raw log content,
+// so they are only available through Samples and aren't exported as labels.
+type LogPatternSample struct {
+	Source string
+	Hash   string
+	Sample string
+}
+
+// LogPatternExporter counts log messages by source, level and pattern.
+type LogPatternExporter struct {
+	lock     sync.Mutex
+	counters map[logPatternKey]float64
+	samples  map[string]LogPatternSample // pattern hash -> sample
+}
+
+func NewLogPatternExporter() *LogPatternExporter {
+	return &LogPatternExporter{
+		counters: map[logPatternKey]float64{},
+		samples:  map[string]LogPatternSample{},
+	}
+}
+
+func (e *LogPatternExporter) Observe(source, level, hash, sample string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.counters[logPatternKey{source: source, level: level, hash: hash}]++
+	if _, ok := e.samples[hash]; !ok {
+		e.samples[hash] = LogPatternSample{Source: source, Hash: hash, Sample: sample}
+	}
+}
+
+// Forget removes the counters and the samples of a source that went away.
+func (e *LogPatternExporter) Forget(source string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for k := range e.counters {
+		if k.source == source {
+			delete(e.counters, k)
+		}
+	}
+	for hash, s := range e.samples {
+		if s.Source == source {
+			delete(e.samples, hash)
+		}
+	}
+}
+
+// Samples returns the sample of every pattern sorted by source and hash, for debugging.
+func (e *LogPatternExporter) Samples() []LogPatternSample {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	res := make([]LogPatternSample, 0, len(e.samples))
+	for _, s := range e.samples {
+		res = append(res, s)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Source != res[j].Source {
+			return res[i].Source < res[j].Source
+		}
+		return res[i].Hash < res[j].Hash
+	})
+	return res
+}
+
+func (e *LogPatternExporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metrics.LogMessages
+}
+
+func (e *LogPatternExporter) Collect(ch chan<- prometheus.Metric) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for k, v := range e.counters {
+		ch <- NewCounter(metrics.LogMessages, v, k.source, k.level, k.hash)
+	}
+}
@@ -0,0 +1,24 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogPatternExporter(t *testing.T) {
+	e := NewLogPatternExporter()
+	e.Observe("app", "error", "h1", "token=secret \xff")
+	e.Observe("app", "error", "h1", "token=other")
+	e.Observe("db", "info", "h2", "ready")
+	assert.Equal(t, 2, testutil.CollectAndCount(e))
+	assert.Equal(t, []LogPatternSample{
+		{Source: "app", Hash: "h1", Sample: "token=secret \xff"},
+		{Source: "db", Hash: "h2", Sample: "ready"},
+	}, e.Samples())
+
+	e.Forget("app")
+	assert.Equal(t, 1, testutil.CollectAndCount(e))
+	assert.Equal(t, []LogPatternSample{{Source: "db", Hash: "h2", Sample: "ready"}}, e.Samples())
+}
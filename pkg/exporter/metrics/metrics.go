@@ -3,11 +3,27 @@ package metrics
 import "github.com/prometheus/client_golang/prometheus"
 
 type ContianerMetrics struct {
-	ContainerInfo *prometheus.Desc
+	ContainerInfo    *prometheus.Desc
+	LogMessages      *prometheus.Desc
+	L7ServerRequests *prometheus.Desc
+	L7ServerLatency  *prometheus.Desc
+
+	EBPFEventsReceived    *prometheus.Desc
+	EBPFEventsLost        *prometheus.Desc
+	EBPFEventDecodeErrors *prometheus.Desc
+	EBPFEventsDropped     *prometheus.Desc
 }
 
 var metrics = &ContianerMetrics{
-	ContainerInfo: metricDesc("container_info", "Meta information about the container", "image", "name", "labels", "annotations"),
+	ContainerInfo:    metricDesc("container_info", "Meta information about the container", "image", "name", "labels", "annotations"),
+	LogMessages:      metricDesc("container_log_messages_total", "Number of messages grouped by the automatically extracted repeated pattern", "source", "level", "pattern_hash"),
+	L7ServerRequests: metricDesc("container_l7_server_requests_total", "Number of requests served by the container on a listening port", "protocol", "port", "status"),
+	L7ServerLatency:  metricDesc("container_l7_server_requests_duration_seconds", "Latency of the requests served by the container as measured by the container", "protocol", "port"),
+
+	EBPFEventsReceived:    metricDesc("sense_agent_ebpf_events_received_total", "Number of events read from the eBPF map", "map"),
+	EBPFEventsLost:        metricDesc("sense_agent_ebpf_events_lost_total", "Number of events lost by the kernel because the eBPF map buffer was full", "map"),
+	EBPFEventDecodeErrors: metricDesc("sense_agent_ebpf_event_decode_errors_total", "Number of events read from the eBPF map that failed to decode", "map"),
+	EBPFEventsDropped:     metricDesc("sense_agent_ebpf_events_dropped_total", "Number of decoded events that weren't delivered to a subscriber", "map"),
 }
 
 func metricDesc(name, help string, labels ...string) *prometheus.Desc {
@@ -17,3 +33,7 @@ func metricDesc(name, help string, labels ...string) *prometheus.Desc {
 func NewMetrics(desc *prometheus.Desc, value float64, labelValues ...string) prometheus.Metric {
 	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labelValues...)
 }
+
+func NewCounter(desc *prometheus.Desc, value float64, labelValues ...string) prometheus.Metric {
+	return prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labelValues...)
+}
@@ -0,0 +1,295 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kwaisu/sense-agent/pkg/exporter/otlp"
+	"github.com/kwaisu/sense-agent/pkg/exporter/resource"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultOtlpPushInterval = 30 * time.Second
+	defaultMetricsURLPath   = "/v1/metrics"
+)
+
+type Temporality string
+
+const (
+	TemporalityCumulative Temporality = "cumulative"
+	TemporalityDelta      Temporality = "delta"
+)
+
+type OtlpExporterConfig struct {
+	otlp.Config
+	// Interval is how often the metrics are pushed.
+	Interval time.Duration
+	// Temporality of counters and histograms, cumulative unless delta is chosen.
+	Temporality Temporality
+}
+
+// OtlpExporter pushes the metrics collected by a prometheus Gatherer to an OpenTelemetry collector,
+// so the metrics exposed for scraping are also available to OTel-native backends. With the "stdout"
+// and "file" protocols the metrics are written locally as JSON lines instead.
+type OtlpExporter struct {
+	gatherer prometheus.Gatherer
+	config   OtlpExporterConfig
+	resource *resourcepb.Resource
+	send     func(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error
+	close    func()
+	start    time.Time
+	// the previous cumulative value of every series and when it was read, used for delta temporality
+	previous     map[string]float64
+	previousTime time.Time
+	lock         sync.Mutex
+	done         chan struct{}
+	wg           sync.WaitGroup
+}
+
+// NewOtlpExporter creates an exporter of the metrics of gatherer, res is the resource of every metric, see resource.Detect.
+func NewOtlpExporter(gatherer prometheus.Gatherer, res *sdkresource.Resource, config OtlpExporterConfig) (*OtlpExporter, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	switch config.Temporality {
+	case "":
+		config.Temporality = TemporalityCumulative
+	case TemporalityCumulative, TemporalityDelta:
+	default:
+		return nil, fmt.Errorf("unknown metrics temporality %q", config.Temporality)
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultOtlpPushInterval
+	}
+	now := time.Now()
+	e := &OtlpExporter{
+		gatherer:     gatherer,
+		config:       config,
+		resource:     resource.Proto(res),
+		start:        now,
+		previous:     map[string]float64{},
+		previousTime: now,
+		done:         make(chan struct{}),
+	}
+	switch {
+	case config.Local():
+		w, err := otlp.NewJSONWriter(config.Config)
+		if err != nil {
+			return nil, err
+		}
+		e.send = func(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+			return w.Write(&metricspb.MetricsData{ResourceMetrics: req.ResourceMetrics})
+		}
+		e.close = func() { w.Close() }
+	case config.Protocol == otlp.ProtocolHTTP:
+		sender, err := otlp.NewHTTPSender(config.Config, defaultMetricsURLPath)
+		if err != nil {
+			return nil, err
+		}
+		e.send = func(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+			return sender.Send(ctx, req)
+		}
+		e.close = sender.Close
+	default:
+		conn, err := otlp.Dial(config.Config)
+		if err != nil {
+			return nil, err
+		}
+		client := colmetricspb.NewMetricsServiceClient(conn)
+		e.send = func(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+			_, err := client.Export(ctx, req, grpc.WaitForReady(true))
+			return err
+		}
+		e.close = func() { conn.Close() }
+	}
+	return e, nil
+}
+
+// Start pushes the metrics every interval until Stop is called.
+func (e *OtlpExporter) Start() {
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ticker := time.NewTicker(e.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.done:
+				return
+			case <-ticker.C:
+				if err := e.Push(); err != nil {
+					klog.Errorf("failed to push metrics: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+func (e *OtlpExporter) Stop() {
+	close(e.done)
+	e.wg.Wait()
+	e.close()
+}
+
+// Push gathers the metrics and sends them once.
+func (e *OtlpExporter) Push() error {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+	e.lock.Lock()
+	req := e.request(families, time.Now())
+	e.lock.Unlock()
+	ctx, cancel := e.config.Context(context.Background())
+	defer cancel()
+	return e.send(ctx, req)
+}
+
+func (e *OtlpExporter) request(families []*dto.MetricFamily, now time.Time) *colmetricspb.ExportMetricsServiceRequest {
+	start := e.start
+	temporality := metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+	if e.config.Temporality == TemporalityDelta {
+		start = e.previousTime
+		e.previousTime = now
+		temporality = metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+	}
+	startNano, nowNano := uint64(start.UnixNano()), uint64(now.UnixNano())
+	var res []*metricspb.Metric
+	for _, f := range families {
+		m := &metricspb.Metric{Name: f.GetName(), Description: f.GetHelp()}
+		switch f.GetType() {
+		case dto.MetricType_COUNTER:
+			sum := &metricspb.Sum{IsMonotonic: true, AggregationTemporality: temporality}
+			for _, pm := range f.Metric {
+				value := e.delta(seriesKey(f.GetName(), pm.Label), pm.GetCounter().GetValue())
+				sum.DataPoints = append(sum.DataPoints, numberDataPoint(pm, value, startNano, nowNano))
+			}
+			m.Data = &metricspb.Metric_Sum{Sum: sum}
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			gauge := &metricspb.Gauge{}
+			for _, pm := range f.Metric {
+				value := pm.GetGauge().GetValue()
+				if f.GetType() == dto.MetricType_UNTYPED {
+					value = pm.GetUntyped().GetValue()
+				}
+				gauge.DataPoints = append(gauge.DataPoints, numberDataPoint(pm, value, 0, nowNano))
+			}
+			m.Data = &metricspb.Metric_Gauge{Gauge: gauge}
+		case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+			histogram := &metricspb.Histogram{AggregationTemporality: temporality}
+			for _, pm := range f.Metric {
+				histogram.DataPoints = append(histogram.DataPoints, e.histogramDataPoint(f.GetName(), pm, startNano, nowNano))
+			}
+			m.Data = &metricspb.Metric_Histogram{Histogram: histogram}
+		case dto.MetricType_SUMMARY:
+			// OTLP summaries are always cumulative
+			summary := &metricspb.Summary{}
+			for _, pm := range f.Metric {
+				s := pm.GetSummary()
+				dp := &metricspb.SummaryDataPoint{
+					Attributes:        attributes(pm.Label),
+					StartTimeUnixNano: uint64(e.start.UnixNano()),
+					TimeUnixNano:      nowNano,
+					Count:             s.GetSampleCount(),
+					Sum:               s.GetSampleSum(),
+				}
+				for _, q := range s.Quantile {
+					dp.QuantileValues = append(dp.QuantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{Quantile: q.GetQuantile(), Value: q.GetValue()})
+				}
+				summary.DataPoints = append(summary.DataPoints, dp)
+			}
+			m.Data = &metricspb.Metric_Summary{Summary: summary}
+		default:
+			continue
+		}
+		res = append(res, m)
+	}
+	return &colmetricspb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		Resource:     e.resource,
+		ScopeMetrics: []*metricspb.ScopeMetrics{{Scope: &commonpb.InstrumentationScope{Name: "sense-agent"}, Metrics: res}},
+	}}}
+}
+
+func (e *OtlpExporter) histogramDataPoint(name string, pm *dto.Metric, start, now uint64) *metricspb.HistogramDataPoint {
+	h := pm.GetHistogram()
+	key := seriesKey(name, pm.Label)
+	dp := &metricspb.HistogramDataPoint{
+		Attributes:        attributes(pm.Label),
+		StartTimeUnixNano: start,
+		TimeUnixNano:      now,
+		Count:             uint64(e.delta(key+"_count", float64(h.GetSampleCount()))),
+	}
+	sum := e.delta(key+"_sum", h.GetSampleSum())
+	dp.Sum = &sum
+	// prometheus buckets are cumulative, OTLP buckets count the observations of their own range
+	var previous float64
+	for _, b := range h.Bucket {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			continue
+		}
+		count := e.delta(fmt.Sprintf("%s_bucket_%g", key, b.GetUpperBound()), float64(b.GetCumulativeCount()))
+		dp.ExplicitBounds = append(dp.ExplicitBounds, b.GetUpperBound())
+		dp.BucketCounts = append(dp.BucketCounts, uint64(count-previous))
+		previous = count
+	}
+	dp.BucketCounts = append(dp.BucketCounts, dp.Count-uint64(previous))
+	return dp
+}
+
+// delta returns the change of a cumulative series since the previous push when the temporality
+// is delta, the value itself otherwise. A value lower than the previous one means the series was reset.
+func (e *OtlpExporter) delta(key string, value float64) float64 {
+	if e.config.Temporality != TemporalityDelta {
+		return value
+	}
+	previous, ok := e.previous[key]
+	e.previous[key] = value
+	if !ok || value < previous {
+		return value
+	}
+	return value - previous
+}
+
+func numberDataPoint(pm *dto.Metric, value float64, start, now uint64) *metricspb.NumberDataPoint {
+	return &metricspb.NumberDataPoint{
+		Attributes:        attributes(pm.Label),
+		StartTimeUnixNano: start,
+		TimeUnixNano:      now,
+		Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+	}
+}
+
+func attributes(labels []*dto.LabelPair) []*commonpb.KeyValue {
+	res := make([]*commonpb.KeyValue, 0, len(labels))
+	for _, l := range labels {
+		res = append(res, stringKeyValue(l.GetName(), l.GetValue()))
+	}
+	return res
+}
+
+func stringKeyValue(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func seriesKey(name string, labels []*dto.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, l.GetName()+"="+l.GetValue())
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
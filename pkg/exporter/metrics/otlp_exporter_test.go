@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kwaisu/sense-agent/pkg/exporter/otlp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOtlpExporter(t *testing.T) {
+	requests := make(chan *colmetricspb.ExportMetricsServiceRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, defaultMetricsURLPath, r.URL.Path)
+		data, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		req := &colmetricspb.ExportMetricsServiceRequest{}
+		assert.NoError(t, proto.Unmarshal(data, req))
+		requests <- req
+	}))
+	defer server.Close()
+
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("sense-agent"), semconv.ServiceVersion("1.0"), semconv.HostName("node"), semconv.HostID("machine"))
+	registry := prometheus.NewRegistry()
+	requestsTotal := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "Requests"}, []string{"method"})
+	latency := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency_seconds", Help: "Latency", Buckets: []float64{0.1, 1}})
+	registry.MustRegister(requestsTotal, latency)
+
+	e, err := NewOtlpExporter(registry, res, OtlpExporterConfig{
+		Config:      otlp.Config{Endpoint: strings.TrimPrefix(server.URL, "http://"), Protocol: otlp.ProtocolHTTP, Insecure: true},
+		Temporality: TemporalityDelta,
+	})
+	assert.NoError(t, err)
+	defer e.Stop()
+
+	push := func() map[string]*metricspb.Metric {
+		assert.NoError(t, e.Push())
+		req := <-requests
+		rm := req.ResourceMetrics[0]
+		attrs := map[string]string{}
+		for _, kv := range rm.Resource.Attributes {
+			attrs[kv.Key] = kv.Value.GetStringValue()
+		}
+		assert.Equal(t, map[string]string{"service.name": "sense-agent", "service.version": "1.0", "host.name": "node", "host.id": "machine"}, attrs)
+		res := map[string]*metricspb.Metric{}
+		for _, m := range rm.ScopeMetrics[0].Metrics {
+			res[m.Name] = m
+		}
+		return res
+	}
+
+	requestsTotal.WithLabelValues("GET").Add(3)
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+	metrics := push()
+	sum := metrics["requests_total"].GetSum()
+	assert.Equal(t, metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA, sum.AggregationTemporality)
+	assert.Equal(t, 3.0, sum.DataPoints[0].GetAsDouble())
+	assert.Equal(t, "method", sum.DataPoints[0].Attributes[0].Key)
+	h := metrics["latency_seconds"].GetHistogram().DataPoints[0]
+	assert.Equal(t, []float64{0.1, 1}, h.ExplicitBounds)
+	assert.Equal(t, []uint64{1, 1, 1}, h.BucketCounts)
+	assert.Equal(t, uint64(3), h.Count)
+
+	requestsTotal.WithLabelValues("GET").Add(2)
+	latency.Observe(0.5)
+	metrics = push()
+	assert.Equal(t, 2.0, metrics["requests_total"].GetSum().DataPoints[0].GetAsDouble())
+	h = metrics["latency_seconds"].GetHistogram().DataPoints[0]
+	assert.Equal(t, []uint64{0, 1, 0}, h.BucketCounts)
+	assert.Equal(t, uint64(1), h.Count)
+
+	_, err = NewOtlpExporter(registry, res, OtlpExporterConfig{
+		Config:      otlp.Config{Endpoint: "collector:4317"},
+		Temporality: "weekly",
+	})
+	assert.Error(t, err)
+}
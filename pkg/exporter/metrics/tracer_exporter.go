@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/kwaisu/sense-agent/pkg/ebpftracer"
+)
+
+// TracerExporter exports the self-metrics of the eBPF tracer.
+type TracerExporter struct {
+	tracer *ebpftracer.EBPFTracer
+}
+
+func NewTracerExporter(tracer *ebpftracer.EBPFTracer) *TracerExporter {
+	return &TracerExporter{tracer: tracer}
+}
+
+func (e *TracerExporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metrics.EBPFEventsReceived
+	ch <- metrics.EBPFEventsLost
+	ch <- metrics.EBPFEventDecodeErrors
+	ch <- metrics.EBPFEventsDropped
+}
+
+func (e *TracerExporter) Collect(ch chan<- prometheus.Metric) {
+	if e.tracer == nil {
+		return
+	}
+	for _, s := range e.tracer.Stats() {
+		ch <- NewCounter(metrics.EBPFEventsReceived, float64(s.Received), s.Map)
+		ch <- NewCounter(metrics.EBPFEventsLost, float64(s.Lost), s.Map)
+		ch <- NewCounter(metrics.EBPFEventDecodeErrors, float64(s.DecodeErrors), s.Map)
+		ch <- NewCounter(metrics.EBPFEventsDropped, float64(s.Dropped), s.Map)
+	}
+}
@@ -0,0 +1,116 @@
+package otlp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+)
+
+type Protocol string
+
+const (
+	ProtocolGRPC Protocol = "grpc"
+	ProtocolHTTP Protocol = "http"
+	// ProtocolStdout and ProtocolFile write the records as JSON lines instead of sending them, for debugging.
+	ProtocolStdout Protocol = "stdout"
+	ProtocolFile   Protocol = "file"
+
+	CompressionGzip = "gzip"
+	CompressionNone = "none"
+)
+
+// Config describes how an exporter connects to an OpenTelemetry collector.
+type Config struct {
+	// Endpoint is the host:port of the collector.
+	Endpoint string
+	// Protocol is "grpc", "http", "stdout" or "file", every exporter has its own default.
+	Protocol Protocol
+	// URLPath overrides the default path of the HTTP protocol, e.g. "/v1/logs".
+	URLPath string
+	// Insecure disables TLS.
+	Insecure bool
+	TLS      TLSConfig
+	// Headers are sent with every request, e.g. {"Authorization": "Bearer <token>"}.
+	Headers map[string]string
+	// Compression is either "gzip" or "none".
+	Compression string
+	// Timeout bounds every export request.
+	Timeout time.Duration
+	// ReconnectionPeriod is the minimum time between gRPC reconnection attempts.
+	ReconnectionPeriod time.Duration
+	// File is where the "file" protocol writes to.
+	File FileConfig
+}
+
+type TLSConfig struct {
+	// CAFile verifies the collector certificate, the system roots are used when empty.
+	CAFile string
+	// CertFile and KeyFile are the client certificate for mutual TLS.
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name the collector certificate is verified against.
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+func (c Config) Validate() error {
+	switch c.Protocol {
+	case ProtocolStdout:
+		return nil
+	case ProtocolFile:
+		if c.File.Path == "" {
+			return fmt.Errorf("OpenTelemetry file path is empty")
+		}
+		return nil
+	case "", ProtocolGRPC, ProtocolHTTP:
+		if c.Endpoint == "" {
+			return fmt.Errorf("OpenTelemetry collector endpoint is empty")
+		}
+	default:
+		return fmt.Errorf("unknown OpenTelemetry protocol %q", c.Protocol)
+	}
+	switch c.Compression {
+	case "", CompressionGzip, CompressionNone:
+	default:
+		return fmt.Errorf("unknown OpenTelemetry compression %q", c.Compression)
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("both the client certificate and key are required for mutual TLS")
+	}
+	return nil
+}
+
+// Local reports whether the records are written locally instead of being sent to a collector.
+func (c Config) Local() bool {
+	return c.Protocol == ProtocolStdout || c.Protocol == ProtocolFile
+}
+
+// Gzip reports whether payloads are compressed.
+func (c Config) Gzip() bool {
+	return c.Compression == CompressionGzip
+}
+
+// ClientConfig loads the certificates into a tls.Config.
+func (c TLSConfig) ClientConfig() (*tls.Config, error) {
+	res := &tls.Config{ServerName: c.ServerName, InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		res.RootCAs = x509.NewCertPool()
+		if !res.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		res.Certificates = []tls.Certificate{cert}
+	}
+	return res, nil
+}
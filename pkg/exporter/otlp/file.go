@@ -0,0 +1,123 @@
+package otlp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultFileMaxBytes   = 100 * 1024 * 1024
+	defaultFileMaxBackups = 3
+)
+
+type FileConfig struct {
+	Path string
+	// MaxBytes is the size the file is rotated at, the rotated files are suffixed with .1, .2, ...
+	MaxBytes int64
+	// MaxBackups is the number of rotated files kept.
+	MaxBackups int
+}
+
+// JSONWriter writes OTLP requests as JSON lines in the OTLP/JSON encoding,
+// either to stdout or to a file that is rotated once it grows too big.
+type JSONWriter struct {
+	config FileConfig
+	lock   sync.Mutex
+	out    io.Writer
+	file   *os.File
+	size   int64
+}
+
+// NewJSONWriter creates the writer of the "stdout" and "file" protocols.
+func NewJSONWriter(config Config) (*JSONWriter, error) {
+	if config.Protocol == ProtocolStdout {
+		return &JSONWriter{out: os.Stdout}, nil
+	}
+	w := &JSONWriter{config: config.File}
+	if w.config.MaxBytes <= 0 {
+		w.config.MaxBytes = defaultFileMaxBytes
+	}
+	if w.config.MaxBackups <= 0 {
+		w.config.MaxBackups = defaultFileMaxBackups
+	}
+	if err := os.MkdirAll(filepath.Dir(w.config.Path), 0755); err != nil {
+		return nil, err
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *JSONWriter) open() error {
+	f, err := os.OpenFile(w.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.out, w.size = f, f, info.Size()
+	return nil
+}
+
+func (w *JSONWriter) Write(m proto.Message) error {
+	data, err := protojson.Marshal(m)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.out == nil {
+		return fmt.Errorf("%s is closed", w.config.Path)
+	}
+	if w.file != nil && w.size > 0 && w.size+int64(len(data)) > w.config.MaxBytes {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.out.Write(data)
+	w.size += int64(n)
+	return err
+}
+
+// rotate shifts the backups by one, dropping the oldest, and starts a new file.
+func (w *JSONWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.out = nil
+	for i := w.config.MaxBackups - 1; i > 0; i-- {
+		from := fmt.Sprintf("%s.%d", w.config.Path, i)
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", w.config.Path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Rename(w.config.Path, w.config.Path+".1"); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *JSONWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.out = nil
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
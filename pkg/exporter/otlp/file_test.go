@@ -0,0 +1,45 @@
+package otlp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestJSONWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "debug", "traces.jsonl")
+	config := Config{Protocol: ProtocolFile, File: FileConfig{Path: path, MaxBytes: 70, MaxBackups: 2}}
+	assert.NoError(t, config.Validate())
+	w, err := NewJSONWriter(config)
+	assert.NoError(t, err)
+	for _, name := range []string{"first", "second", "third", "fourth"} {
+		span := &tracepb.TracesData{ResourceSpans: []*tracepb.ResourceSpans{{ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{{Name: name}}}}}}}
+		assert.NoError(t, w.Write(span))
+	}
+	assert.NoError(t, w.Close())
+
+	read := func(path string) []string {
+		data, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		var names []string
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var traces tracepb.TracesData
+			assert.NoError(t, protojson.Unmarshal([]byte(line), &traces))
+			names = append(names, traces.ResourceSpans[0].ScopeSpans[0].Spans[0].Name)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"fourth"}, read(path))
+	assert.Equal(t, []string{"third"}, read(path+".1"))
+	assert.Equal(t, []string{"second"}, read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Error(t, Config{Protocol: ProtocolFile}.Validate())
+	assert.NoError(t, Config{Protocol: ProtocolStdout}.Validate())
+}
@@ -0,0 +1,52 @@
+package otlp
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+)
+
+// Dial connects to the collector without waiting for it, the connection is re-established in the background.
+func Dial(config Config) (*grpc.ClientConn, error) {
+	opts := []grpc.DialOption{}
+	if config.Insecure {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	} else {
+		tlsConfig, err := config.TLS.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	}
+	if config.Gzip() {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)))
+	}
+	if config.ReconnectionPeriod > 0 {
+		opts = append(opts, grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.DefaultConfig,
+			MinConnectTimeout: config.ReconnectionPeriod,
+		}))
+	}
+	return grpc.Dial(config.Endpoint, opts...)
+}
+
+// Context adds the headers and the timeout of the config to a request context.
+func (c Config) Context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx := parent
+	if len(c.Headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(c.Headers))
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+const defaultTimeout = 10 * time.Second
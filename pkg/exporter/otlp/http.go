@@ -0,0 +1,82 @@
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// HTTPSender posts OTLP requests in the binary protobuf encoding.
+type HTTPSender struct {
+	config Config
+	url    string
+	client *http.Client
+}
+
+// NewHTTPSender creates a sender posting to defaultPath unless the config overrides it.
+func NewHTTPSender(config Config, defaultPath string) (*HTTPSender, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	u := url.URL{Scheme: "http", Host: config.Endpoint, Path: config.URLPath}
+	if u.Path == "" {
+		u.Path = defaultPath
+	}
+	if !config.Insecure {
+		tlsConfig, err := config.TLS.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+		u.Scheme = "https"
+	}
+	return &HTTPSender{config: config, url: u.String(), client: &http.Client{Transport: transport, Timeout: config.Timeout}}, nil
+}
+
+func (s *HTTPSender) Send(ctx context.Context, req proto.Message) error {
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if s.config.Gzip() {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	if s.config.Gzip() {
+		r.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range s.config.Headers {
+		r.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("failed to send to %s: %s %s", s.url, resp.Status, body)
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+func (s *HTTPSender) Close() {
+	s.client.CloseIdleConnections()
+}
@@ -0,0 +1,494 @@
+package queue
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultMaxBytes        = 256 * 1024 * 1024
+	defaultMaxSegmentBytes = 16 * 1024 * 1024
+	defaultMinBackoff      = time.Second
+	defaultMaxBackoff      = time.Minute
+	defaultAckRecords      = 100
+	defaultAckInterval     = time.Second
+
+	segmentSuffix = ".seg"
+	ackFile       = "ack.json"
+	// every record is prefixed with its length and the crc32 of its payload
+	recordHeaderLen = 8
+)
+
+var ErrEmpty = errors.New("disk queue is empty")
+
+type Config struct {
+	// Dir holds the segment files, it's created if missing.
+	Dir string
+	// MaxBytes caps the size of the queue, the oldest segments are dropped once it's exceeded.
+	MaxBytes int64
+	// MaxSegmentBytes is the size a segment is rotated at.
+	MaxSegmentBytes int64
+	// MinBackoff and MaxBackoff bound the exponential delay between the retries of a failed send.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// The read position is saved every AckRecords acknowledged records or AckInterval, whichever comes
+	// first, and when the queue is idle or closed. After a crash the records acknowledged since are sent again.
+	AckRecords  int
+	AckInterval time.Duration
+}
+
+// ackPosition is the next record to read, persisted so a restarted queue doesn't replay sent records.
+type ackPosition struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// DiskQueue is a write-ahead queue of records stored in segment files. Records are read in the
+// order they were appended and stay on disk until they are acknowledged, so they survive restarts.
+type DiskQueue struct {
+	config   Config
+	lock     sync.Mutex
+	segments []uint64
+	sizes    map[uint64]int64
+	size     int64
+	writer   *os.File
+	reader   *os.File
+	read     ackPosition
+	// bytes of the records not acknowledged yet
+	pending int64
+	// length of the record returned by the last Peek
+	peeked int64
+	// records acknowledged since the read position was saved
+	unsaved int
+	savedAt time.Time
+	notify  chan struct{}
+	dropped uint64
+}
+
+func Open(config Config) (*DiskQueue, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("disk queue directory is empty")
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = defaultMaxBytes
+	}
+	if config.MaxSegmentBytes <= 0 {
+		config.MaxSegmentBytes = defaultMaxSegmentBytes
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = defaultMinBackoff
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = defaultMaxBackoff
+	}
+	if config.AckRecords <= 0 {
+		config.AckRecords = defaultAckRecords
+	}
+	if config.AckInterval <= 0 {
+		config.AckInterval = defaultAckInterval
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+	q := &DiskQueue{config: config, sizes: map[uint64]int64{}, notify: make(chan struct{}, 1), savedAt: time.Now()}
+	if err := q.recover(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// recover loads the segments left by a previous run, removes the acknowledged ones
+// and truncates a record torn by a crash at the end of the last segment.
+func (q *DiskQueue) recover() error {
+	entries, err := os.ReadDir(q.config.Dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if id, ok := parseSegmentName(e.Name()); ok {
+			q.segments = append(q.segments, id)
+		}
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+	if data, err := os.ReadFile(q.ackPath()); err == nil {
+		if err := json.Unmarshal(data, &q.read); err != nil {
+			klog.Warningf("failed to decode disk queue ack file, replaying every segment: %s", err)
+			q.read = ackPosition{}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for len(q.segments) > 0 && q.segments[0] < q.read.Segment {
+		if err := os.Remove(q.segmentPath(q.segments[0])); err != nil {
+			return err
+		}
+		q.segments = q.segments[1:]
+	}
+	if len(q.segments) == 0 {
+		q.read = ackPosition{Segment: q.read.Segment + 1}
+		return q.rotate()
+	}
+	if q.segments[0] != q.read.Segment {
+		q.read = ackPosition{Segment: q.segments[0]}
+	}
+	for _, id := range q.segments {
+		size, err := validSize(q.segmentPath(id))
+		if err != nil {
+			return err
+		}
+		q.sizes[id] = size
+		q.size += size
+	}
+	if q.read.Offset > q.sizes[q.read.Segment] {
+		q.read.Offset = q.sizes[q.read.Segment]
+	}
+	q.pending = q.size - q.read.Offset
+	last := q.segments[len(q.segments)-1]
+	if err := os.Truncate(q.segmentPath(last), q.sizes[last]); err != nil {
+		return err
+	}
+	q.writer, err = os.OpenFile(q.segmentPath(last), os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// validSize returns the size of the records of a segment up to the first incomplete or corrupted one.
+func validSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var offset int64
+	for {
+		_, n, err := readRecord(f, offset, info.Size(), false)
+		if err != nil {
+			return offset, nil
+		}
+		offset += recordHeaderLen + n
+	}
+}
+
+// readRecord reads the record at offset of a segment holding size bytes,
+// the payload is only returned when withPayload is set.
+func readRecord(f *os.File, offset, size int64, withPayload bool) ([]byte, int64, error) {
+	header := make([]byte, recordHeaderLen)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+	n := int64(binary.LittleEndian.Uint32(header))
+	if offset+recordHeaderLen+n > size {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	payload := make([]byte, n)
+	if _, err := f.ReadAt(payload, offset+recordHeaderLen); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, 0, fmt.Errorf("corrupted record at offset %d of %s", offset, f.Name())
+	}
+	if !withPayload {
+		return nil, n, nil
+	}
+	return payload, n, nil
+}
+
+// Append writes a record at the end of the queue. When the queue grows beyond MaxBytes the
+// oldest segments are dropped, even if their records haven't been sent yet.
+func (q *DiskQueue) Append(record []byte) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.writer == nil {
+		return fmt.Errorf("disk queue is closed")
+	}
+	last := q.segments[len(q.segments)-1]
+	if q.sizes[last] > 0 && q.sizes[last]+recordHeaderLen+int64(len(record)) > q.config.MaxSegmentBytes {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+		last = q.segments[len(q.segments)-1]
+	}
+	buf := make([]byte, recordHeaderLen+len(record))
+	binary.LittleEndian.PutUint32(buf, uint32(len(record)))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(record))
+	copy(buf[recordHeaderLen:], record)
+	if _, err := q.writer.Write(buf); err != nil {
+		// drop whatever part of the record was written, it would corrupt the segment
+		if terr := q.writer.Truncate(q.sizes[last]); terr != nil {
+			klog.Errorf("failed to truncate disk queue segment: %s", terr)
+		}
+		return err
+	}
+	q.sizes[last] += int64(len(buf))
+	q.size += int64(len(buf))
+	q.pending += int64(len(buf))
+	for q.size > q.config.MaxBytes && len(q.segments) > 1 {
+		if err := q.dropOldest(); err != nil {
+			return err
+		}
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rotate starts a new segment, it must be called with the lock held.
+func (q *DiskQueue) rotate() error {
+	id := q.read.Segment
+	if len(q.segments) > 0 {
+		id = q.segments[len(q.segments)-1] + 1
+	}
+	f, err := os.OpenFile(q.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if q.writer != nil {
+		q.writer.Close()
+	}
+	q.writer = f
+	q.segments = append(q.segments, id)
+	q.sizes[id] = 0
+	return nil
+}
+
+func (q *DiskQueue) dropOldest() error {
+	id := q.segments[0]
+	klog.Warningf("disk queue is full, dropping segment %d", id)
+	q.dropped += uint64(q.sizes[id])
+	if err := q.removeSegment(id); err != nil {
+		return err
+	}
+	if q.read.Segment == id {
+		q.read = ackPosition{Segment: q.segments[0]}
+		q.peeked = 0
+		return q.saveAck()
+	}
+	return nil
+}
+
+// removeSegment removes the oldest segment, it must be called before the read position moves past it.
+func (q *DiskQueue) removeSegment(id uint64) error {
+	if q.read.Segment == id {
+		if q.reader != nil {
+			q.reader.Close()
+			q.reader = nil
+		}
+		q.pending -= q.sizes[id] - q.read.Offset
+	} else {
+		q.pending -= q.sizes[id]
+	}
+	q.segments = q.segments[1:]
+	q.size -= q.sizes[id]
+	delete(q.sizes, id)
+	return os.Remove(q.segmentPath(id))
+}
+
+// Peek returns the oldest record not acknowledged yet, or ErrEmpty.
+// The same record is returned until Ack is called.
+func (q *DiskQueue) Peek() ([]byte, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for {
+		if q.writer == nil {
+			return nil, fmt.Errorf("disk queue is closed")
+		}
+		if q.reader == nil {
+			f, err := os.Open(q.segmentPath(q.read.Segment))
+			if err != nil {
+				return nil, err
+			}
+			q.reader = f
+		}
+		last := q.read.Segment == q.segments[len(q.segments)-1]
+		if q.read.Offset < q.sizes[q.read.Segment] {
+			payload, n, err := readRecord(q.reader, q.read.Offset, q.sizes[q.read.Segment], true)
+			if err == nil {
+				q.peeked = recordHeaderLen + n
+				return payload, nil
+			}
+			klog.Warningf("skipping the rest of disk queue segment %d: %s", q.read.Segment, err)
+			if last {
+				if err := q.rotate(); err != nil {
+					return nil, err
+				}
+			}
+		} else if last {
+			return nil, ErrEmpty
+		}
+		// the segment has been read completely
+		if err := q.removeSegment(q.read.Segment); err != nil {
+			return nil, err
+		}
+		q.read = ackPosition{Segment: q.segments[0]}
+		if err := q.saveAck(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Ack removes the record returned by the last Peek from the queue. The read position is saved
+// in batches, see Config.AckRecords.
+func (q *DiskQueue) Ack() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.peeked == 0 {
+		return nil
+	}
+	q.read.Offset += q.peeked
+	q.pending -= q.peeked
+	q.peeked = 0
+	q.unsaved++
+	if q.unsaved < q.config.AckRecords && time.Since(q.savedAt) < q.config.AckInterval {
+		return nil
+	}
+	return q.saveAck()
+}
+
+// Flush saves the read position if records were acknowledged since it was last saved.
+func (q *DiskQueue) Flush() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.unsaved == 0 {
+		return nil
+	}
+	return q.saveAck()
+}
+
+// saveAck writes the read position, it must be called with the lock held.
+func (q *DiskQueue) saveAck() error {
+	data, err := json.Marshal(q.read)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(q.ackPath(), data); err != nil {
+		return err
+	}
+	q.unsaved = 0
+	q.savedAt = time.Now()
+	return nil
+}
+
+// Notify receives a value after records are appended.
+func (q *DiskQueue) Notify() <-chan struct{} {
+	return q.notify
+}
+
+// Size returns the bytes waiting to be sent and the bytes dropped because the queue was full.
+func (q *DiskQueue) Size() (pending int64, dropped uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.pending, q.dropped
+}
+
+// Consume passes the queued records to send in order until done is closed. A record is
+// acknowledged once send succeeds, a failed send is retried with an exponential backoff.
+func (q *DiskQueue) Consume(done <-chan struct{}, send func(record []byte) error) {
+	backoff := q.config.MinBackoff
+	for {
+		record, err := q.Peek()
+		switch {
+		case err == ErrEmpty:
+			if err := q.Flush(); err != nil {
+				klog.Errorf("failed to save the disk queue position: %s", err)
+			}
+			select {
+			case <-done:
+				return
+			case <-q.Notify():
+			}
+			continue
+		case err != nil:
+			klog.Errorf("failed to read disk queue: %s", err)
+		default:
+			if err = send(record); err == nil {
+				backoff = q.config.MinBackoff
+				if err = q.Ack(); err != nil {
+					klog.Errorf("failed to acknowledge disk queue record: %s", err)
+				}
+				continue
+			}
+			klog.Warningf("failed to send queued record, retrying in %s: %s", backoff, err)
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > q.config.MaxBackoff {
+			backoff = q.config.MaxBackoff
+		}
+	}
+}
+
+// Close saves the read position and closes the segments.
+func (q *DiskQueue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.reader != nil {
+		q.reader.Close()
+		q.reader = nil
+	}
+	if q.writer == nil {
+		return nil
+	}
+	var err error
+	if q.unsaved > 0 {
+		err = q.saveAck()
+	}
+	if cerr := q.writer.Close(); err == nil {
+		err = cerr
+	}
+	q.writer = nil
+	return err
+}
+
+func (q *DiskQueue) segmentPath(id uint64) string {
+	return filepath.Join(q.config.Dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+func (q *DiskQueue) ackPath() string {
+	return filepath.Join(q.config.Dir, ackFile)
+}
+
+func parseSegmentName(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, segmentSuffix) {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+	return id, err == nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,158 @@
+package queue
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskQueue(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(Config{Dir: dir, MaxSegmentBytes: 32})
+	assert.NoError(t, err)
+	_, err = q.Peek()
+	assert.Equal(t, ErrEmpty, err)
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, q.Append([]byte(fmt.Sprintf("record-%d", i))))
+	}
+	record, err := q.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, "record-0", string(record))
+	record, _ = q.Peek()
+	assert.Equal(t, "record-0", string(record))
+	assert.NoError(t, q.Ack())
+	record, _ = q.Peek()
+	assert.Equal(t, "record-1", string(record))
+	assert.NoError(t, q.Ack())
+	record, _ = q.Peek()
+	assert.Equal(t, "record-2", string(record))
+	assert.NoError(t, q.Close())
+
+	// a record torn by a crash is dropped, the acknowledged ones aren't replayed
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{100, 0, 0, 0, 1, 2})
+	assert.NoError(t, err)
+	f.Close()
+
+	q, err = Open(Config{Dir: dir, MaxSegmentBytes: 32})
+	assert.NoError(t, err)
+	assert.NoError(t, q.Append([]byte("record-5")))
+	var read []string
+	for {
+		record, err := q.Peek()
+		if err == ErrEmpty {
+			break
+		}
+		assert.NoError(t, err)
+		read = append(read, string(record))
+		assert.NoError(t, q.Ack())
+	}
+	assert.Equal(t, []string{"record-2", "record-3", "record-4", "record-5"}, read)
+	size, _ := q.Size()
+	assert.Equal(t, int64(0), size)
+	assert.NoError(t, q.Close())
+}
+
+func TestDiskQueueMaxBytes(t *testing.T) {
+	q, err := Open(Config{Dir: t.TempDir(), MaxSegmentBytes: 16, MaxBytes: 48})
+	assert.NoError(t, err)
+	defer q.Close()
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, q.Append([]byte(fmt.Sprintf("record-%d", i))))
+	}
+	size, dropped := q.Size()
+	assert.Equal(t, int64(48), size)
+	assert.Equal(t, uint64(48), dropped)
+	record, err := q.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, "record-3", string(record))
+}
+
+func TestDiskQueueConsume(t *testing.T) {
+	q, err := Open(Config{Dir: t.TempDir(), MinBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond})
+	assert.NoError(t, err)
+	defer q.Close()
+	done := make(chan struct{})
+	sent := make(chan string, 10)
+	failures := 3
+	go q.Consume(done, func(record []byte) error {
+		if failures > 0 {
+			failures--
+			return fmt.Errorf("collector is down")
+		}
+		sent <- string(record)
+		return nil
+	})
+	assert.NoError(t, q.Append([]byte("a")))
+	assert.NoError(t, q.Append([]byte("b")))
+	for _, expected := range []string{"a", "b"} {
+		select {
+		case record := <-sent:
+			assert.Equal(t, expected, record)
+		case <-time.After(time.Second):
+			t.Fatal("record wasn't sent")
+		}
+	}
+	close(done)
+}
+
+func TestDiskQueueAckBatches(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{Dir: dir, AckRecords: 3, AckInterval: time.Hour}
+	q, err := Open(config)
+	assert.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, q.Append([]byte(fmt.Sprintf("record-%d", i))))
+	}
+	for i := 0; i < 4; i++ {
+		_, err := q.Peek()
+		assert.NoError(t, err)
+		assert.NoError(t, q.Ack())
+	}
+
+	// a crash loses the acks since the position was saved with the third one, the fourth record is sent again
+	crashed, err := Open(config)
+	assert.NoError(t, err)
+	record, err := crashed.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, "record-3", string(record))
+	crashed.Close()
+
+	assert.NoError(t, q.Close())
+	q, err = Open(config)
+	assert.NoError(t, err)
+	defer q.Close()
+	record, err = q.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, "record-4", string(record))
+}
+
+func TestDiskQueueSizeAcrossSegments(t *testing.T) {
+	q, err := Open(Config{Dir: t.TempDir(), MaxSegmentBytes: 32})
+	assert.NoError(t, err)
+	defer q.Close()
+	// every record takes 16 bytes, a segment holds two of them
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, q.Append([]byte(fmt.Sprintf("record-%d", i))))
+	}
+	for i := 0; i < 3; i++ {
+		_, err := q.Peek()
+		assert.NoError(t, err)
+		assert.NoError(t, q.Ack())
+	}
+	pending, _ := q.Size()
+	assert.Equal(t, int64(3*16), pending)
+	for i := 0; i < 3; i++ {
+		_, err := q.Peek()
+		assert.NoError(t, err)
+		assert.NoError(t, q.Ack())
+	}
+	pending, _ = q.Size()
+	assert.Equal(t, int64(0), pending)
+}
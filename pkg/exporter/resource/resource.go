@@ -0,0 +1,172 @@
+package resource
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/kwaisu/sense-agent/pkg/system"
+	"go.opentelemetry.io/otel/attribute"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"k8s.io/klog/v2"
+)
+
+var (
+	// the host files are read through the root of pid 1, so the agent sees the host inside a container
+	machineIdPaths = []string{system.ProcRootSubpath("etc/machine-id"), system.ProcRootSubpath("var/lib/dbus/machine-id"), "/etc/machine-id"}
+	osReleasePaths = []string{system.ProcRootSubpath("etc/os-release"), "/etc/os-release"}
+	uname          = system.Uname
+	nodeNameEnvs   = []string{"NODE_NAME", "KUBERNETES_NODE_NAME"}
+)
+
+type Config struct {
+	ServiceName    string
+	ServiceVersion string
+	// ClusterName is the name of the Kubernetes cluster the node belongs to.
+	ClusterName string
+	// NodeName is the name of the Kubernetes node, read from NODE_NAME or KUBERNETES_NODE_NAME when empty.
+	NodeName string
+	// Cloud provides the metadata of the cloud instance, cloud attributes are skipped when nil.
+	Cloud CloudProvider
+}
+
+type CloudMetadata struct {
+	// Provider and Platform use the OpenTelemetry values, e.g. "aws" and "aws_ec2".
+	Provider         string
+	Platform         string
+	Region           string
+	AvailabilityZone string
+	AccountId        string
+	InstanceId       string
+	InstanceType     string
+}
+
+// CloudProvider reads the metadata of the instance the agent runs on, usually from the metadata service of the cloud.
+type CloudProvider interface {
+	Metadata(ctx context.Context) (*CloudMetadata, error)
+}
+
+// StaticCloudProvider returns fixed metadata, for providers without a metadata service and for tests.
+type StaticCloudProvider CloudMetadata
+
+func (p StaticCloudProvider) Metadata(ctx context.Context) (*CloudMetadata, error) {
+	m := CloudMetadata(p)
+	return &m, nil
+}
+
+// Detect builds the resource shared by every exported signal: the service, the host, the OS,
+// the Kubernetes node and the cloud instance. Attributes that can't be detected are left out.
+func Detect(ctx context.Context, config Config) *sdkresource.Resource {
+	attrs := []attribute.KeyValue{
+		semconv.ServiceName(config.ServiceName),
+		semconv.ServiceVersion(config.ServiceVersion),
+		semconv.OSTypeKey.String(runtime.GOOS),
+		semconv.HostArchKey.String(runtime.GOARCH),
+	}
+	if id := machineId(); id != "" {
+		attrs = append(attrs, semconv.HostID(id))
+	}
+	hostname, kernelVersion, err := uname()
+	if err != nil {
+		klog.Warningf("failed to read the host uname, using the agent's: %s", err)
+		hostname, _ = os.Hostname()
+		if data, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+			kernelVersion = strings.TrimSpace(string(data))
+		}
+	}
+	if hostname != "" {
+		attrs = append(attrs, semconv.HostName(hostname))
+	}
+	if kernelVersion != "" {
+		attrs = append(attrs, semconv.OSVersion(kernelVersion))
+	}
+	if name := osName(); name != "" {
+		attrs = append(attrs, semconv.OSDescription(name))
+	}
+	nodeName := config.NodeName
+	for _, env := range nodeNameEnvs {
+		if nodeName != "" {
+			break
+		}
+		nodeName = os.Getenv(env)
+	}
+	if nodeName != "" {
+		attrs = append(attrs, semconv.K8SNodeName(nodeName))
+	}
+	if config.ClusterName != "" {
+		attrs = append(attrs, semconv.K8SClusterName(config.ClusterName))
+	}
+	if config.Cloud != nil {
+		if m, err := config.Cloud.Metadata(ctx); err != nil {
+			klog.Warningf("failed to read the cloud metadata: %s", err)
+		} else {
+			attrs = append(attrs, cloudAttributes(m)...)
+		}
+	}
+	return sdkresource.NewWithAttributes(semconv.SchemaURL, attrs...)
+}
+
+func cloudAttributes(m *CloudMetadata) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	add := func(attr func(string) attribute.KeyValue, value string) {
+		if value != "" {
+			attrs = append(attrs, attr(value))
+		}
+	}
+	add(semconv.CloudProviderKey.String, m.Provider)
+	add(semconv.CloudPlatformKey.String, m.Platform)
+	add(semconv.CloudRegion, m.Region)
+	add(semconv.CloudAvailabilityZone, m.AvailabilityZone)
+	add(semconv.CloudAccountID, m.AccountId)
+	add(semconv.HostID, m.InstanceId)
+	add(semconv.HostType, m.InstanceType)
+	return attrs
+}
+
+func machineId() string {
+	for _, path := range machineIdPaths {
+		if data, err := os.ReadFile(path); err == nil {
+			if id := strings.TrimSpace(string(data)); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// osName returns the PRETTY_NAME of os-release, e.g. "Ubuntu 22.04.3 LTS".
+func osName() string {
+	for _, path := range osReleasePaths {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if v, ok := strings.CutPrefix(scanner.Text(), "PRETTY_NAME="); ok {
+				return strings.Trim(v, `"'`)
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// Proto converts the resource to its OTLP representation.
+func Proto(res *sdkresource.Resource) *resourcepb.Resource {
+	pb := &resourcepb.Resource{}
+	for iter := res.Iter(); iter.Next(); {
+		kv := iter.Attribute()
+		pb.Attributes = append(pb.Attributes, &commonpb.KeyValue{
+			Key:   string(kv.Key),
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: kv.Value.Emit()}},
+		})
+	}
+	return pb
+}
@@ -0,0 +1,54 @@
+package resource
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestDetect(t *testing.T) {
+	dir := t.TempDir()
+	machineIdPaths = []string{filepath.Join(dir, "missing"), filepath.Join(dir, "machine-id")}
+	osReleasePaths = []string{filepath.Join(dir, "os-release")}
+	uname = func() (string, string, error) { return "node-1", "5.15.0-91-generic", nil }
+	assert.NoError(t, os.WriteFile(machineIdPaths[1], []byte("0123456789abcdef\n"), 0644))
+	assert.NoError(t, os.WriteFile(osReleasePaths[0], []byte("NAME=\"Ubuntu\"\nPRETTY_NAME=\"Ubuntu 22.04.3 LTS\"\n"), 0644))
+	t.Setenv("NODE_NAME", "worker-1")
+
+	res := Detect(context.Background(), Config{
+		ServiceName:    "sense-agent",
+		ServiceVersion: "1.0",
+		ClusterName:    "prod",
+		Cloud:          StaticCloudProvider{Provider: "aws", Region: "eu-west-1", InstanceType: "m5.large"},
+	})
+	attrs := map[string]string{}
+	for _, kv := range res.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	assert.Equal(t, "sense-agent", attrs["service.name"])
+	assert.Equal(t, "0123456789abcdef", attrs["host.id"])
+	assert.Equal(t, "node-1", attrs["host.name"])
+	assert.Equal(t, "5.15.0-91-generic", attrs["os.version"])
+	assert.Equal(t, "Ubuntu 22.04.3 LTS", attrs["os.description"])
+	assert.Equal(t, "worker-1", attrs["k8s.node.name"])
+	assert.Equal(t, "prod", attrs["k8s.cluster.name"])
+	assert.Equal(t, "aws", attrs["cloud.provider"])
+	assert.Equal(t, "eu-west-1", attrs["cloud.region"])
+	assert.Equal(t, "m5.large", attrs["host.type"])
+	_, ok := attrs["cloud.account.id"]
+	assert.False(t, ok)
+
+	pb := Proto(res)
+	assert.Len(t, pb.Attributes, len(attrs))
+
+	uname = func() (string, string, error) { return "", "", fmt.Errorf("permission denied") }
+	res = Detect(context.Background(), Config{ServiceName: "sense-agent"})
+	hostname, _ := os.Hostname()
+	v, _ := res.Set().Value(attribute.Key("host.name"))
+	assert.Equal(t, hostname, v.AsString())
+}
@@ -0,0 +1,81 @@
+package trace
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kwaisu/sense-agent/pkg/exporter/queue"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/klog/v2"
+)
+
+const uploadTimeout = 30 * time.Second
+
+// diskClient writes the spans to a disk queue and uploads them with the wrapped client in the
+// background, so spans are kept while the collector is unreachable and replayed after a restart.
+type diskClient struct {
+	client otlptrace.Client
+	config queue.Config
+	queue  *queue.DiskQueue
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+var _ otlptrace.Client = (*diskClient)(nil)
+
+func newDiskClient(client otlptrace.Client, config queue.Config) otlptrace.Client {
+	return &diskClient{client: client, config: config}
+}
+
+func (c *diskClient) Start(ctx context.Context) error {
+	q, err := queue.Open(c.config)
+	if err != nil {
+		return fmt.Errorf("failed to open the span disk buffer: %w", err)
+	}
+	if err := c.client.Start(ctx); err != nil {
+		q.Close()
+		return err
+	}
+	c.queue = q
+	c.done = make(chan struct{})
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		q.Consume(c.done, c.upload)
+	}()
+	return nil
+}
+
+func (c *diskClient) UploadTraces(ctx context.Context, protoSpans []*tracepb.ResourceSpans) error {
+	data, err := proto.Marshal(&tracepb.TracesData{ResourceSpans: protoSpans})
+	if err != nil {
+		return err
+	}
+	return c.queue.Append(data)
+}
+
+func (c *diskClient) upload(record []byte) error {
+	var traces tracepb.TracesData
+	if err := proto.Unmarshal(record, &traces); err != nil {
+		// it will never decode, skip it
+		klog.Errorf("failed to decode spans from the disk buffer: %s", err)
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+	defer cancel()
+	return c.client.UploadTraces(ctx, traces.ResourceSpans)
+}
+
+func (c *diskClient) Stop(ctx context.Context) error {
+	close(c.done)
+	c.wg.Wait()
+	err := c.client.Stop(ctx)
+	if qerr := c.queue.Close(); err == nil {
+		err = qerr
+	}
+	return err
+}
@@ -6,16 +6,16 @@ import (
 	"time"
 
 	"github.com/kwaisu/sense-agent/pkg/ebpftracer/l7"
+	"github.com/kwaisu/sense-agent/pkg/exporter/otlp"
+	"github.com/kwaisu/sense-agent/pkg/exporter/queue"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
 	oteltrace "go.opentelemetry.io/otel/trace"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 	"k8s.io/klog/v2"
 )
 
@@ -23,43 +23,48 @@ type otelExporter struct {
 	tracer oteltrace.Tracer
 }
 
-func NewExporter(machineId, hostname, version, endpoint, serviceName string) (Exporter, error) {
-	klog.Info(endpoint)
-	if endpoint == "" {
-		return nil, fmt.Errorf("OpenTelemetry logs collector endpoint is nil")
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	conn, err := grpc.DialContext(ctx, "endpoint",
-		// Note the use of insecure transport here. TLS is recommended in production.
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithBlock(),
-	)
+// NewExporter creates an OTLP span exporter, res is the resource of every span, see resource.Detect.
+// Spans are kept on disk until they are uploaded when diskBuffer is set.
+func NewExporter(res *resource.Resource, config otlp.Config, diskBuffer *queue.Config) (Exporter, error) {
+	klog.Info(config.Endpoint)
+	client, err := newClient(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create gRPC connection to collector: %w", err)
+		return nil, err
+	}
+	if diskBuffer != nil {
+		client = newDiskClient(client, *diskBuffer)
 	}
-	traceExporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn))
+	traceExporter, err := otlptrace.New(context.Background(), client)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
 	}
 	bsp := sdktrace.NewBatchSpanProcessor(traceExporter)
 	tracerProvider := sdktrace.NewTracerProvider(
 		sdktrace.WithSampler(sdktrace.AlwaysSample()),
-		sdktrace.WithResource(resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceName("sense-agent"),
-			semconv.ServiceVersion(version),
-		)),
+		sdktrace.WithResource(res),
 		sdktrace.WithSpanProcessor(bsp),
 	)
 	otel.SetTracerProvider(tracerProvider)
 	otel.SetTextMapPropagator(propagation.TraceContext{})
-	tracer := otel.Tracer("sense-agent")
-	return &otelExporter{tracer: tracer}, nil
+	return NewTracerExporter(otel.Tracer("sense-agent")), nil
 }
 
-func (t *otelExporter) createSpan(name string, duration time.Duration, error bool, attrs ...attribute.KeyValue) {
+// NewTracerExporter creates the spans with tracer, the caller sets up where they are exported.
+func NewTracerExporter(tracer oteltrace.Tracer) Exporter {
+	return &otelExporter{tracer: tracer}
+}
 
+func (t *otelExporter) createSpan(ctx context.Context, name string, kind oteltrace.SpanKind, duration time.Duration, error bool, attrs ...attribute.KeyValue) {
+	end := time.Now()
+	_, span := t.tracer.Start(ctx, name,
+		oteltrace.WithTimestamp(end.Add(-duration)),
+		oteltrace.WithSpanKind(kind),
+		oteltrace.WithAttributes(attrs...),
+	)
+	if error {
+		span.SetStatus(codes.Error, "")
+	}
+	span.End(oteltrace.WithTimestamp(end))
 }
 
 func (t *otelExporter) HttpRequest(method, path string, status l7.Status, duration time.Duration) {
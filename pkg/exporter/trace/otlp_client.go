@@ -0,0 +1,100 @@
+package trace
+
+import (
+	"context"
+
+	"github.com/kwaisu/sense-agent/pkg/exporter/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc/credentials"
+)
+
+const defaultTracesURLPath = "/v1/traces"
+
+// newClient creates the OTLP client described by config, spans are sent over gRPC unless another protocol is chosen.
+// Neither client waits for the collector, gRPC connections are established and re-established in the background.
+func newClient(config otlp.Config) (otlptrace.Client, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Local() {
+		w, err := otlp.NewJSONWriter(config)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonClient{writer: w}, nil
+	}
+	if config.Protocol == otlp.ProtocolHTTP {
+		return newHTTPClient(config)
+	}
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(config.Endpoint)}
+	if config.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	} else {
+		tlsConfig, err := config.TLS.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+	}
+	if len(config.Headers) > 0 {
+		opts = append(opts, otlptracegrpc.WithHeaders(config.Headers))
+	}
+	if config.Gzip() {
+		opts = append(opts, otlptracegrpc.WithCompressor(otlp.CompressionGzip))
+	}
+	if config.Timeout > 0 {
+		opts = append(opts, otlptracegrpc.WithTimeout(config.Timeout))
+	}
+	if config.ReconnectionPeriod > 0 {
+		opts = append(opts, otlptracegrpc.WithReconnectionPeriod(config.ReconnectionPeriod))
+	}
+	return otlptracegrpc.NewClient(opts...), nil
+}
+
+// httpClient sends spans with OTLP/HTTP.
+type httpClient struct {
+	sender *otlp.HTTPSender
+}
+
+var _ otlptrace.Client = (*httpClient)(nil)
+
+func newHTTPClient(config otlp.Config) (*httpClient, error) {
+	sender, err := otlp.NewHTTPSender(config, defaultTracesURLPath)
+	if err != nil {
+		return nil, err
+	}
+	return &httpClient{sender: sender}, nil
+}
+
+func (c *httpClient) Start(ctx context.Context) error {
+	return nil
+}
+
+func (c *httpClient) Stop(ctx context.Context) error {
+	c.sender.Close()
+	return nil
+}
+
+func (c *httpClient) UploadTraces(ctx context.Context, protoSpans []*tracepb.ResourceSpans) error {
+	return c.sender.Send(ctx, &coltracepb.ExportTraceServiceRequest{ResourceSpans: protoSpans})
+}
+
+// jsonClient writes the spans as JSON lines to stdout or a local file, for debugging.
+type jsonClient struct {
+	writer *otlp.JSONWriter
+}
+
+func (c *jsonClient) Start(ctx context.Context) error {
+	return nil
+}
+
+func (c *jsonClient) Stop(ctx context.Context) error {
+	return c.writer.Close()
+}
+
+func (c *jsonClient) UploadTraces(ctx context.Context, protoSpans []*tracepb.ResourceSpans) error {
+	return c.writer.Write(&tracepb.TracesData{ResourceSpans: protoSpans})
+}
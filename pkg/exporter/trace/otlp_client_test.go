@@ -0,0 +1,94 @@
+package trace
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kwaisu/sense-agent/pkg/exporter/otlp"
+	"github.com/stretchr/testify/assert"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+type traceReceiver struct {
+	coltracepb.UnimplementedTraceServiceServer
+	requests chan *coltracepb.ExportTraceServiceRequest
+	tokens   chan string
+}
+
+func (r *traceReceiver) Export(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	r.tokens <- strings.Join(md.Get("authorization"), ",")
+	r.requests <- req
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+func testSpans() []*tracepb.ResourceSpans {
+	return []*tracepb.ResourceSpans{{ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{{Name: "GET /"}}}}}}
+}
+
+func TestGRPCClient(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	receiver := &traceReceiver{requests: make(chan *coltracepb.ExportTraceServiceRequest, 1), tokens: make(chan string, 1)}
+	server := grpc.NewServer()
+	coltracepb.RegisterTraceServiceServer(server, receiver)
+	go server.Serve(l)
+	defer server.Stop()
+
+	client, err := newClient(otlp.Config{
+		Endpoint:    l.Addr().String(),
+		Insecure:    true,
+		Headers:     map[string]string{"Authorization": "Bearer token"},
+		Compression: otlp.CompressionGzip,
+		Timeout:     time.Second,
+	})
+	assert.NoError(t, err)
+	ctx := context.Background()
+	assert.NoError(t, client.Start(ctx))
+	assert.NoError(t, client.UploadTraces(ctx, testSpans()))
+	assert.Equal(t, "Bearer token", <-receiver.tokens)
+	assert.Equal(t, "GET /", (<-receiver.requests).ResourceSpans[0].ScopeSpans[0].Spans[0].Name)
+	assert.NoError(t, client.Stop(ctx))
+}
+
+func TestHTTPClient(t *testing.T) {
+	requests := make(chan *coltracepb.ExportTraceServiceRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, defaultTracesURLPath, r.URL.Path)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		body, err := gzip.NewReader(r.Body)
+		assert.NoError(t, err)
+		data, err := io.ReadAll(body)
+		assert.NoError(t, err)
+		req := &coltracepb.ExportTraceServiceRequest{}
+		assert.NoError(t, proto.Unmarshal(data, req))
+		requests <- req
+	}))
+	defer server.Close()
+
+	client, err := newClient(otlp.Config{
+		Endpoint:    strings.TrimPrefix(server.URL, "http://"),
+		Protocol:    otlp.ProtocolHTTP,
+		Insecure:    true,
+		Headers:     map[string]string{"Authorization": "Bearer token"},
+		Compression: otlp.CompressionGzip,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.UploadTraces(context.Background(), testSpans()))
+	assert.Equal(t, "GET /", (<-requests).ResourceSpans[0].ScopeSpans[0].Spans[0].Name)
+
+	_, err = newClient(otlp.Config{Endpoint: "collector:4318", Protocol: "udp"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,131 @@
+package trace
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/kwaisu/sense-agent/pkg/ebpftracer/l7"
+)
+
+// idle token buckets are forgotten after bucketTTL, so exited containers don't leak
+const bucketTTL = 5 * time.Minute
+
+type SamplingConfig struct {
+	// Ratio is the share of requests kept by head sampling, every request is kept when it's 0.
+	Ratio float64
+	// ProtocolRatios and ContainerRatios override Ratio, the container one wins when both match.
+	ProtocolRatios  map[l7.Protocol]float64
+	ContainerRatios map[string]float64
+	// KeepErrors keeps every failed request regardless of the ratio.
+	KeepErrors bool
+	// LatencyThresholds keeps every request of a protocol slower than the threshold regardless of the ratio.
+	LatencyThresholds map[l7.Protocol]time.Duration
+	// SpansPerSecond caps the spans of every container, kept requests included, 0 means no cap.
+	SpansPerSecond float64
+	// Burst is the number of spans allowed at once above the rate, SpansPerSecond when unset.
+	Burst int
+	// CapturePayload attaches the request payload to the sampled spans.
+	CapturePayload bool
+}
+
+// Sampler decides which L7 requests become spans before they are created.
+// Errors and slow requests bypass head sampling, then a token bucket per container caps the rate.
+type Sampler struct {
+	config  SamplingConfig
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+	random  func() float64
+	now     func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewSampler(config SamplingConfig) *Sampler {
+	if config.Burst <= 0 {
+		config.Burst = int(config.SpansPerSecond)
+		if config.Burst < 1 {
+			config.Burst = 1
+		}
+	}
+	return &Sampler{
+		config:  config,
+		buckets: map[string]*tokenBucket{},
+		random:  rand.Float64,
+		now:     time.Now,
+	}
+}
+
+// Sample reports whether a span should be created for the request. A nil Sampler keeps every request.
+func (s *Sampler) Sample(containerId string, protocol l7.Protocol, duration time.Duration, isError bool) bool {
+	if s == nil {
+		return true
+	}
+	if !s.alwaysKeep(protocol, duration, isError) {
+		if ratio := s.ratio(containerId, protocol); ratio < 1 && s.random() >= ratio {
+			return false
+		}
+	}
+	return s.allow(containerId)
+}
+
+func (s *Sampler) alwaysKeep(protocol l7.Protocol, duration time.Duration, isError bool) bool {
+	if isError && s.config.KeepErrors {
+		return true
+	}
+	threshold, ok := s.config.LatencyThresholds[protocol]
+	return ok && threshold > 0 && duration >= threshold
+}
+
+func (s *Sampler) ratio(containerId string, protocol l7.Protocol) float64 {
+	if r, ok := s.config.ContainerRatios[containerId]; ok {
+		return r
+	}
+	if r, ok := s.config.ProtocolRatios[protocol]; ok {
+		return r
+	}
+	if s.config.Ratio == 0 {
+		return 1
+	}
+	return s.config.Ratio
+}
+
+func (s *Sampler) allow(containerId string) bool {
+	if s.config.SpansPerSecond <= 0 {
+		return true
+	}
+	now := s.now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if now.Sub(s.pruned) > bucketTTL {
+		for id, b := range s.buckets {
+			if now.Sub(b.last) > bucketTTL {
+				delete(s.buckets, id)
+			}
+		}
+		s.pruned = now
+	}
+	b := s.buckets[containerId]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(s.config.Burst), last: now}
+		s.buckets[containerId] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * s.config.SpansPerSecond
+	if b.tokens > float64(s.config.Burst) {
+		b.tokens = float64(s.config.Burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (s *Sampler) capturePayload() bool {
+	return s != nil && s.config.CapturePayload
+}
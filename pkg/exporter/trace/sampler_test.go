@@ -0,0 +1,113 @@
+package trace
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kwaisu/sense-agent/pkg/ebpftracer/l7"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"inet.af/netaddr"
+)
+
+type recordingExporter struct {
+	spans    []string
+	kinds    []oteltrace.SpanKind
+	attrs    [][]attribute.KeyValue
+	contexts []context.Context
+}
+
+func (e *recordingExporter) createSpan(ctx context.Context, name string, kind oteltrace.SpanKind, duration time.Duration, error bool, attrs ...attribute.KeyValue) {
+	e.spans = append(e.spans, name)
+	e.kinds = append(e.kinds, kind)
+	e.attrs = append(e.attrs, attrs)
+	e.contexts = append(e.contexts, ctx)
+}
+
+func (e *recordingExporter) HttpRequest(method, path string, status l7.Status, duration time.Duration) {
+}
+
+func TestSampler(t *testing.T) {
+	s := NewSampler(SamplingConfig{
+		Ratio:             0.5,
+		ProtocolRatios:    map[l7.Protocol]float64{l7.ProtocolRedis: 0.01},
+		ContainerRatios:   map[string]float64{"/k8s/default/api/app": 1},
+		KeepErrors:        true,
+		LatencyThresholds: map[l7.Protocol]time.Duration{l7.ProtocolRedis: 100 * time.Millisecond},
+	})
+	s.random = func() float64 { return 0.3 }
+
+	assert.True(t, s.Sample("c1", l7.ProtocolHTTP, time.Millisecond, false))
+	assert.False(t, s.Sample("c1", l7.ProtocolRedis, time.Millisecond, false))
+	assert.True(t, s.Sample("c1", l7.ProtocolRedis, time.Millisecond, true))
+	assert.True(t, s.Sample("c1", l7.ProtocolRedis, 200*time.Millisecond, false))
+	assert.True(t, s.Sample("/k8s/default/api/app", l7.ProtocolRedis, time.Millisecond, false))
+
+	s.random = func() float64 { return 0.7 }
+	assert.False(t, s.Sample("c1", l7.ProtocolHTTP, time.Millisecond, false))
+
+	var nilSampler *Sampler
+	assert.True(t, nilSampler.Sample("c1", l7.ProtocolRedis, time.Millisecond, false))
+}
+
+func TestSamplerRateLimit(t *testing.T) {
+	s := NewSampler(SamplingConfig{SpansPerSecond: 2, KeepErrors: true})
+	now := time.Unix(1700000000, 0)
+	s.now = func() time.Time { return now }
+
+	assert.True(t, s.Sample("c1", l7.ProtocolHTTP, time.Millisecond, false))
+	assert.True(t, s.Sample("c1", l7.ProtocolHTTP, time.Millisecond, false))
+	assert.False(t, s.Sample("c1", l7.ProtocolHTTP, time.Millisecond, true))
+	// containers have their own buckets
+	assert.True(t, s.Sample("c2", l7.ProtocolHTTP, time.Millisecond, false))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, s.Sample("c1", l7.ProtocolHTTP, time.Millisecond, false))
+	assert.False(t, s.Sample("c1", l7.ProtocolHTTP, time.Millisecond, false))
+
+	now = now.Add(time.Hour)
+	assert.True(t, s.Sample("c1", l7.ProtocolHTTP, time.Millisecond, false))
+	assert.Len(t, s.buckets, 1)
+}
+
+func TestTraceL7Request(t *testing.T) {
+	e := &recordingExporter{}
+	s := NewSampler(SamplingConfig{ProtocolRatios: map[l7.Protocol]float64{l7.ProtocolRedis: 0}, CapturePayload: true})
+	p := NewTraceProvider(e, s)
+	tr := p.NewTrace("c1", netaddr.MustParseIPPort("10.0.0.1:6379"))
+
+	tr.L7Request(&l7.RequestData{Protocol: l7.ProtocolRedis, Status: l7.StatusOk, Duration: time.Millisecond})
+	assert.Empty(t, e.spans)
+
+	tr.L7Request(&l7.RequestData{Protocol: l7.ProtocolKafka, Method: l7.MethodProduce, Status: l7.StatusOk, Payload: []byte("topic")})
+	assert.Equal(t, []string{"Kafka produce"}, e.spans)
+	assert.Contains(t, e.attrs[0], payloadAttribute.String("topic"))
+}
+
+func TestTraceRemoteParent(t *testing.T) {
+	e := &recordingExporter{}
+	tr := NewTraceProvider(e, nil).NewTrace("c1", netaddr.MustParseIPPort("10.0.0.1:80"))
+	tc := &l7.TraceContext{TraceId: [16]byte{1}, SpanId: [8]byte{2}, Sampled: true}
+	tr.L7Request(&l7.RequestData{Protocol: l7.ProtocolHTTP, TraceContext: tc})
+	tr.L7Request(&l7.RequestData{Protocol: l7.ProtocolHTTP})
+
+	parent := oteltrace.SpanContextFromContext(e.contexts[0])
+	assert.True(t, parent.IsRemote())
+	assert.Equal(t, oteltrace.TraceID(tc.TraceId), parent.TraceID())
+	assert.Equal(t, oteltrace.SpanID(tc.SpanId), parent.SpanID())
+	assert.True(t, parent.IsSampled())
+	assert.False(t, oteltrace.SpanContextFromContext(e.contexts[1]).IsValid())
+}
+
+func TestServerTrace(t *testing.T) {
+	e := &recordingExporter{}
+	tr := NewTraceProvider(e, nil).NewServerTrace("c1", netaddr.MustParseIPPort("10.0.0.2:8080"), netaddr.MustParseIPPort("10.0.0.1:43210"))
+	tr.L7Request(&l7.RequestData{Protocol: l7.ProtocolHTTP, Status: 404, Payload: []byte("GET /users/1 HTTP/1.1\r\n"), Server: true})
+	assert.Equal(t, []string{"GET"}, e.spans)
+	assert.Equal(t, []oteltrace.SpanKind{oteltrace.SpanKindServer}, e.kinds)
+	assert.Contains(t, e.attrs[0], semconv.URLPath("/users/1"))
+	assert.Contains(t, e.attrs[0], semconv.NetHostPort(8080))
+}
@@ -1,18 +1,24 @@
 package trace
 
 import (
+	"context"
 	"time"
 
 	"github.com/kwaisu/sense-agent/pkg/ebpftracer/l7"
 	"go.opentelemetry.io/otel/attribute"
 	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
 	"inet.af/netaddr"
 )
 
+const payloadAttribute = attribute.Key("sense.l7.payload")
+
 type Trace struct {
 	containerId string
 	destination netaddr.IPPort
 	commonAttrs []attribute.KeyValue
+	provider    *TraceProvider
+	kind        oteltrace.SpanKind
 }
 
 // New Trace
@@ -20,18 +26,80 @@ func (t *TraceProvider) NewTrace(containerId string, destination netaddr.IPPort)
 	if t.traceExporter == nil {
 		return nil
 	}
-	return &Trace{containerId: containerId, destination: destination, commonAttrs: []attribute.KeyValue{
+	return &Trace{containerId: containerId, destination: destination, provider: t, kind: oteltrace.SpanKindClient, commonAttrs: []attribute.KeyValue{
 		semconv.ContainerID(containerId),
 		semconv.NetPeerName(destination.IP().String()),
 		semconv.NetPeerPort(int(destination.Port())),
 	}}
 }
 
+// NewServerTrace creates the trace of the requests served by a container on a connection accepted from client.
+func (t *TraceProvider) NewServerTrace(containerId string, listen, client netaddr.IPPort) *Trace {
+	if t.traceExporter == nil {
+		return nil
+	}
+	return &Trace{containerId: containerId, destination: listen, provider: t, kind: oteltrace.SpanKindServer, commonAttrs: []attribute.KeyValue{
+		semconv.ContainerID(containerId),
+		semconv.NetHostPort(int(listen.Port())),
+		semconv.NetSockPeerAddr(client.IP().String()),
+	}}
+}
+
+// L7Request creates a span for the request unless the sampler drops it.
+func (t *Trace) L7Request(r *l7.RequestData) {
+	if t == nil || r == nil {
+		return
+	}
+	failed := r.Status.Error() || (r.Protocol == l7.ProtocolHTTP && r.Status >= 500)
+	if !t.provider.sampler.Sample(t.containerId, r.Protocol, r.Duration, failed) {
+		return
+	}
+	attrs := make([]attribute.KeyValue, 0, len(t.commonAttrs)+6)
+	attrs = append(attrs, t.commonAttrs...)
+	attrs = append(attrs, attribute.String("sense.l7.protocol", r.Protocol.String()), attribute.String("sense.l7.status", r.Status.String()))
+	if t.provider.sampler.capturePayload() && len(r.Payload) > 0 {
+		attrs = append(attrs, payloadAttribute.String(string(r.Payload)))
+	}
+	name := r.Protocol.String()
+	if r.Method != l7.MethodUnknown {
+		name += " " + r.Method.String()
+	}
+	if r.Protocol == l7.ProtocolHTTP {
+		if method, path := l7.ParseHttp(r.Payload); method != "" {
+			name = method
+			attrs = append(attrs, semconv.HTTPMethod(method), semconv.URLPath(path), semconv.HTTPStatusCode(int(r.Status)))
+		}
+	}
+	t.provider.traceExporter.createSpan(remoteContext(r.TraceContext), name, t.kind, r.Duration, failed, attrs...)
+}
+
+// remoteContext makes the span a child of the span that sent the request, when the application propagated it.
+func remoteContext(tc *l7.TraceContext) context.Context {
+	ctx := context.Background()
+	if tc == nil {
+		return ctx
+	}
+	config := oteltrace.SpanContextConfig{TraceID: tc.TraceId, SpanID: tc.SpanId, Remote: true}
+	if tc.Sampled {
+		config.TraceFlags = oteltrace.FlagsSampled
+	}
+	if ts, err := oteltrace.ParseTraceState(tc.TraceState); err == nil {
+		config.TraceState = ts
+	}
+	return oteltrace.ContextWithRemoteSpanContext(ctx, oteltrace.NewSpanContext(config))
+}
+
 type Exporter interface {
-	createSpan(name string, duration time.Duration, error bool, attrs ...attribute.KeyValue)
+	createSpan(ctx context.Context, name string, kind oteltrace.SpanKind, duration time.Duration, error bool, attrs ...attribute.KeyValue)
 	HttpRequest(method, path string, status l7.Status, duration time.Duration)
 }
 
 type TraceProvider struct {
 	traceExporter Exporter
+	sampler       *Sampler
+}
+
+// NewTraceProvider creates the traces of exporter, sampler may be nil to keep every request.
+func NewTraceProvider(exporter Exporter, sampler *Sampler) *TraceProvider {
+	return &TraceProvider{traceExporter: exporter, sampler: sampler}
 }
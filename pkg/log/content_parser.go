@@ -0,0 +1,157 @@
+package log
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// prefixLevelSearchLen bounds how far into a line a level prefix is looked for,
+// so words in the message body aren't taken for the level.
+const prefixLevelSearchLen = 64
+
+var (
+	levelFieldNames = []string{"level", "severity", "lvl", "loglevel", "log.level", "levelname", "@l"}
+
+	// I0102 15:04:05.000000   12345 file.go:10] message
+	klogRe            = regexp.MustCompile(`^([IWEF])(\d{4}) (\d{2}:\d{2}:\d{2}\.\d+)\s+(\d+) ([^\]\s]+:\d+)\] `)
+	bracketedLevelRe  = regexp.MustCompile(`(?i)[\[<(](trace|debug|info|notice|warn|warning|error|err|crit|critical|fatal|panic)[\]>)]`)
+	uppercaseLevelRe  = regexp.MustCompile(`\b(TRACE|DEBUG|INFO|NOTICE|WARN|WARNING|ERROR|CRIT|CRITICAL|FATAL|PANIC)\b`)
+	klogSeverityLevel = map[string]Level{"I": LevelInfo, "W": LevelWarning, "E": LevelError, "F": LevelCritical}
+)
+
+// ParseContent detects the level and the structured fields of a message from its content.
+// JSON and logfmt lines are split into Fields, klog headers and common level prefixes such as
+// "[WARN]" only yield the level. A detected level replaces the level set by the source.
+func ParseContent(m *Message) {
+	content := strings.TrimSpace(m.Content)
+	if content == "" {
+		return
+	}
+	var fields map[string]string
+	level := LevelUnknown
+	switch {
+	case content[0] == '{':
+		fields = parseJsonFields(content)
+	case klogRe.MatchString(content):
+		match := klogRe.FindStringSubmatch(content)
+		level = klogSeverityLevel[match[1]]
+		fields = map[string]string{"thread": match[4], "source": match[5]}
+	default:
+		fields = parseLogfmtFields(content)
+	}
+	if level == LevelUnknown {
+		level = levelFromFields(fields)
+	}
+	if level == LevelUnknown {
+		level = levelFromPrefix(content)
+	}
+	for name, val := range fields {
+		m.AddFields(name, val)
+	}
+	if level != LevelUnknown {
+		m.Level = level.string()
+	}
+}
+
+func parseJsonFields(content string) map[string]string {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &obj); err != nil {
+		return nil
+	}
+	fields := make(map[string]string, len(obj))
+	for k, v := range obj {
+		switch val := v.(type) {
+		case nil:
+		case string:
+			fields[k] = val
+		case float64:
+			fields[k] = strconv.FormatFloat(val, 'f', -1, 64)
+		case bool:
+			fields[k] = strconv.FormatBool(val)
+		default:
+			if data, err := json.Marshal(val); err == nil {
+				fields[k] = string(data)
+			}
+		}
+	}
+	return fields
+}
+
+// parseLogfmtFields parses key=value pairs, values may be double quoted.
+// A line is only considered logfmt if it has at least two pairs or a level key.
+func parseLogfmtFields(content string) map[string]string {
+	fields := map[string]string{}
+	for i := 0; i < len(content); {
+		for i < len(content) && content[i] == ' ' {
+			i++
+		}
+		start := i
+		for i < len(content) && content[i] != '=' && content[i] != ' ' && content[i] != '"' {
+			i++
+		}
+		if i >= len(content) || content[i] != '=' || i == start {
+			for i < len(content) && content[i] != ' ' {
+				i++
+			}
+			continue
+		}
+		key := content[start:i]
+		i++
+		var val string
+		if i < len(content) && content[i] == '"' {
+			end := i + 1
+			for end < len(content) && content[end] != '"' {
+				if content[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(content) {
+				return nil
+			}
+			if unquoted, err := strconv.Unquote(content[i : end+1]); err == nil {
+				val = unquoted
+			} else {
+				val = content[i+1 : end]
+			}
+			i = end + 1
+		} else {
+			start = i
+			for i < len(content) && content[i] != ' ' {
+				i++
+			}
+			val = content[start:i]
+		}
+		fields[key] = val
+	}
+	if len(fields) < 2 && levelFromFields(fields) == LevelUnknown {
+		return nil
+	}
+	return fields
+}
+
+func levelFromFields(fields map[string]string) Level {
+	for _, name := range levelFieldNames {
+		if v, ok := fields[name]; ok {
+			if l := String2Level(v); l != LevelUnknown {
+				return l
+			}
+		}
+	}
+	return LevelUnknown
+}
+
+func levelFromPrefix(content string) Level {
+	if len(content) > prefixLevelSearchLen {
+		content = content[:prefixLevelSearchLen]
+	}
+	if m := bracketedLevelRe.FindStringSubmatch(content); m != nil {
+		return String2Level(m[1])
+	}
+	if m := uppercaseLevelRe.FindStringSubmatch(content); m != nil {
+		return String2Level(m[1])
+	}
+	return LevelUnknown
+}
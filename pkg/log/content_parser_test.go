@@ -0,0 +1,45 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseContent(t *testing.T) {
+	m := Message{Content: `time="2023-12-21T15:00:39.104700154+08:00" level=warning msg="API listen on /run/docker.sock"`, Level: "INFO"}
+	ParseContent(&m)
+	assert.Equal(t, "WARN", m.Level)
+	assert.Equal(t, "API listen on /run/docker.sock", m.Fields["msg"])
+	assert.Equal(t, "2023-12-21T15:00:39.104700154+08:00", m.Fields["time"])
+
+	m = Message{Content: `{"severity":"ERROR","message":"failed","code":500,"ctx":{"id":1}}`}
+	ParseContent(&m)
+	assert.Equal(t, "ERROR", m.Level)
+	assert.Equal(t, map[string]string{"severity": "ERROR", "message": "failed", "code": "500", "ctx": `{"id":1}`}, m.Fields)
+
+	m = Message{Content: `E0102 15:04:05.123456    1234 kubelet.go:2855] "Container runtime network not ready"`}
+	ParseContent(&m)
+	assert.Equal(t, "ERROR", m.Level)
+	assert.Equal(t, "kubelet.go:2855", m.Fields["source"])
+
+	m = Message{Content: `2024-01-02 10:00:00.123 [WARN] disk almost full`}
+	ParseContent(&m)
+	assert.Equal(t, "WARN", m.Level)
+	assert.Nil(t, m.Fields)
+
+	m = Message{Content: `2024/01/02 10:00:00 FATAL cannot start`}
+	ParseContent(&m)
+	assert.Equal(t, "CRITICAL", m.Level)
+
+	m = Message{Content: `user logged in, no error here`, Level: "INFO"}
+	ParseContent(&m)
+	assert.Equal(t, "INFO", m.Level)
+	assert.Nil(t, m.Fields)
+}
+
+func TestString2Level(t *testing.T) {
+	assert.Equal(t, LevelWarning, String2Level("warning"))
+	assert.Equal(t, LevelCritical, String2Level("Fatal"))
+	assert.Equal(t, LevelUnknown, String2Level("verbose"))
+}
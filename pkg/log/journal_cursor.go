@@ -0,0 +1,137 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// journalCursor is the last journal entry delivered to a subscriber.
+type journalCursor struct {
+	Cursor string `json:"cursor"`
+	// realtime timestamp of the entry in microseconds
+	Timestamp uint64 `json:"timestamp"`
+}
+
+// cursorStore keeps the journal cursor of every subscriber and persists them to a state file,
+// so a restarted reader can resume where the previous one stopped.
+type cursorStore struct {
+	path    string
+	cursors map[string]journalCursor
+	// the subscribers seen since the store was loaded, the cursors of the others are pruned on sync
+	subscribers map[string]bool
+	dirty       bool
+	lock        sync.Mutex
+}
+
+func newCursorStore(path string) *cursorStore {
+	return &cursorStore{path: path, cursors: map[string]journalCursor{}, subscribers: map[string]bool{}}
+}
+
+func loadCursorStore(path string) (*cursorStore, error) {
+	s := newCursorStore(path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if len(data) == 0 {
+		return s, nil
+	}
+	if err := json.Unmarshal(data, &s.cursors); err != nil {
+		return nil, fmt.Errorf("failed to decode journal state file %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *cursorStore) get(subscriber string) (journalCursor, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c, ok := s.cursors[subscriber]
+	return c, ok
+}
+
+// register keeps the cursor of the subscriber when the store syncs.
+func (s *cursorStore) register(subscriber string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.subscribers[subscriber] = true
+}
+
+func (s *cursorStore) set(subscriber string, c journalCursor) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.subscribers[subscriber] = true
+	s.cursors[subscriber] = c
+	s.dirty = true
+}
+
+// ordered returns the saved cursors from the subscriber that is furthest behind to the most recent one.
+func (s *cursorStore) ordered() []journalCursor {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make([]journalCursor, 0, len(s.cursors))
+	for _, c := range s.cursors {
+		if c.Cursor != "" {
+			res = append(res, c)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Timestamp < res[j].Timestamp })
+	return res
+}
+
+// sync writes the cursors to the state file if they changed since the last call.
+// The cursors of the subscribers that didn't subscribe since the store was loaded are dropped,
+// so a removed subscriber doesn't hold the journal back on the next restart.
+// The file is replaced atomically, so a crash never leaves a truncated state behind.
+func (s *cursorStore) sync() error {
+	s.lock.Lock()
+	for name := range s.cursors {
+		if !s.subscribers[name] {
+			delete(s.cursors, name)
+			s.dirty = true
+		}
+	}
+	if !s.dirty {
+		s.lock.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(s.cursors)
+	s.dirty = false
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		s.lock.Lock()
+		s.dirty = true
+		s.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
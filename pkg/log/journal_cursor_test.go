@@ -0,0 +1,45 @@
+package log
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursorStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal", "cursors.json")
+	s, err := loadCursorStore(path)
+	assert.NoError(t, err)
+	assert.Empty(t, s.ordered())
+
+	s.set("kernel", journalCursor{Cursor: "s=1;i=2", Timestamp: 200})
+	s.set("docker.service", journalCursor{Cursor: "s=1;i=1", Timestamp: 100})
+	assert.NoError(t, s.sync())
+
+	s, err = loadCursorStore(path)
+	assert.NoError(t, err)
+	c, ok := s.get("kernel")
+	assert.True(t, ok)
+	assert.Equal(t, journalCursor{Cursor: "s=1;i=2", Timestamp: 200}, c)
+	assert.Equal(t, []journalCursor{{Cursor: "s=1;i=1", Timestamp: 100}, {Cursor: "s=1;i=2", Timestamp: 200}}, s.ordered())
+}
+
+func TestCursorStorePrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cursors.json")
+	s := newCursorStore(path)
+	s.set("kernel", journalCursor{Cursor: "s=1;i=2", Timestamp: 200})
+	s.set("removed.service", journalCursor{Cursor: "s=1;i=1", Timestamp: 100})
+	assert.NoError(t, s.sync())
+
+	// only kernel subscribes after the restart, the cursor of the removed subscriber is dropped on sync
+	s, err := loadCursorStore(path)
+	assert.NoError(t, err)
+	s.register("kernel")
+	assert.Len(t, s.ordered(), 2)
+	assert.NoError(t, s.sync())
+
+	s, err = loadCursorStore(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []journalCursor{{Cursor: "s=1;i=2", Timestamp: 200}}, s.ordered())
+}
@@ -0,0 +1,147 @@
+package log
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/sdjournal"
+)
+
+var priorityNames = map[string]int{
+	"emerg":   0,
+	"alert":   1,
+	"crit":    2,
+	"err":     3,
+	"error":   3,
+	"warning": 4,
+	"warn":    4,
+	"notice":  5,
+	"info":    6,
+	"debug":   7,
+}
+
+// JournalMatch matches an entry when all of its conditions hold.
+type JournalMatch struct {
+	// Fields maps journal fields to their expected value, e.g. {"_TRANSPORT": "kernel"}.
+	// Values containing glob meta characters are matched as patterns, e.g. {"_SYSTEMD_UNIT": "kube*.service"}.
+	Fields map[string]string
+	// Priority keeps only entries at least as severe as the given syslog priority,
+	// either a number ("4") or a name ("warning"). Empty keeps every priority.
+	Priority string
+}
+
+// JournalFilter matches an entry when any of its matches does. An empty filter matches every entry.
+type JournalFilter []JournalMatch
+
+type journalMatch struct {
+	exact       map[string]string
+	globs       map[string]string
+	maxPriority int
+}
+
+type journalFilter []journalMatch
+
+func compileJournalFilter(filter JournalFilter) (journalFilter, error) {
+	res := make(journalFilter, 0, len(filter))
+	for _, m := range filter {
+		cm := journalMatch{exact: map[string]string{}, globs: map[string]string{}, maxPriority: -1}
+		for field, value := range m.Fields {
+			if field == "" {
+				return nil, fmt.Errorf("empty journal field name in filter")
+			}
+			if !strings.ContainsAny(value, "*?[") {
+				cm.exact[field] = value
+				continue
+			}
+			if _, err := path.Match(value, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q for journal field %s: %w", value, field, err)
+			}
+			cm.globs[field] = value
+		}
+		if m.Priority != "" {
+			p, err := parsePriority(m.Priority)
+			if err != nil {
+				return nil, err
+			}
+			cm.maxPriority = p
+		}
+		res = append(res, cm)
+	}
+	return res, nil
+}
+
+func parsePriority(priority string) (int, error) {
+	if p, ok := priorityNames[strings.ToLower(priority)]; ok {
+		return p, nil
+	}
+	if p, err := strconv.Atoi(priority); err == nil && p >= 0 && p <= 7 {
+		return p, nil
+	}
+	return -1, fmt.Errorf("unknown journal priority %q", priority)
+}
+
+func (f journalFilter) match(fields map[string]string) bool {
+	if len(f) == 0 {
+		return true
+	}
+	for _, m := range f {
+		if m.match(fields) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m journalMatch) match(fields map[string]string) bool {
+	for field, value := range m.exact {
+		if v, ok := fields[field]; !ok || v != value {
+			return false
+		}
+	}
+	for field, pattern := range m.globs {
+		v, ok := fields[field]
+		if !ok {
+			return false
+		}
+		if matched, _ := path.Match(pattern, v); !matched {
+			return false
+		}
+	}
+	if m.maxPriority >= 0 {
+		p, err := strconv.Atoi(fields[sdjournal.SD_JOURNAL_FIELD_PRIORITY])
+		if err != nil || p > m.maxPriority {
+			return false
+		}
+	}
+	return true
+}
+
+// sdMatches translates the filter into terms of sd-journal matches, the fields of a term are AND-ed
+// and the terms are OR-ed. Globs can't be expressed by sd-journal, so the terms only narrow down the
+// entries read from the journal and match still has to be checked for every entry.
+// ok is false when the filter can't be narrowed down at all.
+func (f journalFilter) sdMatches() (terms [][]sdjournal.Match, ok bool) {
+	if len(f) == 0 {
+		return nil, false
+	}
+	for _, m := range f {
+		var term []sdjournal.Match
+		for field, value := range m.exact {
+			term = append(term, sdjournal.Match{Field: field, Value: value})
+		}
+		if m.maxPriority >= 0 {
+			for p := 0; p <= m.maxPriority; p++ {
+				term = append(term, sdjournal.Match{Field: sdjournal.SD_JOURNAL_FIELD_PRIORITY, Value: strconv.Itoa(p)})
+			}
+		}
+		if len(term) == 0 {
+			return nil, false
+		}
+		sort.Slice(term, func(i, j int) bool { return term[i].String() < term[j].String() })
+		terms = append(terms, term)
+	}
+	return terms, true
+}
@@ -0,0 +1,37 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/coreos/go-systemd/v22/sdjournal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalFilter(t *testing.T) {
+	f, err := compileJournalFilter(JournalFilter{
+		{Fields: map[string]string{"_TRANSPORT": "kernel"}},
+		{Fields: map[string]string{"_SYSTEMD_UNIT": "kube*.service"}, Priority: "warning"},
+	})
+	assert.NoError(t, err)
+
+	assert.True(t, f.match(map[string]string{"_TRANSPORT": "kernel", "PRIORITY": "6"}))
+	assert.True(t, f.match(map[string]string{"_SYSTEMD_UNIT": "kubelet.service", "PRIORITY": "3"}))
+	assert.False(t, f.match(map[string]string{"_SYSTEMD_UNIT": "kubelet.service", "PRIORITY": "6"}))
+	assert.False(t, f.match(map[string]string{"_SYSTEMD_UNIT": "containerd.service", "PRIORITY": "3"}))
+	assert.True(t, journalFilter{}.match(map[string]string{"_SYSTEMD_UNIT": "containerd.service"}))
+
+	terms, ok := f.sdMatches()
+	assert.True(t, ok)
+	assert.Equal(t, [][]sdjournal.Match{
+		{{Field: "_TRANSPORT", Value: "kernel"}},
+		{{Field: "PRIORITY", Value: "0"}, {Field: "PRIORITY", Value: "1"}, {Field: "PRIORITY", Value: "2"}, {Field: "PRIORITY", Value: "3"}, {Field: "PRIORITY", Value: "4"}},
+	}, terms)
+
+	f, err = compileJournalFilter(JournalFilter{{Fields: map[string]string{"_SYSTEMD_UNIT": "kube*"}}})
+	assert.NoError(t, err)
+	_, ok = f.sdMatches()
+	assert.False(t, ok)
+
+	_, err = compileJournalFilter(JournalFilter{{Priority: "loud"}})
+	assert.Error(t, err)
+}
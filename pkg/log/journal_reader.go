@@ -7,20 +7,55 @@ import (
 	"time"
 
 	"github.com/coreos/go-systemd/v22/sdjournal"
+	"k8s.io/klog/v2"
 )
 
+const defaultCursorSyncInterval = 5 * time.Second
+
+type JournalReaderConfig struct {
+	// StateFile is where the cursor of every subscriber is persisted, persistence is disabled when empty.
+	StateFile string
+	// MaxLookback limits how far back a restarted reader replays the journal, zero means no limit.
+	MaxLookback time.Duration
+	// SyncInterval is how often cursors are written to the StateFile.
+	SyncInterval time.Duration
+}
+
 type JournalReader struct {
-	journal     *sdjournal.Journal
-	subscribers map[string]chan<- Message
-	lock        sync.Mutex
+	journal        *sdjournal.Journal
+	subscribers    map[string]*journalSubscriber
+	matchesChanged bool
+	lock           sync.Mutex
+	cursors        *cursorStore
+	// realtime timestamp in microseconds the reader started at, subscribers without a saved cursor
+	// only receive entries written after it
+	startUsec uint64
+	// the last entry read from the journal, used to keep the position when the journal matches change
+	position journalCursor
+	done     chan struct{}
+	wg       sync.WaitGroup
 }
 
-func NewJournalReader(journalFieldFilter string, journalPath []string) (j *JournalReader, err error) {
-	if len(journalPath) == 0 || len(journalFieldFilter) == 0 {
-		return nil, fmt.Errorf("The JournalReader can't be created because the journalFieldFilter or journalPathdoes not exist.")
+type journalSubscriber struct {
+	name      string
+	filter    journalFilter
+	unmatched bool
+	ch        chan<- Message
+}
+
+func NewJournalReader(journalPath []string, config JournalReaderConfig) (j *JournalReader, err error) {
+	if len(journalPath) == 0 {
+		return nil, fmt.Errorf("The JournalReader can't be created because the journalPath does not exist.")
 	}
 	j = &JournalReader{
-		subscribers: map[string]chan<- Message{},
+		subscribers: map[string]*journalSubscriber{},
+		done:        make(chan struct{}),
+	}
+	if config.StateFile != "" {
+		if j.cursors, err = loadCursorStore(config.StateFile); err != nil {
+			klog.Warningf("failed to load journal cursors, reading from tail: %s", err)
+			j.cursors = newCursorStore(config.StateFile)
+		}
 	}
 	for _, path := range journalPath {
 		if j.journal, err = sdjournal.NewJournalFromDir(path); err != nil {
@@ -29,24 +64,171 @@ func NewJournalReader(journalFieldFilter string, journalPath []string) (j *Journ
 		if usage, err := j.journal.GetUsage(); err != nil || usage == 0 {
 			continue
 		}
-		if err = j.journal.SeekRealtimeUsec(uint64(time.Now().Add(time.Millisecond).UnixNano() / 1000)); err != nil {
+		if err = j.seek(config.MaxLookback); err != nil {
 			return nil, err
 		}
-
-		// if err = j.journal.SeekRealtimeUsec(1000); err != nil {
-		// 	return nil, err
-		// }
 		break
 	}
 	if j.journal == nil {
 		return nil, fmt.Errorf("systemd journal not found in path : %s ", strings.Join(journalPath, ";"))
 	}
-	go j.fllow(journalFieldFilter)
+	j.wg.Add(1)
+	go j.fllow()
+	if j.cursors != nil {
+		if config.SyncInterval <= 0 {
+			config.SyncInterval = defaultCursorSyncInterval
+		}
+		j.wg.Add(1)
+		go j.syncCursors(config.SyncInterval)
+	}
 	return j, nil
 }
 
-func (j *JournalReader) fllow(journalFieldFilter string) {
+// seek positions the journal at the saved cursor of the subscriber that is furthest behind, bounded by maxLookback.
+// When that cursor has already been vacuumed the next subscriber cursor is used, and the subscribers
+// skip the entries they already received. Without any available cursor the reader resumes from
+// maxLookback, or from the tail when there is no limit.
+func (j *JournalReader) seek(maxLookback time.Duration) error {
+	now := time.Now()
+	j.startUsec = uint64(now.UnixMicro())
+	var cursors []journalCursor
+	if j.cursors != nil {
+		cursors = j.cursors.ordered()
+	}
+	if len(cursors) == 0 {
+		j.position = journalCursor{Timestamp: uint64(now.Add(time.Millisecond).UnixMicro())}
+		return j.journal.SeekRealtimeUsec(j.position.Timestamp)
+	}
+	var since uint64
+	if maxLookback > 0 {
+		since = uint64(now.Add(-maxLookback).UnixMicro())
+	}
+	for _, cursor := range cursors {
+		if cursor.Timestamp < since {
+			klog.Infof("journal cursor is older than %s, resuming from %s", maxLookback, time.UnixMicro(int64(since)))
+			j.position = journalCursor{Timestamp: since}
+			return j.journal.SeekRealtimeUsec(since)
+		}
+		if j.seekCursor(cursor.Cursor) {
+			klog.Infof("resuming journal from cursor %s", cursor.Cursor)
+			j.position = cursor
+			return nil
+		}
+		klog.Warningf("journal cursor %s is no longer available", cursor.Cursor)
+	}
+	if since > 0 {
+		klog.Infof("no journal cursor is available, resuming from %s", time.UnixMicro(int64(since)))
+		j.position = journalCursor{Timestamp: since}
+		return j.journal.SeekRealtimeUsec(since)
+	}
+	klog.Warningf("no journal cursor is available, reading from tail")
+	if err := j.journal.SeekTail(); err != nil {
+		return err
+	}
+	if _, err := j.journal.Previous(); err != nil {
+		return err
+	}
+	j.position = journalCursor{Timestamp: j.startUsec}
+	if c, err := j.journal.GetCursor(); err == nil {
+		j.position.Cursor = c
+	}
+	return nil
+}
+
+// seekCursor moves the journal to the entry of the cursor, it reports false when the entry is gone.
+func (j *JournalReader) seekCursor(cursor string) bool {
+	if err := j.journal.SeekCursor(cursor); err != nil {
+		return false
+	}
+	_, err := j.journal.Next()
+	return err == nil && j.journal.TestCursor(cursor) == nil
+}
+
+// applyMatches replaces the sd-journal matches with the ones required by the current subscribers
+// and moves the journal back to the last read entry, as changing matches invalidates the position.
+func (j *JournalReader) applyMatches() error {
+	j.lock.Lock()
+	terms, ok := j.sdMatches()
+	j.matchesChanged = false
+	j.lock.Unlock()
+
+	j.journal.FlushMatches()
+	if ok {
+		for i, term := range terms {
+			if i > 0 {
+				if err := j.journal.AddDisjunction(); err != nil {
+					return err
+				}
+			}
+			for _, m := range term {
+				if err := j.journal.AddMatch(m.String()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if j.position.Cursor == "" {
+		return j.journal.SeekRealtimeUsec(j.position.Timestamp)
+	}
+	if err := j.journal.SeekCursor(j.position.Cursor); err != nil {
+		return err
+	}
+	if _, err := j.journal.Next(); err != nil {
+		return err
+	}
+	if j.journal.TestCursor(j.position.Cursor) != nil {
+		// the last read entry is excluded by the new matches and the journal already points
+		// to the entry after it, step back so that entry isn't skipped
+		_, err := j.journal.Previous()
+		return err
+	}
+	return nil
+}
+
+// sdMatches returns the union of the subscriber filters as sd-journal match terms,
+// ok is false when some subscriber needs every entry. It must be called with the lock held.
+func (j *JournalReader) sdMatches() (terms [][]sdjournal.Match, ok bool) {
+	if len(j.subscribers) == 0 {
+		return nil, false
+	}
+	seen := map[string]bool{}
+	for _, s := range j.subscribers {
+		if s.unmatched {
+			return nil, false
+		}
+		sterms, ok := s.filter.sdMatches()
+		if !ok {
+			return nil, false
+		}
+		for _, term := range sterms {
+			key := fmt.Sprint(term)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms, true
+}
+
+func (j *JournalReader) fllow() {
+	defer j.wg.Done()
 	for {
+		select {
+		case <-j.done:
+			return
+		default:
+		}
+		j.lock.Lock()
+		changed := j.matchesChanged
+		j.lock.Unlock()
+		if changed {
+			if err := j.applyMatches(); err != nil {
+				klog.Errorf("failed to apply journal matches: %s", err)
+				return
+			}
+		}
 		if n, err := j.journal.Next(); err != nil {
 			fmt.Println("faild to read journal, error: ", err)
 			return
@@ -59,25 +241,88 @@ func (j *JournalReader) fllow(journalFieldFilter string) {
 		if entry, err := j.journal.GetEntry(); err != nil {
 			fmt.Println("fail to read jouranl entry")
 		} else {
-			msg := entry.Fields[sdjournal.SD_JOURNAL_FIELD_MESSAGE]
-			if len(msg) == 0 {
+			j.position = journalCursor{Cursor: entry.Cursor, Timestamp: entry.RealtimeTimestamp}
+			if len(entry.Fields[sdjournal.SD_JOURNAL_FIELD_MESSAGE]) == 0 {
 				continue
 			}
-			log := Message{Content: msg,
-				Level:     priority2Levels[entry.Fields[sdjournal.SD_JOURNAL_FIELD_PRIORITY]].string(),
-				Timestamp: time.UnixMicro(int64(entry.RealtimeTimestamp)),
-				Meta:      attr(entry, sdjournal.SD_JOURNAL_FIELD_HOSTNAME, sdjournal.SD_JOURNAL_FIELD_MACHINE_ID, sdjournal.SD_JOURNAL_FIELD_TRANSPORT, sdjournal.SD_JOURNAL_FIELD_SYSTEMD_UNIT),
-			}
 			j.lock.Lock()
-			ch, ok := j.subscribers[entry.Fields[journalFieldFilter]]
+			subscribers := j.match(entry.Fields)
 			j.lock.Unlock()
-			if !ok {
-				continue
+			for _, s := range subscribers {
+				if !j.pending(s.name, entry) {
+					continue
+				}
+				select {
+				case s.ch <- newJournalMessage(entry):
+				case <-j.done:
+					return
+				}
+				if j.cursors != nil {
+					j.cursors.set(s.name, j.position)
+				}
+			}
+		}
+	}
+}
+
+// match returns the subscribers whose filter matches the entry fields,
+// or the subscribers of unmatched entries if there are none. It must be called with the lock held.
+func (j *JournalReader) match(fields map[string]string) []*journalSubscriber {
+	var matched, unmatched []*journalSubscriber
+	for _, s := range j.subscribers {
+		switch {
+		case s.unmatched:
+			unmatched = append(unmatched, s)
+		case s.filter.match(fields):
+			matched = append(matched, s)
+		}
+	}
+	if len(matched) == 0 {
+		return unmatched
+	}
+	return matched
+}
+
+func newJournalMessage(entry *sdjournal.JournalEntry) Message {
+	level := LevelUnknown
+	if l, ok := priority2Levels[entry.Fields[sdjournal.SD_JOURNAL_FIELD_PRIORITY]]; ok {
+		level = l
+	}
+	return Message{Content: entry.Fields[sdjournal.SD_JOURNAL_FIELD_MESSAGE],
+		Level:     level.string(),
+		Timestamp: time.UnixMicro(int64(entry.RealtimeTimestamp)),
+		Meta:      attr(entry, sdjournal.SD_JOURNAL_FIELD_HOSTNAME, sdjournal.SD_JOURNAL_FIELD_MACHINE_ID, sdjournal.SD_JOURNAL_FIELD_TRANSPORT, sdjournal.SD_JOURNAL_FIELD_SYSTEMD_UNIT),
+	}
+}
+
+// pending reports whether the entry hasn't been delivered to the subscriber yet,
+// entries replayed for other subscribers after a restart are skipped.
+func (j *JournalReader) pending(subscriber string, entry *sdjournal.JournalEntry) bool {
+	if j.cursors == nil {
+		return true
+	}
+	if c, ok := j.cursors.get(subscriber); ok {
+		return entry.RealtimeTimestamp > c.Timestamp
+	}
+	return entry.RealtimeTimestamp >= j.startUsec
+}
+
+func (j *JournalReader) syncCursors(interval time.Duration) {
+	defer j.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.done:
+			return
+		case <-ticker.C:
+			if err := j.cursors.sync(); err != nil {
+				klog.Warningf("failed to save journal cursors: %s", err)
 			}
-			ch <- log
 		}
 	}
 }
+
 func attr(entry *sdjournal.JournalEntry, fields ...string) map[string]string {
 	attr := make(map[string]string, len(fields))
 	for _, field := range fields {
@@ -88,21 +333,56 @@ func attr(entry *sdjournal.JournalEntry, fields ...string) map[string]string {
 	return attr
 }
 
-func (j *JournalReader) Subscribe(JournalFieldVal string, ch chan<- Message) error {
+// Subscribe sends the entries matching the filter to ch. The name identifies the subscriber,
+// several subscribers may share the same filter.
+func (j *JournalReader) Subscribe(name string, filter JournalFilter, ch chan<- Message) error {
+	f, err := compileJournalFilter(filter)
+	if err != nil {
+		return err
+	}
+	return j.subscribe(&journalSubscriber{name: name, filter: f, ch: ch})
+}
+
+// SubscribeUnmatched sends the entries no other subscriber is interested in to ch.
+func (j *JournalReader) SubscribeUnmatched(name string, ch chan<- Message) error {
+	return j.subscribe(&journalSubscriber{name: name, unmatched: true, ch: ch})
+}
+
+func (j *JournalReader) subscribe(s *journalSubscriber) error {
 	j.lock.Lock()
 	defer j.lock.Unlock()
-	if _, ok := j.subscribers[JournalFieldVal]; ok {
-		return fmt.Errorf("duplicate subscriber for group %s", JournalFieldVal)
+	if _, ok := j.subscribers[s.name]; ok {
+		return fmt.Errorf("duplicate subscriber %s", s.name)
+	}
+	j.subscribers[s.name] = s
+	j.matchesChanged = true
+	if j.cursors != nil {
+		j.cursors.register(s.name)
 	}
-	j.subscribers[JournalFieldVal] = ch
 	return nil
 }
 
-func (j *JournalReader) Unsubscribe(JournalFieldVal string) {
+func (j *JournalReader) Unsubscribe(name string) {
 	j.lock.Lock()
 	defer j.lock.Unlock()
-	if _, ok := j.subscribers[JournalFieldVal]; ok {
-		fmt.Printf("unknow subscribe group %s", JournalFieldVal)
+	if _, ok := j.subscribers[name]; !ok {
+		klog.Warningf("unknown journal subscriber %s", name)
+		return
+	}
+	delete(j.subscribers, name)
+	j.matchesChanged = true
+}
+
+// Close stops reading the journal and saves the subscriber cursors.
+func (j *JournalReader) Close() error {
+	close(j.done)
+	j.wg.Wait()
+	var err error
+	if j.cursors != nil {
+		err = j.cursors.sync()
+	}
+	if cerr := j.journal.Close(); err == nil {
+		err = cerr
 	}
-	delete(j.subscribers, JournalFieldVal)
+	return err
 }
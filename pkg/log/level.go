@@ -1,5 +1,7 @@
 package log
 
+import "strings"
+
 // A Level is a logging priority. Higher levels are more important.
 type Level int
 
@@ -14,7 +16,10 @@ type Level int
 7 (debug) corresponds to debug in syslog, indicating debugging or trace information
 */
 const (
-	LevelCritical Level = iota - 1
+	// LevelUnknown is returned for unrecognized level strings.
+	LevelUnknown Level = iota - 2
+	// LevelCritical is logger critical level.
+	LevelCritical
 	// LevelError is logger error level.
 	LevelError
 	// LevelWarn is logger warn level.
@@ -37,17 +42,19 @@ var priority2Levels = map[string]Level{
 }
 
 func String2Level(level string) Level {
-	switch level {
-	case "DEBUG":
+	switch strings.ToUpper(strings.TrimSpace(level)) {
+	case "DEBUG", "DBG", "TRACE", "TRC":
 		return LevelDebug
-	case "INFO":
+	case "INFO", "INF", "INFORMATION", "INFORMATIONAL", "NOTICE":
 		return LevelInfo
-	case "WARN":
+	case "WARN", "WRN", "WARNING":
 		return LevelWarning
-	case "ERROR":
+	case "ERROR", "ERR", "EROR":
 		return LevelError
+	case "CRITICAL", "CRIT", "CRT", "FATAL", "FTL", "PANIC", "ALERT", "EMERG", "EMERGENCY":
+		return LevelCritical
 	default:
-		return -1
+		return LevelUnknown
 	}
 }
 
@@ -61,6 +68,8 @@ func (l Level) string() string {
 		return "WARN"
 	case LevelError:
 		return "ERROR"
+	case LevelCritical:
+		return "CRITICAL"
 	default:
 		return ""
 	}
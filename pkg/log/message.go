@@ -5,6 +5,9 @@ import (
 	"time"
 )
 
+// MetaContainerId is the Meta key sources set to the id of the container a message was read from.
+const MetaContainerId = "container_id"
+
 type Message struct {
 	Content   string
 	Level     string
@@ -14,6 +17,9 @@ type Message struct {
 }
 
 func (m *Message) AddFields(name string, val string) {
+	if m.Fields == nil {
+		m.Fields = map[string]string{}
+	}
 	if val, ok := m.Fields[name]; ok {
 		fmt.Printf(" Message Field duplicate, name :%s,	val: %s", name, val)
 	}
@@ -21,8 +27,21 @@ func (m *Message) AddFields(name string, val string) {
 }
 
 func (m *Message) AddMeta(name string, val string) {
-	if val, ok := m.Fields[name]; ok {
+	if m.Meta == nil {
+		m.Meta = map[string]string{}
+	}
+	if val, ok := m.Meta[name]; ok {
 		fmt.Printf(" Message Field duplicate, name :%s,	val: %s", name, val)
 	}
 	m.Meta[name] = val
 }
+
+// Source identifies where the message comes from: the container, the systemd unit or the journal transport.
+func (m *Message) Source() string {
+	for _, name := range []string{MetaContainerId, "_SYSTEMD_UNIT", "_TRANSPORT"} {
+		if v := m.Meta[name]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
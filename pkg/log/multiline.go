@@ -0,0 +1,244 @@
+package log
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMultilineMaxLines     = 500
+	defaultMultilineMaxBytes     = 64 * 1024
+	defaultMultilineFlushTimeout = time.Second
+)
+
+type MultilineConfig struct {
+	// StartPatterns are regular expressions matching the first line of a message, every line not matching
+	// any of them is appended to the previous message. The built-in detectors are used when empty.
+	StartPatterns []string
+	// Detectors enables the built-in stack trace detectors: "java", "python", "go" and "dotnet". All of them when empty.
+	Detectors []string
+	// MaxLines and MaxBytes flush a message once it grows beyond them.
+	MaxLines int
+	MaxBytes int
+	// FlushTimeout flushes a message when no continuation line arrives in time.
+	FlushTimeout time.Duration
+}
+
+// multilineDetector reports whether line continues the message whose last line is last.
+type multilineDetector func(last, line string) bool
+
+var multilineDetectors = map[string]multilineDetector{
+	"java":   javaContinues,
+	"python": pythonContinues,
+	"go":     goPanicContinues,
+	"dotnet": dotnetContinues,
+}
+
+var (
+	javaContinuationRe   = regexp.MustCompile(`^(\s+at\s|\s+\.\.\.\s\d+\s(more|common frames omitted)|Caused by:\s|\s+Suppressed:\s)`)
+	dotnetContinuationRe = regexp.MustCompile(`^(\s+at\s|\s*--- End of (inner exception|stack trace)|\s*---> )`)
+	pythonExceptionRe    = regexp.MustCompile(`^[A-Za-z_][\w.]*(Error|Exception|Exit|Interrupt|Warning|Iteration)(:\s.*)?$`)
+	goGoroutineRe        = regexp.MustCompile(`^goroutine \d+ \[.+\]:$`)
+	goFunctionRe         = regexp.MustCompile(`^(created by )?[\w.\-/*()\[\]{},]+\(.*\)( in goroutine \d+)?$`)
+)
+
+const (
+	pythonTracebackHeader = "Traceback (most recent call last):"
+	pythonChainedCause    = "The above exception was the direct cause of the following exception:"
+	pythonChainedContext  = "During handling of the above exception, another exception occurred:"
+)
+
+func javaContinues(last, line string) bool {
+	return javaContinuationRe.MatchString(line)
+}
+
+func dotnetContinues(last, line string) bool {
+	return dotnetContinuationRe.MatchString(line)
+}
+
+func pythonContinues(last, line string) bool {
+	indented := func(s string) bool { return strings.HasPrefix(s, "  ") }
+	switch {
+	case line == pythonTracebackHeader, line == pythonChainedCause, line == pythonChainedContext:
+		return true
+	case indented(line):
+		return last == pythonTracebackHeader || indented(last)
+	case line == "":
+		return pythonExceptionRe.MatchString(last) || last == pythonChainedCause || last == pythonChainedContext
+	}
+	return indented(last) && pythonExceptionRe.MatchString(line)
+}
+
+func goPanicContinues(last, line string) bool {
+	switch {
+	case line == "":
+		return strings.HasPrefix(last, "panic: ") || strings.HasPrefix(last, "fatal error: ") ||
+			strings.HasPrefix(last, "[signal ") || strings.HasPrefix(last, "\t")
+	case strings.HasPrefix(line, "\t"):
+		return true
+	case goGoroutineRe.MatchString(line):
+		return last == ""
+	case strings.HasPrefix(line, "[signal "):
+		return strings.HasPrefix(last, "panic: ")
+	case strings.HasPrefix(line, "exit status "):
+		return strings.HasPrefix(last, "\t")
+	case goFunctionRe.MatchString(line):
+		return goGoroutineRe.MatchString(last) || strings.HasPrefix(last, "\t")
+	}
+	return false
+}
+
+// MultilineAssembler joins the continuation lines of stack traces and other multiline
+// output into a single message. Lines of different sources are kept apart by their Meta.
+type MultilineAssembler struct {
+	config        MultilineConfig
+	startPatterns []*regexp.Regexp
+	detectors     []multilineDetector
+	pending       map[string]*multilineMessage
+	out           chan<- Message
+	done          <-chan struct{}
+}
+
+type multilineMessage struct {
+	Message
+	content strings.Builder
+	last    string
+	lines   int
+	updated time.Time
+}
+
+func NewMultilineAssembler(config MultilineConfig) (*MultilineAssembler, error) {
+	a := &MultilineAssembler{config: config, pending: map[string]*multilineMessage{}}
+	for _, p := range config.StartPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid multiline start pattern %q: %w", p, err)
+		}
+		a.startPatterns = append(a.startPatterns, re)
+	}
+	names := config.Detectors
+	if len(names) == 0 {
+		names = []string{"java", "python", "go", "dotnet"}
+	}
+	for _, name := range names {
+		d, ok := multilineDetectors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown multiline detector %s", name)
+		}
+		a.detectors = append(a.detectors, d)
+	}
+	if a.config.MaxLines <= 0 {
+		a.config.MaxLines = defaultMultilineMaxLines
+	}
+	if a.config.MaxBytes <= 0 {
+		a.config.MaxBytes = defaultMultilineMaxBytes
+	}
+	if a.config.FlushTimeout <= 0 {
+		a.config.FlushTimeout = defaultMultilineFlushTimeout
+	}
+	return a, nil
+}
+
+// Run assembles the lines read from in and sends the resulting messages to out.
+// It returns once in is closed, after flushing the pending messages, or when done is closed.
+func (a *MultilineAssembler) Run(in <-chan Message, out chan<- Message, done <-chan struct{}) {
+	a.out, a.done = out, done
+	ticker := time.NewTicker(a.config.FlushTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case msg, ok := <-in:
+			if !ok {
+				a.flush(time.Time{})
+				return
+			}
+			a.add(msg)
+		case now := <-ticker.C:
+			a.flush(now.Add(-a.config.FlushTimeout))
+		}
+	}
+}
+
+func (a *MultilineAssembler) add(msg Message) {
+	key := streamKey(msg)
+	line := strings.TrimRight(msg.Content, "\r\n")
+	if m := a.pending[key]; m != nil {
+		if a.continues(m.last, line) && m.lines < a.config.MaxLines && m.content.Len()+len(line) < a.config.MaxBytes {
+			m.content.WriteByte('\n')
+			m.content.WriteString(line)
+			m.last = line
+			m.lines++
+			m.updated = time.Now()
+			return
+		}
+		delete(a.pending, key)
+		a.emit(m.message())
+	}
+	m := &multilineMessage{Message: msg, last: line, lines: 1, updated: time.Now()}
+	m.content.WriteString(line)
+	a.pending[key] = m
+}
+
+func (a *MultilineAssembler) continues(last, line string) bool {
+	if len(a.startPatterns) > 0 {
+		for _, re := range a.startPatterns {
+			if re.MatchString(line) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, d := range a.detectors {
+		if d(last, line) {
+			return true
+		}
+	}
+	return false
+}
+
+// flush sends the messages not updated since before, all of them when before is zero.
+func (a *MultilineAssembler) flush(before time.Time) {
+	for key, m := range a.pending {
+		if before.IsZero() || m.updated.Before(before) {
+			delete(a.pending, key)
+			a.emit(m.message())
+		}
+	}
+}
+
+func (a *MultilineAssembler) emit(msg Message) {
+	select {
+	case a.out <- msg:
+	case <-a.done:
+	}
+}
+
+func (m *multilineMessage) message() Message {
+	msg := m.Message
+	msg.Content = m.content.String()
+	return msg
+}
+
+func streamKey(msg Message) string {
+	if len(msg.Meta) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(msg.Meta))
+	for k := range msg.Meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(msg.Meta[k])
+		b.WriteByte(';')
+	}
+	return b.String()
+}
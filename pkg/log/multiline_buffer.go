@@ -1,65 +1,216 @@
 package log
 
 import (
-	"encoding/json"
-	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 )
 
+const (
+	defaultBufferMaxBytes     = 1024 * 1024
+	defaultBufferMaxLines     = 1000
+	defaultBufferFlushTimeout = time.Second
+	defaultBufferQueueSize    = 16
+
+	// messageOverhead approximates the JSON encoding of a message without its strings
+	messageOverhead = 96
+	// fieldOverhead approximates the quotes and separators around a field name and value
+	fieldOverhead = 6
+)
+
+// OverflowPolicy decides what happens to a full batch when the queue of batches waiting for export is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the producers until the exporter catches up.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the batch that doesn't fit into the queue.
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest queued batch to make room for the new one.
+	OverflowDropOldest
+)
+
+type MessageBufferConfig struct {
+	// MaxBytes and MaxLines flush a batch once it reaches them.
+	MaxBytes int
+	MaxLines int
+	// Timeout flushes a partial batch once its first message is older than it.
+	Timeout time.Duration
+	// QueueSize is the number of flushed batches waiting for export.
+	QueueSize int
+	// Overflow is applied when the queue is full.
+	Overflow OverflowPolicy
+}
+
+// MessageBuffer groups messages into batches and queues them on MessagesChan.
+// MessagesChan is closed by Close once the last batch has been queued.
 type MessageBuffer struct {
-	maxBytes     int // bytes stored in content
-	maxLines     int
-	lastBytes    int
-	numLines     int
+	config       MessageBufferConfig
 	MessagesChan chan []Message
 	lock         sync.Mutex
-	message      []Message
-	closed       bool
+	// sendLock is taken before lock is released, so batches are queued in the order they were flushed
+	sendLock sync.Mutex
+	message  []Message
+	bytes    int // approximate size of the batch encoded as JSON
+	first    time.Time
+	closed   bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	droppedBatches  atomic.Uint64
+	droppedMessages atomic.Uint64
 }
 
-func NewMessageBuffer(maxBytes, maxLines int, timeout time.Duration) *MessageBuffer {
-	return &MessageBuffer{
-		maxBytes:     maxBytes,
-		maxLines:     maxLines,
-		MessagesChan: make(chan []Message),
+func NewMessageBuffer(config MessageBufferConfig) *MessageBuffer {
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = defaultBufferMaxBytes
+	}
+	if config.MaxLines <= 0 {
+		config.MaxLines = defaultBufferMaxLines
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultBufferFlushTimeout
 	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultBufferQueueSize
+	}
+	m := &MessageBuffer{
+		config:       config,
+		MessagesChan: make(chan []Message, config.QueueSize),
+		done:         make(chan struct{}),
+	}
+	m.wg.Add(1)
+	go m.flushExpired()
+	return m
 }
 
 func (m *MessageBuffer) Add(message Message) {
-	if m.closed {
-		return
-	}
-	if !utf8.ValidString(message.Content) {
+	if message.Content == "" || !utf8.ValidString(message.Content) {
 		return
 	}
+	size := messageSize(message)
 	m.lock.Lock()
-	defer m.lock.Unlock()
-	if message.Content == "" {
+	if m.closed {
+		m.lock.Unlock()
 		return
 	}
-	if m.numLines >= m.maxLines || m.lastBytes >= m.maxBytes {
+	if len(m.message) > 0 && m.bytes+size > m.config.MaxBytes {
 		m.flushMessage()
+		m.lock.Lock()
+	}
+	if len(m.message) == 0 {
+		m.first = time.Now()
 	}
 	m.message = append(m.message, message)
-	if j, err := json.Marshal(m.message); err != nil {
-		fmt.Println("message buffer add message error:", err)
-	} else {
-		m.lastBytes = len(j)
+	m.bytes += size
+	if len(m.message) >= m.config.MaxLines || m.bytes >= m.config.MaxBytes {
+		m.flushMessage()
+		return
 	}
-	m.numLines++
+	m.lock.Unlock()
 }
 
+// flushMessage queues the current batch. It must be called with the lock held and releases it,
+// so producers aren't stalled while a blocking send waits for the exporter.
 func (m *MessageBuffer) flushMessage() {
-	if m.numLines == 0 {
+	if len(m.message) == 0 {
+		m.lock.Unlock()
 		return
 	}
-	m.MessagesChan <- m.message
+	batch := m.message
 	m.reset()
+	m.sendLock.Lock()
+	defer m.sendLock.Unlock()
+	m.lock.Unlock()
+	m.enqueue(batch)
+}
+
+func (m *MessageBuffer) enqueue(batch []Message) {
+	switch m.config.Overflow {
+	case OverflowDropNewest:
+		select {
+		case m.MessagesChan <- batch:
+		default:
+			m.drop(batch)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case m.MessagesChan <- batch:
+				return
+			default:
+			}
+			select {
+			case oldest := <-m.MessagesChan:
+				m.drop(oldest)
+			default:
+			}
+		}
+	default:
+		m.MessagesChan <- batch
+	}
+}
+
+func (m *MessageBuffer) drop(batch []Message) {
+	m.droppedBatches.Add(1)
+	m.droppedMessages.Add(uint64(len(batch)))
 }
 
 func (m *MessageBuffer) reset() {
-	m.numLines = 0
-	m.message = []Message{}
+	m.message = nil
+	m.bytes = 0
+}
+
+func (m *MessageBuffer) flushExpired() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.config.Timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			m.lock.Lock()
+			if len(m.message) > 0 && now.Sub(m.first) >= m.config.Timeout {
+				m.flushMessage()
+			} else {
+				m.lock.Unlock()
+			}
+		}
+	}
+}
+
+// Dropped returns the number of batches and messages dropped because the queue was full.
+func (m *MessageBuffer) Dropped() (batches, messages uint64) {
+	return m.droppedBatches.Load(), m.droppedMessages.Load()
+}
+
+// Close queues the pending batch and closes MessagesChan, messages added afterwards are discarded.
+func (m *MessageBuffer) Close() {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return
+	}
+	m.closed = true
+	m.lock.Unlock()
+	close(m.done)
+	m.wg.Wait()
+	m.lock.Lock()
+	m.flushMessage()
+	m.sendLock.Lock()
+	close(m.MessagesChan)
+	m.sendLock.Unlock()
+}
+
+func messageSize(message Message) int {
+	size := messageOverhead + len(message.Content) + len(message.Level)
+	for k, v := range message.Fields {
+		size += len(k) + len(v) + fieldOverhead
+	}
+	for k, v := range message.Meta {
+		size += len(k) + len(v) + fieldOverhead
+	}
+	return size
 }
@@ -0,0 +1,91 @@
+package log
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func assemble(t *testing.T, config MultilineConfig, lines ...string) []string {
+	a, err := NewMultilineAssembler(config)
+	assert.NoError(t, err)
+	in := make(chan Message, len(lines))
+	out := make(chan Message, len(lines))
+	for _, l := range lines {
+		in <- Message{Content: l, Meta: map[string]string{"_SYSTEMD_UNIT": "app.service"}}
+	}
+	close(in)
+	a.Run(in, out, nil)
+	close(out)
+	var res []string
+	for m := range out {
+		res = append(res, m.Content)
+	}
+	return res
+}
+
+func TestMultilineJava(t *testing.T) {
+	trace := []string{
+		`Exception in thread "main" java.lang.IllegalStateException: boom`,
+		"\tat com.example.App.run(App.java:10)",
+		"\tat com.example.App.main(App.java:5)",
+		"Caused by: java.io.IOException: closed",
+		"\t... 2 more",
+	}
+	res := assemble(t, MultilineConfig{}, append([]string{"starting"}, append(trace, "done")...)...)
+	assert.Equal(t, []string{"starting", strings.Join(trace, "\n"), "done"}, res)
+}
+
+func TestMultilinePython(t *testing.T) {
+	trace := []string{
+		"ERROR:root:request failed",
+		"Traceback (most recent call last):",
+		`  File "app.py", line 3, in <module>`,
+		"    main()",
+		"ValueError: bad value",
+	}
+	res := assemble(t, MultilineConfig{Detectors: []string{"python"}}, append(trace, "INFO:root:next")...)
+	assert.Equal(t, []string{strings.Join(trace, "\n"), "INFO:root:next"}, res)
+}
+
+func TestMultilineGoPanic(t *testing.T) {
+	trace := []string{
+		"panic: runtime error: index out of range [1] with length 1",
+		"",
+		"goroutine 1 [running]:",
+		"main.main()",
+		"\t/app/main.go:8 +0x1d",
+		"exit status 2",
+	}
+	res := assemble(t, MultilineConfig{Detectors: []string{"go"}}, trace...)
+	assert.Equal(t, []string{strings.Join(trace, "\n")}, res)
+}
+
+func TestMultilineStartPattern(t *testing.T) {
+	res := assemble(t, MultilineConfig{StartPatterns: []string{`^\d{4}-\d{2}-\d{2}`}},
+		"2024-01-02 first", "  detail", "2024-01-02 second")
+	assert.Equal(t, []string{"2024-01-02 first\n  detail", "2024-01-02 second"}, res)
+
+	_, err := NewMultilineAssembler(MultilineConfig{Detectors: []string{"cobol"}})
+	assert.Error(t, err)
+}
+
+func TestMultilineFlushTimeout(t *testing.T) {
+	a, err := NewMultilineAssembler(MultilineConfig{FlushTimeout: 20 * time.Millisecond})
+	assert.NoError(t, err)
+	in := make(chan Message)
+	out := make(chan Message)
+	done := make(chan struct{})
+	defer close(done)
+	go a.Run(in, out, done)
+	in <- Message{Content: "java.lang.RuntimeException"}
+	in <- Message{Content: "\tat App.main(App.java:1)"}
+	select {
+	case m := <-out:
+		assert.Equal(t, "java.lang.RuntimeException\n\tat App.main(App.java:1)", m.Content)
+	case <-time.After(time.Second):
+		t.Fatal("pending message wasn't flushed")
+	}
+}
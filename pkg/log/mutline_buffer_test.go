@@ -1,7 +1,69 @@
 package log
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
 
 func TestMutlineBuffer(t *testing.T) {
+	b := NewMessageBuffer(MessageBufferConfig{MaxLines: 2, Timeout: time.Hour})
+	b.Add(Message{Content: "first"})
+	b.Add(Message{Content: ""})
+	b.Add(Message{Content: "second"})
+	batch := <-b.MessagesChan
+	assert.Len(t, batch, 2)
+
+	b.Add(Message{Content: "third"})
+	b.Close()
+	batch = <-b.MessagesChan
+	assert.Equal(t, "third", batch[0].Content)
+	_, ok := <-b.MessagesChan
+	assert.False(t, ok)
+	b.Add(Message{Content: "after close"})
+}
+
+func TestMessageBufferMaxBytes(t *testing.T) {
+	msg := Message{Content: "0123456789"}
+	b := NewMessageBuffer(MessageBufferConfig{MaxBytes: 2*messageSize(msg) + 1, Timeout: time.Hour})
+	defer b.Close()
+	for i := 0; i < 3; i++ {
+		b.Add(msg)
+	}
+	assert.Len(t, <-b.MessagesChan, 2)
+	assert.Len(t, b.MessagesChan, 0)
+}
+
+func TestMessageBufferTimeout(t *testing.T) {
+	b := NewMessageBuffer(MessageBufferConfig{Timeout: 20 * time.Millisecond})
+	defer b.Close()
+	b.Add(Message{Content: "quiet"})
+	select {
+	case batch := <-b.MessagesChan:
+		assert.Len(t, batch, 1)
+	case <-time.After(time.Second):
+		t.Fatal("partial batch wasn't flushed")
+	}
+}
 
+func TestMessageBufferOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		policy OverflowPolicy
+		first  string
+	}{
+		{OverflowDropNewest, "0"},
+		{OverflowDropOldest, "2"},
+	} {
+		b := NewMessageBuffer(MessageBufferConfig{MaxLines: 1, QueueSize: 2, Timeout: time.Hour, Overflow: tc.policy})
+		for i := 0; i < 4; i++ {
+			b.Add(Message{Content: fmt.Sprint(i)})
+		}
+		batches, messages := b.Dropped()
+		assert.Equal(t, uint64(2), batches)
+		assert.Equal(t, uint64(2), messages)
+		assert.Equal(t, tc.first, (<-b.MessagesChan)[0].Content)
+		b.Close()
+	}
 }
@@ -0,0 +1,170 @@
+package log
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultPatternSimilarity    = 0.6
+	defaultMaxPatternsPerSource = 500
+	patternSampleLen            = 256
+	patternWildcard             = "<*>"
+)
+
+var (
+	// masks are applied to every word in order, the first match replaces the word
+	patternMasks = []struct {
+		re   *regexp.Regexp
+		mask string
+	}{
+		{regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`), "<uuid>"},
+		{regexp.MustCompile(`^\d{1,3}(\.\d{1,3}){3}(:\d+)?$`), "<ip>"},
+		{regexp.MustCompile(`^0x[0-9a-fA-F]+$`), "<num>"},
+		{regexp.MustCompile(`^[+-]?\d+([.,:]\d+)*([a-zA-Zµ%]{1,3})?$`), "<num>"},
+		{regexp.MustCompile(`^\[?[0-9a-fA-F]{0,4}(:[0-9a-fA-F]{0,4}){2,7}\]?(:\d+)?$`), "<ip>"},
+		{regexp.MustCompile(`^[0-9a-fA-F]*\d[0-9a-fA-F]*$`), "<id>"},
+		{regexp.MustCompile(`^[\w.-]*\d[\w.-]*$`), "<id>"},
+	}
+	patternTrimChars = `"'()[]{}<>,;`
+)
+
+// Pattern is a group of similar log lines, the words that differ between them are replaced by a wildcard.
+type Pattern struct {
+	Hash   string
+	Sample string
+	words  []string
+}
+
+func (p *Pattern) String() string {
+	return strings.Join(p.words, " ")
+}
+
+// similarity returns the share of words that are equal in both patterns, wildcards match any word.
+func (p *Pattern) similarity(words []string) float64 {
+	equal := 0
+	for i, w := range p.words {
+		if w == words[i] || w == patternWildcard {
+			equal++
+		}
+	}
+	return float64(equal) / float64(len(words))
+}
+
+func (p *Pattern) merge(words []string) {
+	for i, w := range p.words {
+		if w != words[i] {
+			p.words[i] = patternWildcard
+		}
+	}
+}
+
+// PatternClassifier groups the log lines of every source into patterns.
+// Variable parts like numbers, ids and addresses are masked first, then a line joins
+// the most similar pattern with the same number of words. It isn't safe for concurrent use.
+type PatternClassifier struct {
+	similarity  float64
+	maxPatterns int
+	sources     map[string]*sourcePatterns
+	now         func() time.Time
+}
+
+type sourcePatterns struct {
+	byLength map[int][]*Pattern
+	count    int
+	lastSeen time.Time
+}
+
+func NewPatternClassifier(similarity float64, maxPatternsPerSource int) *PatternClassifier {
+	if similarity <= 0 || similarity > 1 {
+		similarity = defaultPatternSimilarity
+	}
+	if maxPatternsPerSource <= 0 {
+		maxPatternsPerSource = defaultMaxPatternsPerSource
+	}
+	return &PatternClassifier{similarity: similarity, maxPatterns: maxPatternsPerSource, sources: map[string]*sourcePatterns{}, now: time.Now}
+}
+
+// Classify returns the pattern of the first line of content, or nil when the line is empty
+// or the source already has too many patterns.
+func (c *PatternClassifier) Classify(source, content string) *Pattern {
+	line, _, _ := strings.Cut(content, "\n")
+	words := patternWords(line)
+	if len(words) == 0 {
+		return nil
+	}
+	sp := c.sources[source]
+	if sp == nil {
+		sp = &sourcePatterns{byLength: map[int][]*Pattern{}}
+		c.sources[source] = sp
+	}
+	sp.lastSeen = c.now()
+	var best *Pattern
+	bestSimilarity := 0.0
+	for _, p := range sp.byLength[len(words)] {
+		if s := p.similarity(words); s >= c.similarity && s > bestSimilarity {
+			best, bestSimilarity = p, s
+		}
+	}
+	if best != nil {
+		best.merge(words)
+		return best
+	}
+	if sp.count >= c.maxPatterns {
+		return nil
+	}
+	sum := md5.Sum([]byte(source + "\n" + strings.Join(words, " ")))
+	p := &Pattern{Hash: hex.EncodeToString(sum[:]), Sample: patternSample(line), words: words}
+	sp.byLength[len(words)] = append(sp.byLength[len(words)], p)
+	sp.count++
+	return p
+}
+
+// Expire forgets the patterns of the sources that had no lines for the idle duration and returns the sources,
+// so the patterns of removed containers don't pile up.
+func (c *PatternClassifier) Expire(idle time.Duration) []string {
+	var expired []string
+	deadline := c.now().Add(-idle)
+	for source, sp := range c.sources {
+		if sp.lastSeen.Before(deadline) {
+			delete(c.sources, source)
+			expired = append(expired, source)
+		}
+	}
+	return expired
+}
+
+// patternSample cuts the line on a rune boundary, the journal lines aren't always valid UTF-8
+func patternSample(line string) string {
+	if len(line) > patternSampleLen {
+		n := patternSampleLen
+		for n > 0 && !utf8.RuneStart(line[n]) {
+			n--
+		}
+		line = line[:n]
+	}
+	return strings.ToValidUTF8(line, "\ufffd")
+}
+
+func patternWords(line string) []string {
+	fields := strings.Fields(line)
+	words := make([]string, 0, len(fields))
+	for _, f := range fields {
+		w := strings.Trim(f, patternTrimChars)
+		if w == "" {
+			continue
+		}
+		for _, m := range patternMasks {
+			if m.re.MatchString(w) {
+				w = m.mask
+				break
+			}
+		}
+		words = append(words, w)
+	}
+	return words
+}
@@ -0,0 +1,52 @@
+package log
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPatternClassifier(t *testing.T) {
+	c := NewPatternClassifier(0, 0)
+	p1 := c.Classify("app", "connection from 10.0.0.1:5432 closed after 150ms")
+	p2 := c.Classify("app", "connection from 10.0.0.2:5433 closed after 3s")
+	assert.Same(t, p1, p2)
+	assert.Equal(t, "connection from <ip> closed after <num>", p1.String())
+	assert.Equal(t, "connection from 10.0.0.1:5432 closed after 150ms", p1.Sample)
+
+	p3 := c.Classify("app", "user 3f2504e0-4f89-11d3-9a0c-0305e82c3301 logged in")
+	assert.NotSame(t, p1, p3)
+	assert.Equal(t, "user <uuid> logged in", p3.String())
+
+	p4 := c.Classify("app", "user alice logged in")
+	assert.Same(t, p3, p4)
+	assert.Equal(t, "user <*> logged in", p3.String())
+
+	assert.NotEqual(t, p1.Hash, c.Classify("other", "connection from 10.0.0.1:5432 closed after 150ms").Hash)
+	assert.Nil(t, c.Classify("app", "   "))
+
+	c = NewPatternClassifier(0, 1)
+	assert.NotNil(t, c.Classify("app", "first pattern"))
+	assert.Nil(t, c.Classify("app", "a completely different line"))
+}
+
+func TestPatternSampleAndExpire(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := NewPatternClassifier(0, 0)
+	c.now = func() time.Time { return now }
+
+	// the cut falls in the middle of a rune, and the line has an invalid byte
+	line := "\xff" + strings.Repeat("a", patternSampleLen-2) + "é tail"
+	p := c.Classify("app", line)
+	assert.True(t, utf8.ValidString(p.Sample))
+	assert.Equal(t, "�"+strings.Repeat("a", patternSampleLen-2), p.Sample)
+
+	now = now.Add(time.Minute)
+	c.Classify("other", "still logging")
+	assert.Equal(t, []string{"app"}, c.Expire(30*time.Second))
+	assert.Nil(t, c.Expire(30*time.Second))
+	assert.NotSame(t, p, c.Classify("app", line))
+}
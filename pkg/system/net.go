@@ -7,6 +7,8 @@ import (
 	"encoding/hex"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 
 	"inet.af/netaddr"
 )
@@ -111,3 +113,22 @@ func decodeAddr(src []byte) netaddr.IPPort {
 	}
 	return netaddr.IPPortFrom(ipp, binary.BigEndian.Uint16(port))
 }
+
+// GetSocket returns the TCP socket open as fd by the process, or nil when fd isn't one.
+func GetSocket(pid uint32, fd uint64) (*Sock, error) {
+	dest, err := os.Readlink(Path(pid, "fd", strconv.FormatUint(fd, 10)))
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(dest, "socket:[") || !strings.HasSuffix(dest, "]") {
+		return nil, nil
+	}
+	inode := dest[len("socket:[") : len(dest)-1]
+	socks, err := GetSockets(pid)
+	for _, s := range socks {
+		if s.Inode == inode {
+			return &s, nil
+		}
+	}
+	return nil, err
+}